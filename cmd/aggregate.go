@@ -18,10 +18,13 @@ var aggregateCmd = &cobra.Command{
 	Long: `The event aggregator is the consumer of events that are published from our IOT devices. 
 		A subscription is created and and the specified number of worker threaders are started in background 
 		that will continuously process events put on their shared event queue. Events are slightly massaged from protobuf
-		serialized objects to plain json objects and then stored in rethinkdb.`,
+		serialized objects to plain json objects and then stored in rethinkdb. Each interaction is stored with the store,
+		fixture, aisle and timezone metadata of the device that published it, metadata is cached for --metadata-ttl.
+		With --catalog interactions are stored with the catalog name, category and price of their product, interactions
+		with product IDs missing from the catalog are dropped.`,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if threads < 1 {
-			return fmt.Errorf("invalid value for threads %s", threads)
+			return fmt.Errorf("invalid value for threads %d", threads)
 		}
 
 		if threads > 5 {
@@ -41,13 +44,19 @@ var aggregateCmd = &cobra.Command{
 }
 
 func aggregateRun() error {
-	registry, err := core.NewDeviceRegistry(projectID, region, registryID, topicID).Init(false)
+	registry, err := newDeviceRegistry().Init(rootCtx, false)
 	if err != nil {
 		return err
 	}
 
-	aggregator := core.NewEventListener(registry, threads)
-	err = aggregator.Start(host, database)
+	aggregator := core.NewEventListener(clients, registry, threads)
+	aggregator.Metadata.TTL = viper.GetDuration("metadata-ttl")
+	if path := viper.GetString("catalog"); path != "" {
+		if aggregator.Catalog, err = core.LoadCatalog(path); err != nil {
+			return err
+		}
+	}
+	err = aggregator.Start(rootCtx, host, database)
 	if err != nil {
 		return err
 	}
@@ -60,7 +69,10 @@ func init() {
 	aggregateCmd.PersistentFlags().StringVarP(&host, "rethinkdb", "H", "127.0.0.1:28015", "Full endpoint to rethinkdb server")
 	aggregateCmd.PersistentFlags().StringVarP(&database, "database", "D", "interactions", "Name of rethinkdb database to store events")
 
+	aggregateCmd.PersistentFlags().Duration("metadata-ttl", core.DefaultMetadataTTL, "How long the store and fixture metadata of a device is cached before it is looked up again")
+
 	_ = viper.BindPFlag("threads", aggregateCmd.PersistentFlags().Lookup("threads"))
 	_ = viper.BindPFlag("rethinkdb", aggregateCmd.PersistentFlags().Lookup("rethinkdb"))
 	_ = viper.BindPFlag("database", aggregateCmd.PersistentFlags().Lookup("database"))
+	_ = viper.BindPFlag("metadata-ttl", aggregateCmd.PersistentFlags().Lookup("metadata-ttl"))
 }
@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/cloudiot/v1"
+	"os"
+	"text/tabwriter"
+)
+
+var (
+	describeStates     int64
+	createGateway      bool
+	rotateKeepExisting bool
+	createKeyAlgorithm string
+	createMetadata     core.DeviceMetadata
+	deviceRegistry     *core.DeviceRegistry
+)
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "Manage the devices of the IoT Core registry",
+	Long: `List, inspect, create and delete devices of the registry selected by the global flags. Keys of created
+		devices and rotated keys are saved in the keystore (--keystore) so the simulator can connect as them.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateOutput(); err != nil {
+			return err
+		}
+
+		var err error
+		deviceRegistry, err = newDeviceRegistry().Init(rootCtx, false)
+		return err
+	},
+}
+
+var devicesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the devices of the registry",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		devices, err := deviceRegistry.ListDevices(rootCtx)
+		if err != nil {
+			return err
+		}
+
+		if outputFormat == outputJSON {
+			return printJSON(devices)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "DEVICE ID\tNUM ID\tGATEWAY\tBLOCKED\tSTORE\tFIXTURE\tLAST EVENT\tLAST HEARTBEAT")
+		for _, device := range devices {
+			metadata := core.MetadataOf(device)
+			fmt.Fprintf(w, "%s\t%d\t%t\t%t\t%s\t%s\t%s\t%s\n",
+				device.Id, device.NumId, core.IsGateway(device), device.Blocked, orDash(metadata.StoreID), orDash(metadata.Fixture),
+				orDash(device.LastEventTime), orDash(device.LastHeartbeatTime))
+		}
+
+		return w.Flush()
+	},
+}
+
+var devicesDescribeCmd = &cobra.Command{
+	Use:   "describe <device-id>",
+	Short: "Show the details of a device and, with --states, the states it reported",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		device, err := deviceRegistry.GetDevice(rootCtx, args[0])
+		if err != nil {
+			return err
+		}
+
+		var states []*core.DeviceStateRecord
+		if describeStates > 0 {
+			states, err = deviceRegistry.DeviceStates(rootCtx, args[0], describeStates)
+			if err != nil {
+				return err
+			}
+		}
+
+		if outputFormat == outputJSON {
+			return printJSON(struct {
+				Device *cloudiot.Device          `json:"device"`
+				States []*core.DeviceStateRecord `json:"states,omitempty"`
+			}{device, states})
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintf(w, "ID:\t%s\n", device.Id)
+		fmt.Fprintf(w, "NUM ID:\t%d\n", device.NumId)
+		fmt.Fprintf(w, "NAME:\t%s\n", device.Name)
+		fmt.Fprintf(w, "GATEWAY:\t%t\n", core.IsGateway(device))
+		fmt.Fprintf(w, "BLOCKED:\t%t\n", device.Blocked)
+		metadata := core.MetadataOf(device)
+		fmt.Fprintf(w, "STORE:\t%s\n", orDash(metadata.StoreID))
+		fmt.Fprintf(w, "FIXTURE:\t%s\n", orDash(metadata.Fixture))
+		fmt.Fprintf(w, "AISLE:\t%s\n", orDash(metadata.Aisle))
+		fmt.Fprintf(w, "TIMEZONE:\t%s\n", orDash(metadata.Timezone))
+		fmt.Fprintf(w, "LAST EVENT:\t%s\n", orDash(device.LastEventTime))
+		fmt.Fprintf(w, "LAST HEARTBEAT:\t%s\n", orDash(device.LastHeartbeatTime))
+		fmt.Fprintf(w, "LAST STATE:\t%s\n", orDash(device.LastStateTime))
+		fmt.Fprintf(w, "LAST CONFIG ACK:\t%s\n", orDash(device.LastConfigAckTime))
+		if device.LastErrorStatus != nil {
+			fmt.Fprintf(w, "LAST ERROR:\t%s %s\n", device.LastErrorTime, device.LastErrorStatus.Message)
+		}
+
+		for i, credential := range device.Credentials {
+			if credential.PublicKey == nil {
+				continue
+			}
+
+			fmt.Fprintf(w, "CREDENTIAL %d:\t%s expires %s\n", i, credential.PublicKey.Format, orDash(credential.ExpirationTime))
+		}
+
+		if err = w.Flush(); err != nil {
+			return err
+		}
+
+		if len(states) == 0 {
+			return nil
+		}
+
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "UPDATED\tSESSION\tEVENTS SENT\tUPTIME\tFIRMWARE\tLAST ERROR")
+		for _, record := range states {
+			state := record.State
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+				record.UpdateTime, orDash(state.SessionID), state.EventsSent, state.Uptime, state.FirmwareVersion, orDash(state.LastError))
+		}
+
+		return w.Flush()
+	},
+}
+
+var devicesCreateCmd = &cobra.Command{
+	Use:   "create [device-id]",
+	Short: "Create a device with a new key, a random ID is generated when none is given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !core.ValidKeyAlgorithm(createKeyAlgorithm) {
+			return fmt.Errorf("invalid value for key-algorithm %s", createKeyAlgorithm)
+		}
+
+		if err := createMetadata.Validate(); err != nil {
+			return err
+		}
+
+		store, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+
+		device := core.NewDevice(clients, projectID, region, registryID, deviceRegistry.RegistryName())
+		device.KeyAlgorithm = createKeyAlgorithm
+		device.Gateway = createGateway
+		device.Metadata = createMetadata
+		if len(args) == 1 {
+			device.SetID(args[0])
+		}
+
+		// creating a device without a key replaces any device with the same id
+		if _, err = deviceRegistry.GetDevice(rootCtx, device.DeviceID); err == nil {
+			return fmt.Errorf("device %s already exists", device.DeviceID)
+		}
+
+		if _, err = device.Init(rootCtx); err != nil {
+			return err
+		}
+
+		if store == nil {
+			logger.WithField("device-id", device.DeviceID).Warnln("no keystore configured, the device key was not saved")
+		} else if err = saveIdentity(store, device); err != nil {
+			return err
+		}
+
+		logger.WithField("device-id", device.DeviceID).
+			WithField("algorithm", createKeyAlgorithm).
+			WithField("gateway", createGateway).
+			WithField("store-id", createMetadata.StoreID).
+			Infoln("created device")
+		return nil
+	},
+}
+
+var devicesDeleteCmd = &cobra.Command{
+	Use:   "delete <device-id>...",
+	Short: "Delete devices",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, deviceID := range args {
+			if err := deviceRegistry.DeleteDevice(rootCtx, deviceID); err != nil {
+				return fmt.Errorf("error deleting %s: %s", deviceID, err)
+			}
+
+			logger.WithField("device-id", deviceID).Infoln("deleted device")
+		}
+
+		return nil
+	},
+}
+
+var devicesBlockCmd = &cobra.Command{
+	Use:   "block <device-id>...",
+	Short: "Block devices, blocked devices can not connect",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setBlocked(args, true)
+	},
+}
+
+var devicesUnblockCmd = &cobra.Command{
+	Use:   "unblock <device-id>...",
+	Short: "Unblock devices",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setBlocked(args, false)
+	},
+}
+
+var devicesRotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key <device-id>",
+	Short: "Replace the key of a device with a new one saved in the keystore",
+	Long: `Generates a new key and certificate, registers it as the device credential and saves it in the keystore.
+		With --keep-existing the previous credentials stay valid so connected devices can switch over gradually.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+
+		if store == nil {
+			return fmt.Errorf("--keystore is required, the new key would be lost otherwise")
+		}
+
+		existing, err := deviceRegistry.GetDevice(rootCtx, args[0])
+		if err != nil {
+			return err
+		}
+
+		device := core.NewDevice(clients, projectID, region, registryID, deviceRegistry.RegistryName())
+		device.SetID(args[0])
+		device.KeyAlgorithm = createKeyAlgorithm
+		if identity, err := store.Get(args[0]); err == nil {
+			device.KeyAlgorithm = identity.KeyAlgorithm
+		}
+
+		if err = device.NewKey(); err != nil {
+			return err
+		}
+
+		credentials := []*cloudiot.DeviceCredential{device.Credential()}
+		if rotateKeepExisting {
+			credentials = append(credentials, existing.Credentials...)
+		}
+
+		if _, err = deviceRegistry.SetDeviceCredentials(rootCtx, device.DeviceID, credentials); err != nil {
+			return err
+		}
+
+		if err = saveIdentity(store, device); err != nil {
+			return err
+		}
+
+		logger.WithField("device-id", device.DeviceID).
+			WithField("algorithm", device.KeyAlgorithm).
+			WithField("credentials", len(credentials)).
+			Infoln("rotated device key")
+		return nil
+	},
+}
+
+func setBlocked(deviceIDs []string, blocked bool) error {
+	for _, deviceID := range deviceIDs {
+		if _, err := deviceRegistry.SetDeviceBlocked(rootCtx, deviceID, blocked); err != nil {
+			return fmt.Errorf("error updating %s: %s", deviceID, err)
+		}
+
+		logger.WithField("device-id", deviceID).WithField("blocked", blocked).Infoln("updated device")
+	}
+
+	return nil
+}
+
+func init() {
+	addOutputFlag(devicesCmd)
+
+	devicesDescribeCmd.Flags().Int64Var(&describeStates, "states", 0, "Number of recent device states to show")
+
+	devicesCreateCmd.Flags().BoolVar(&createGateway, "gateway", false, "Create the device as a gateway")
+	devicesCreateCmd.Flags().StringVar(&createKeyAlgorithm, "key-algorithm", core.KeyAlgorithmRS256, "Algorithm of the generated key: RS256 or ES256")
+
+	devicesCreateCmd.Flags().StringVar(&createMetadata.StoreID, "store-id", "", "ID of the store the device is installed in")
+	devicesCreateCmd.Flags().StringVar(&createMetadata.Fixture, "fixture", "", "Fixture the device is mounted on")
+	devicesCreateCmd.Flags().StringVar(&createMetadata.Aisle, "aisle", "", "Aisle of the fixture")
+	devicesCreateCmd.Flags().StringVar(&createMetadata.Timezone, "timezone", "", "IANA timezone of the store e.g. America/New_York")
+
+	devicesRotateKeyCmd.Flags().BoolVar(&rotateKeepExisting, "keep-existing", false, "Keep the current credentials next to the new one")
+	devicesRotateKeyCmd.Flags().StringVar(&createKeyAlgorithm, "key-algorithm", core.KeyAlgorithmRS256, "Algorithm of the new key when the keystore does not know the device")
+
+	devicesCmd.AddCommand(devicesListCmd, devicesDescribeCmd, devicesCreateCmd, devicesDeleteCmd,
+		devicesBlockCmd, devicesUnblockCmd, devicesRotateKeyCmd)
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	importDeviceID, importKeyPath, importCertPath, exportDir string
+)
+
+var identitiesCmd = &cobra.Command{
+	Use:   "identities",
+	Short: "Manage the device identities saved in a keystore",
+	Long: `Device identities are the device ID, private key and certificate a simulated or real device connects with.
+		Saving them in a keystore (--keystore) lets a simulated fleet keep the same identities across runs, keys of
+		real devices can be imported so the simulator can act on their behalf.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("keystore") == "" {
+			return fmt.Errorf("--keystore is required")
+		}
+
+		return nil
+	},
+}
+
+var identitiesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the identities saved in the keystore",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+
+		identities, err := store.List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "DEVICE ID\tALGORITHM\tCERT EXPIRES")
+		for _, identity := range identities {
+			expires := "-"
+			if cert, err := identity.Cert(); err == nil {
+				expires = cert.NotAfter.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\n", identity.DeviceID, identity.KeyAlgorithm, expires)
+		}
+
+		return w.Flush()
+	},
+}
+
+var identitiesImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import the private key, and optionally the certificate, of a device into the keystore",
+	Long: `Imports a PEM encoded RSA or P-256 EC private key. When no certificate is given a self signed certificate
+		is created for the key, the algorithm (RS256 or ES256) is detected from the key type.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(importKeyPath)
+		if err != nil {
+			return fmt.Errorf("error reading key %s", err)
+		}
+
+		key, err := core.ParsePrivateKey(b)
+		if err != nil {
+			return err
+		}
+
+		device := core.NewDevice(clients, projectID, region, registryID, core.RegistryName(projectID, region, registryID))
+		if importDeviceID == "" {
+			importDeviceID = device.DeviceID
+		}
+
+		var identity *core.Identity
+		if importCertPath != "" {
+			certPEM, err := ioutil.ReadFile(importCertPath)
+			if err != nil {
+				return fmt.Errorf("error reading cert %s", err)
+			}
+
+			identity, err = core.NewIdentity(importDeviceID, key, string(certPEM))
+			if err != nil {
+				return err
+			}
+
+			if _, err = identity.Cert(); err != nil {
+				return fmt.Errorf("invalid cert %s: %s", importCertPath, err)
+			}
+		} else {
+			err = device.UseKey(key)
+			if err != nil {
+				return err
+			}
+
+			identity, err = core.NewIdentity(importDeviceID, key, device.Certs.Pem)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = store.Put(identity)
+		if err != nil {
+			return err
+		}
+
+		logger.WithField("device-id", identity.DeviceID).
+			WithField("algorithm", identity.KeyAlgorithm).
+			Infoln("imported device identity")
+		return nil
+	},
+}
+
+var identitiesExportCmd = &cobra.Command{
+	Use:   "export <device-id>",
+	Short: "Export the private key and certificate of a device as PEM files",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+
+		identity, err := store.Get(args[0])
+		if err != nil {
+			return fmt.Errorf("error loading %s: %s", args[0], err)
+		}
+
+		keyPath := filepath.Join(exportDir, fmt.Sprintf("%s_private.pem", identity.DeviceID))
+		err = ioutil.WriteFile(keyPath, []byte(identity.PrivateKey), 0600)
+		if err != nil {
+			return err
+		}
+
+		certPath := filepath.Join(exportDir, fmt.Sprintf("%s_cert.pem", identity.DeviceID))
+		err = ioutil.WriteFile(certPath, []byte(identity.Certificate), 0644)
+		if err != nil {
+			return err
+		}
+
+		logger.WithField("key", keyPath).WithField("cert", certPath).Infoln("exported device identity")
+		return nil
+	},
+}
+
+func init() {
+	identitiesImportCmd.Flags().StringVar(&importDeviceID, "device-id", "", "ID of the imported device, a random ID is generated when empty")
+	identitiesImportCmd.Flags().StringVar(&importKeyPath, "key", "", "Path to a PEM encoded private key")
+	identitiesImportCmd.Flags().StringVar(&importCertPath, "cert", "", "Path to a PEM encoded certificate for the key")
+	_ = identitiesImportCmd.MarkFlagRequired("key")
+
+	identitiesExportCmd.Flags().StringVar(&exportDir, "out", ".", "Directory the PEM files are written to")
+
+	identitiesCmd.AddCommand(identitiesListCmd, identitiesImportCmd, identitiesExportCmd)
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+var loadTestCmd = &cobra.Command{
+	Use:   "loadtest",
+	Short: "Publish a target rate of events from thousands of simulated devices and report publish latency and throughput",
+	Long: `The load test connects --devices simulated devices, or the device groups of --scenario, and publishes events
+		from them in three stages. During --ramp-up the target rate grows from 0 to --rate events per second and devices
+		join one after another, --steady holds the rate with every device and --ramp-down brings both back to 0. Every
+		active device publishes one event at a time, the rate is shared out between them.
+
+		The report lists per stage and for the whole run the target and achieved events per second, publish latency
+		percentiles, errors by type and the events that were dropped because no active device was free to publish
+		them before the next tick. Dropped events mean more devices are needed to reach the rate. Interrupting the run reports the
+		stages that ran. The transport, gateway, catalog and metadata flags of the simulator apply, creating thousands of
+		devices is quickest with --key-algorithm ES256.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if loadDevices := viper.GetInt("devices"); loadDevices < 1 {
+			return fmt.Errorf("invalid value for devices %d", loadDevices)
+		}
+
+		if rate := viper.GetFloat64("rate"); rate <= 0 {
+			return fmt.Errorf("invalid value for rate %v", rate)
+		}
+
+		var total time.Duration
+		for _, stage := range []string{"ramp-up", "steady", "ramp-down"} {
+			d := viper.GetDuration(stage)
+			if d < 0 {
+				return fmt.Errorf("invalid value for %s %s", stage, d)
+			}
+
+			total += d
+		}
+
+		if total <= 0 {
+			return fmt.Errorf("the load test has no stages, set --ramp-up, --steady or --ramp-down")
+		}
+
+		for _, flag := range []string{"sessions", "iterations", "shopper", "speed", "start-time", "end-time"} {
+			if cmd.Flags().Changed(flag) {
+				return fmt.Errorf("--%s does not apply to load tests", flag)
+			}
+		}
+
+		if err := validateOutput(); err != nil {
+			return err
+		}
+
+		if err := validateSimulatorFlags(cmd); err != nil {
+			return err
+		}
+
+		var err error
+		simulation, err = simulatorScenario(cmd, viper.GetInt("devices"))
+		return err
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return RunLoadTest(rootCtx)
+	},
+}
+
+// RunLoadTest connects the devices of the simulation, runs the load test stages on them and prints the report,
+// once ctx is done the stages stop and the stages that ran are reported
+func RunLoadTest(ctx context.Context) error {
+	fleet, err := prepareFleet(ctx)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	if err = fleet.open(ctx); err != nil {
+		return err
+	}
+
+	devices := fleet.simulated()
+	logger.
+		WithField("devices", len(devices)).
+		WithField("took", time.Since(started).Round(time.Millisecond)).
+		Infoln("devices connected, starting load test")
+
+	test := core.NewLoadTest(devices, loadStages(len(devices)))
+	report := test.Run(ctx)
+	core.Metrics().Log()
+	if err = printLoadReport(report); err != nil {
+		logger.Errorln(err)
+	}
+
+	fleet.close()
+	return nil
+}
+
+// loadStages returns the ramp-up, steady and ramp-down stages of the flags, stages without a duration are
+// kept so the next stage starts where they end
+func loadStages(devices int) []core.LoadStage {
+	rate := viper.GetFloat64("rate")
+	return []core.LoadStage{
+		{Name: "ramp-up", Duration: viper.GetDuration("ramp-up"), Rate: rate, Devices: devices},
+		{Name: "steady", Duration: viper.GetDuration("steady"), Rate: rate, Devices: devices},
+		{Name: "ramp-down", Duration: viper.GetDuration("ramp-down")},
+	}
+}
+
+func printLoadReport(report *core.LoadReport) error {
+	if outputFormat == outputJSON {
+		return printJSON(report)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tDURATION\tTARGET EVT/S\tACHIEVED EVT/S\tPUBLISHED\tERRORS\tDROPPED\tP50\tP90\tP95\tP99\tMAX")
+	for _, stage := range append(report.Stages, report.Total) {
+		if stage.Seconds == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%d\t%d\t%d\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%.1fms\n",
+			stage.Name, time.Duration(stage.Seconds*float64(time.Second)).Round(time.Second), stage.TargetRate, stage.Throughput,
+			stage.Published, stage.Errors, stage.Dropped, stage.P50, stage.P90, stage.P95, stage.P99, stage.Max)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Total.ErrorTypes) == 0 {
+		return nil
+	}
+
+	errors := make([]string, 0, len(report.Total.ErrorTypes))
+	for err := range report.Total.ErrorTypes {
+		errors = append(errors, err)
+	}
+	sort.Slice(errors, func(i, j int) bool { return report.Total.ErrorTypes[errors[i]] > report.Total.ErrorTypes[errors[j]] })
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "COUNT\tERROR")
+	for _, err := range errors {
+		fmt.Fprintf(w, "%d\t%s\n", report.Total.ErrorTypes[err], err)
+	}
+
+	return w.Flush()
+}
+
+func init() {
+	loadTestCmd.Flags().Int("devices", 1000, "Number of simulated devices publishing events, replaced by the device groups of --scenario")
+	loadTestCmd.Flags().Float64("rate", 100, "Target events per second of the steady stage across every device")
+	loadTestCmd.Flags().Duration("ramp-up", 30*time.Second, "How long the rate and the number of publishing devices grow from 0")
+	loadTestCmd.Flags().Duration("steady", time.Minute, "How long the full rate is held")
+	loadTestCmd.Flags().Duration("ramp-down", 30*time.Second, "How long the rate and the number of publishing devices shrink back to 0")
+	addOutputFlag(loadTestCmd)
+
+	_ = viper.BindPFlag("devices", loadTestCmd.Flags().Lookup("devices"))
+	_ = viper.BindPFlag("rate", loadTestCmd.Flags().Lookup("rate"))
+	_ = viper.BindPFlag("ramp-up", loadTestCmd.Flags().Lookup("ramp-up"))
+	_ = viper.BindPFlag("steady", loadTestCmd.Flags().Lookup("steady"))
+	_ = viper.BindPFlag("ramp-down", loadTestCmd.Flags().Lookup("ramp-down"))
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core"
+	"github.com/kc1116/perch-interactive-challenge/core/fakeiot"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"net"
+	"os"
+	"path"
+)
+
+var localCmd = &cobra.Command{
+	Use:   "local",
+	Short: "Will run an MQTT broker, Pub/Sub and IoT Core API stand-in so the other commands can run without GCP",
+	Long: `Starts an embedded MQTT broker, a fake Pub/Sub server and a fake IoT Core API in one process. Events devices
+		publish to the broker on /devices/{id}/events are forwarded to the registry topic with the same attributes IoT
+		Core adds, states are recorded in the fake API and configs and commands sent through the API are delivered
+		on the broker. Run the other commands with --local to use it, simulated devices then publish to the local
+		broker and the aggregator subscribes to the local topic:
+
+		perch-iot-pubsub local
+		perch-iot-pubsub simulator --local
+		perch-iot-pubsub aggregate --local
+		perch-iot-pubsub devices list --local
+
+		--local points the pubsub client at localhost:8085 and the IoT Core client at localhost:8086 unless
+		PUBSUB_EMULATOR_HOST or CLOUDIOT_EMULATOR_HOST are set.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return localRun()
+	},
+}
+
+func localRun() error {
+	local, err := core.StartLocalPubSub(viper.GetString("pubsub-addr"))
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	broker := core.NewMQTTBroker()
+	iot := fakeiot.NewServer()
+	iot.OnConfig = func(deviceName string, data []byte) {
+		_ = broker.Publish(fmt.Sprintf("/devices/%s/config", path.Base(deviceName)), data)
+	}
+	iot.OnCommand = func(deviceName, subFolder string, data []byte) {
+		_ = broker.Publish(path.Join("/devices", path.Base(deviceName), "commands", subFolder), data)
+	}
+
+	listener, err := net.Listen("tcp", viper.GetString("iot-addr"))
+	if err != nil {
+		return fmt.Errorf("error starting local iot core api %s", err)
+	}
+
+	errs := make(chan error, 3)
+	go func() {
+		errs <- iot.Serve(listener)
+	}()
+	defer iot.Close()
+
+	// the registry below has to be created in the servers that were just started
+	if err = os.Setenv(core.PubSubEmulatorHostEnv, local.Addr); err != nil {
+		return err
+	}
+
+	if err = os.Setenv(core.CloudIoTEmulatorHostEnv, viper.GetString("iot-addr")); err != nil {
+		return err
+	}
+
+	registry := newDeviceRegistry()
+	registry.Local = true
+	if _, err = registry.Init(rootCtx, true); err != nil {
+		return fmt.Errorf("error creating local registry %s", err)
+	}
+
+	bridge := core.NewLocalBridge(registry)
+	bridge.OnState = func(deviceID string, payload []byte) {
+		if err := iot.ReportState(registry.DevicePath(deviceID), payload); err != nil {
+			logger.WithError(err).WithField("device-id", deviceID).Warnln("error recording device state")
+		}
+	}
+
+	broker.OnPublish = bridge.Forward
+	go func() {
+		errs <- broker.ListenAndServe(viper.GetString("mqtt-addr"))
+	}()
+
+	logger.
+		WithField("registry", registry.RegistryName()).
+		WithField("topic", registry.Topic.String()).
+		Infoln("forwarding device events to local pubsub")
+
+	select {
+	case err = <-errs:
+		return err
+	case <-rootCtx.Done():
+		return broker.Close()
+	}
+}
+
+func init() {
+	localCmd.PersistentFlags().String("mqtt-addr", core.DefaultLocalBrokerAddr, "Address the MQTT broker listens on")
+	localCmd.PersistentFlags().String("pubsub-addr", core.DefaultLocalPubSubAddr, "Address the Pub/Sub stand-in listens on")
+	localCmd.PersistentFlags().String("iot-addr", core.DefaultLocalIoTAddr, "Address the IoT Core API stand-in listens on")
+
+	_ = viper.BindPFlag("mqtt-addr", localCmd.PersistentFlags().Lookup("mqtt-addr"))
+	_ = viper.BindPFlag("pubsub-addr", localCmd.PersistentFlags().Lookup("pubsub-addr"))
+	_ = viper.BindPFlag("iot-addr", localCmd.PersistentFlags().Lookup("iot-addr"))
+}
@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+)
+
+var (
+	registryEventTopic, registryStateTopic, registryLogLevel string
+	registryMQTT, registryHTTP                               bool
+	deleteForce, deleteTopics                                bool
+	adminRegistry                                            *core.DeviceRegistry
+)
+
+var registryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "Manage the IoT Core registry and its Pub/Sub topics",
+	Long: `Create, inspect, update and delete the registry selected by the global flags (-p, -R, -r). Topics given
+		by ID are created in the project of the registry when they do not exist yet. Events of the subfolders given
+		with --route are published to their own topic, every other event goes to the event topic.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := validateOutput(); err != nil {
+			return err
+		}
+
+		if registryLogLevel != "" && !core.ValidLogLevel(registryLogLevel) {
+			return fmt.Errorf("invalid value for log-level %s", registryLogLevel)
+		}
+
+		adminRegistry = newDeviceRegistry()
+		return adminRegistry.InitClients()
+	},
+}
+
+var registryCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create the registry and its topics",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if adminRegistry.GetRegistry(rootCtx) != nil {
+			return fmt.Errorf("registry %s already exists", adminRegistry.RegistryName())
+		}
+
+		if registryEventTopic == "" {
+			registryEventTopic = topicID
+		}
+
+		settings, err := registrySettings()
+		if err != nil {
+			return err
+		}
+
+		registry, err := adminRegistry.CreateRegistryWithSettings(rootCtx, settings)
+		if err != nil {
+			return err
+		}
+
+		logger.WithField("registry", registry.Name).Infoln("created registry")
+		return printRegistry()
+	},
+}
+
+var registryDescribeCmd = &cobra.Command{
+	Use:   "describe",
+	Short: "Show the configuration of the registry",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return printRegistry()
+	},
+}
+
+var registryUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Change the topics, protocols or log level of the registry",
+	Long: `Only the settings passed on the command line are changed, e.g. to turn off the HTTP bridge and
+		log errors of devices:
+
+		perch-iot-pubsub registry update --http=false --log-level ERROR
+
+		Passing --route replaces every route, the event topic is kept unless --event-topic is passed as well.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if adminRegistry.GetRegistry(rootCtx) == nil {
+			return fmt.Errorf("registry %s not found", adminRegistry.RegistryName())
+		}
+
+		var fields []string
+		for _, setting := range []struct{ flag, field string }{
+			{"event-topic", core.RegistryFieldEventTopics},
+			{"route", core.RegistryFieldEventTopics},
+			{"state-topic", core.RegistryFieldStateTopic},
+			{"mqtt", core.RegistryFieldMQTT},
+			{"http", core.RegistryFieldHTTP},
+			{"log-level", core.RegistryFieldLogLevel},
+		} {
+			if cmd.Flags().Changed(setting.flag) && (len(fields) == 0 || fields[len(fields)-1] != setting.field) {
+				fields = append(fields, setting.field)
+			}
+		}
+
+		if len(fields) == 0 {
+			return fmt.Errorf("nothing to update, pass at least one of --event-topic, --route, --state-topic, --mqtt, --http or --log-level")
+		}
+
+		settings, err := registrySettings()
+		if err != nil {
+			return err
+		}
+
+		// event topics are a single field, the half that was not passed is kept
+		if !cmd.Flags().Changed("route") {
+			settings.EventRoutes = nil
+		}
+
+		current := core.EventRoutes(adminRegistry.GetRegistry(rootCtx))
+		for _, route := range current {
+			if route.SubFolder == "" && !cmd.Flags().Changed("event-topic") {
+				settings.EventTopic = route.Topic
+			} else if route.SubFolder != "" && !cmd.Flags().Changed("route") {
+				settings.EventRoutes = append(settings.EventRoutes, route)
+			}
+		}
+
+		registry, err := adminRegistry.UpdateRegistry(rootCtx, settings, fields...)
+		if err != nil {
+			return err
+		}
+
+		logger.WithField("registry", registry.Name).WithField("fields", fields).Infoln("updated registry")
+		return printRegistry()
+	},
+}
+
+var registryDeleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete the registry and, with --topics, the topics it publishes to",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registry := adminRegistry.GetRegistry(rootCtx)
+		if registry == nil {
+			return fmt.Errorf("registry %s not found", adminRegistry.RegistryName())
+		}
+
+		if err := adminRegistry.DeleteRegistry(rootCtx, deleteForce); err != nil {
+			return fmt.Errorf("error deleting registry %s, registries with devices need --force", err)
+		}
+
+		logger.WithField("registry", registry.Name).Infoln("deleted registry")
+		if !deleteTopics {
+			return nil
+		}
+
+		for _, topic := range core.RegistryTopics(registry) {
+			if err := adminRegistry.DeleteTopic(rootCtx, topic); err != nil {
+				return fmt.Errorf("error deleting topic %s: %s", topic, err)
+			}
+
+			logger.WithField("topic", topic).Infoln("deleted topic")
+		}
+
+		return nil
+	},
+}
+
+// registrySettings returns the settings passed on the command line, the topics are created when missing
+func registrySettings() (*core.RegistrySettings, error) {
+	settings := &core.RegistrySettings{
+		MQTTEnabled: registryMQTT,
+		HTTPEnabled: registryHTTP,
+		LogLevel:    registryLogLevel,
+	}
+
+	for _, topic := range []struct {
+		id   string
+		name *string
+	}{{registryEventTopic, &settings.EventTopic}, {registryStateTopic, &settings.StateTopic}} {
+		if topic.id == "" {
+			continue
+		}
+
+		topicID, err := core.TopicID(projectID, topic.id)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = adminRegistry.EnsureTopic(rootCtx, topicID); err != nil {
+			return nil, fmt.Errorf("error creating topic %s: %s", topic.id, err)
+		}
+
+		*topic.name = core.TopicName(projectID, topicID)
+	}
+
+	routes, err := adminRegistry.EnsureRouteTopics(rootCtx, eventRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.EventRoutes = routes
+	return settings, nil
+}
+
+func printRegistry() error {
+	registry := adminRegistry.GetRegistry(rootCtx)
+	if registry == nil {
+		return fmt.Errorf("registry %s not found", adminRegistry.RegistryName())
+	}
+
+	if outputFormat == outputJSON {
+		return printJSON(registry)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", registry.Id)
+	fmt.Fprintf(w, "NAME:\t%s\n", registry.Name)
+	for _, route := range core.EventRoutes(registry) {
+		if route.SubFolder == "" {
+			fmt.Fprintf(w, "EVENT TOPIC:\t%s\n", route.Topic)
+		} else {
+			fmt.Fprintf(w, "EVENT ROUTE:\t%s -> %s\n", route.SubFolder, route.Topic)
+		}
+	}
+
+	stateTopic := ""
+	if registry.StateNotificationConfig != nil {
+		stateTopic = registry.StateNotificationConfig.PubsubTopicName
+	}
+	fmt.Fprintf(w, "STATE TOPIC:\t%s\n", orDash(stateTopic))
+
+	mqtt, http := "", ""
+	if registry.MqttConfig != nil {
+		mqtt = registry.MqttConfig.MqttEnabledState
+	}
+	if registry.HttpConfig != nil {
+		http = registry.HttpConfig.HttpEnabledState
+	}
+	fmt.Fprintf(w, "MQTT:\t%s\n", orDash(mqtt))
+	fmt.Fprintf(w, "HTTP:\t%s\n", orDash(http))
+	fmt.Fprintf(w, "LOG LEVEL:\t%s\n", orDash(registry.LogLevel))
+	fmt.Fprintf(w, "CREDENTIALS:\t%d\n", len(registry.Credentials))
+
+	return w.Flush()
+}
+
+func addRegistrySettingsFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&registryEventTopic, "event-topic", "", "ID or full name of the topic device events are published to, the topic has to be in --projectID, defaults to --topicID on create")
+	cmd.Flags().StringVar(&registryStateTopic, "state-topic", "", "ID or full name of the topic device state changes are published to, the topic has to be in --projectID")
+	cmd.Flags().BoolVar(&registryMQTT, "mqtt", true, "Whether devices may connect through the MQTT bridge")
+	cmd.Flags().BoolVar(&registryHTTP, "http", true, "Whether devices may connect through the HTTP bridge")
+	cmd.Flags().StringVar(&registryLogLevel, "log-level", "", "Default log level of devices: NONE, ERROR, INFO or DEBUG")
+}
+
+func init() {
+	addOutputFlag(registryCmd)
+	addRegistrySettingsFlags(registryCreateCmd)
+	addRegistrySettingsFlags(registryUpdateCmd)
+
+	registryDeleteCmd.Flags().BoolVar(&deleteForce, "force", false, "Unbind and delete every device of the registry first")
+	registryDeleteCmd.Flags().BoolVar(&deleteTopics, "topics", false, "Also delete the event and state topics of the registry")
+
+	registryCmd.AddCommand(registryCreateCmd, registryDescribeCmd, registryUpdateCmd, registryDeleteCmd)
+}
@@ -1,15 +1,26 @@
 package cmd
 
 import (
+	"context"
 	"github.com/kc1116/perch-interactive-challenge/core"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 var (
 	projectID, region, registryID, topicID, googleCloudAuth string
+	configFile                                              string
+	eventRoutes                                             []core.EventRoute
 	logger                                                  = core.Logger()
+	// clients are shared by everything the command creates and closed when it returns
+	clients *core.Clients
+	// rootCtx is cancelled on SIGINT or SIGTERM, commands pass it to every blocking call
+	rootCtx = context.Background()
 )
 
 var RootCmd = &cobra.Command{
@@ -18,12 +29,102 @@ var RootCmd = &cobra.Command{
 }
 
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	rootCtx = ctx
+	clients = core.NewClients()
+	err := RootCmd.Execute()
+	stop()
+	if closeErr := clients.Close(); closeErr != nil {
+		logger.Warnln(closeErr)
+	}
+
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// initConfig reads the optional config file and lets PERCH_ prefixed env variables override any bound setting
+func initConfig() {
+	viper.SetEnvPrefix("perch")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			logger.Fatalf("error reading config file %s: %s", configFile, err)
+		}
+	}
+
+	eventRoutes = nil
+	for _, value := range viper.GetStringSlice("route") {
+		route, err := core.ParseEventRoute(value)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		eventRoutes = append(eventRoutes, route)
+	}
+
+	if endpoint := viper.GetString("cloudiot-endpoint"); endpoint != "" {
+		_ = os.Setenv(core.CloudIoTEmulatorHostEnv, endpoint)
+	}
+
+	if viper.GetBool("local") && os.Getenv(core.PubSubEmulatorHostEnv) == "" {
+		_ = os.Setenv(core.PubSubEmulatorHostEnv, core.DefaultLocalPubSubAddr)
+	}
+
+	if viper.GetBool("local") && os.Getenv(core.CloudIoTEmulatorHostEnv) == "" {
+		_ = os.Setenv(core.CloudIoTEmulatorHostEnv, core.DefaultLocalIoTAddr)
+	}
+}
+
+// cleanupContext bounds deleting what a command created, it is not derived from rootCtx so commands
+// stopped by a signal still clean up
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), core.CleanupTimeout)
+}
+
+// newDeviceRegistry returns the registry selected by the global flags, with --local it lives in the local emulators
+func newDeviceRegistry() *core.DeviceRegistry {
+	registry := core.NewDeviceRegistry(clients, projectID, region, registryID, topicID)
+	registry.Local = viper.GetBool("local")
+	registry.Routes = eventRoutes
+	return registry
+}
+
+// openKeyStore opens the keystore selected by --keystore, it returns nil when no keystore is configured
+func openKeyStore() (core.KeyStore, error) {
+	path := viper.GetString("keystore")
+	if path == "" {
+		return nil, nil
+	}
+
+	return core.OpenKeyStore(path, viper.GetString("keystore-passphrase"))
+}
+
+// tlsOptions returns the broker trust settings from flags, config or PERCH_CA_FILE, PERCH_CLIENT_CERT and PERCH_CLIENT_KEY
+func tlsOptions() core.TLSOptions {
+	return core.TLSOptions{
+		CAFile:     viper.GetString("ca-file"),
+		ClientCert: viper.GetString("client-cert"),
+		ClientKey:  viper.GetString("client-key"),
+	}
+}
+
 func init() {
+	cobra.OnInitialize(initConfig)
+
+	RootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Optional config file (json, yaml or toml) providing values for any flag")
+	RootCmd.PersistentFlags().String("keystore", "", "Directory holding device identities, or a single encrypted file when a keystore passphrase is set")
+	RootCmd.PersistentFlags().String("keystore-passphrase", "", "Passphrase of an encrypted keystore file, prefer setting PERCH_KEYSTORE_PASSPHRASE")
+	RootCmd.PersistentFlags().String("ca-file", "", "PEM bundle of CAs trusted when connecting to brokers, defaults to the embedded google roots")
+	RootCmd.PersistentFlags().String("client-cert", "", "PEM client certificate presented to brokers that require mutual TLS")
+	RootCmd.PersistentFlags().String("client-key", "", "PEM private key of the client certificate")
+	RootCmd.PersistentFlags().Bool("local", false, "Use the broker, pubsub and IoT Core API started by the local command instead of GCP")
+	RootCmd.PersistentFlags().String("cloudiot-endpoint", "", "Base url or host:port of a fake IoT Core API, overrides CLOUDIOT_EMULATOR_HOST")
+	RootCmd.PersistentFlags().String("catalog", "", "Csv or json product catalog the simulator draws products from and the aggregator validates product IDs against")
+	RootCmd.PersistentFlags().StringSlice("route", nil, "Route events of a subfolder to their own topic, subfolder=topic e.g. telemetry=device-telemetry, may be repeated")
 	RootCmd.PersistentFlags().StringVarP(&projectID, "projectID", "p", "perch-challenge", "Google cloud project ID")
 	RootCmd.PersistentFlags().StringVarP(&registryID, "registryID", "r", "test-registry", "Google cloud IOT core device registry ID")
 	RootCmd.PersistentFlags().StringVarP(&topicID, "topicID", "t", "test-registry-topic", "Google cloud Pubsub topic ID")
@@ -33,6 +134,15 @@ func init() {
 	_ = viper.BindPFlag("registryID", RootCmd.PersistentFlags().Lookup("registryID"))
 	_ = viper.BindPFlag("topicID", RootCmd.PersistentFlags().Lookup("topicID"))
 	_ = viper.BindPFlag("region", RootCmd.PersistentFlags().Lookup("region"))
+	_ = viper.BindPFlag("ca-file", RootCmd.PersistentFlags().Lookup("ca-file"))
+	_ = viper.BindPFlag("client-cert", RootCmd.PersistentFlags().Lookup("client-cert"))
+	_ = viper.BindPFlag("client-key", RootCmd.PersistentFlags().Lookup("client-key"))
+	_ = viper.BindPFlag("keystore", RootCmd.PersistentFlags().Lookup("keystore"))
+	_ = viper.BindPFlag("local", RootCmd.PersistentFlags().Lookup("local"))
+	_ = viper.BindPFlag("cloudiot-endpoint", RootCmd.PersistentFlags().Lookup("cloudiot-endpoint"))
+	_ = viper.BindPFlag("route", RootCmd.PersistentFlags().Lookup("route"))
+	_ = viper.BindPFlag("catalog", RootCmd.PersistentFlags().Lookup("catalog"))
+	_ = viper.BindPFlag("keystore-passphrase", RootCmd.PersistentFlags().Lookup("keystore-passphrase"))
 
-	RootCmd.AddCommand(aggregateCmd, sessionCmd, websocketCmd)
+	RootCmd.AddCommand(aggregateCmd, sessionCmd, websocketCmd, identitiesCmd, localCmd, devicesCmd, registryCmd)
 }
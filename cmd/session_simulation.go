@@ -1,17 +1,31 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/kc1116/perch-interactive-challenge/core"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
-//@TODO: make google certs path configurable
-//@TODO: configurable device keys
-
 var (
-	sessions, iterations int
+	sessions, iterations    int
+	transport, broker       string
+	tokenTTL, stateInterval time.Duration
+	certValidity            time.Duration
+	tlsConfig               *tls.Config
+	memoryBroker            = core.NewMemoryBroker()
+	// simulation is loaded from --scenario or built from the simulator flags
+	simulation *core.Scenario
+	// simulationClock is the clock every device runs its sessions on, nil when each device gets a virtual
+	// clock of its own
+	simulationClock core.Clock
+	simulationStart time.Time
+	simulationEnd   time.Time
 )
 
 var sessionCmd = &cobra.Command{
@@ -22,67 +36,614 @@ var sessionCmd = &cobra.Command{
 		an event and published through GCP IOT Core MQTT Bridge. Each session will not last as long as others this duration 
 		is randomized between 5s & 180. A Simulated device acts like it's own independent entity. Thus sessions are independent
 		from each other. The frequency in which events occur in a simulated session is a randomized number between 5s and 30s. 
-		You can increase the amount of concurrent sessions (default: 2).`,
+		You can increase the amount of concurrent sessions (default: 2). Devices subscribe to their IoT Core config and
+		commands topics, a config document can change the tick interval, duration range and product set at runtime and
+		the end-session command stops a running session. With --children every simulated device becomes an IoT Core
+		gateway that attaches its child devices and publishes their events over its own connection.
+
+		--scenario runs the device groups of a yaml file instead, with their own store metadata, products, session
+		length and tick distributions, interaction mix and time of day activity. It replaces --sessions, --iterations
+		and the store metadata flags.
+
+		--shopper replaces the independent events of a session with a shopper that approaches the device, picks up
+		products, browses their screen buttons, puts them down, moves on to other products and finally leaves.
+		Scenarios configure its transition probabilities and dwell times per group.
+
+		--catalog draws products from a csv or json catalog by popularity, events carry the SKU of their product as
+		product ID and screen touches press the buttons the catalog lists for it. Scenarios set it as productCatalog.
+
+		Every device draws its ID, sessions and events from its own random stream seeded from --seed, runs with the
+		same seed and scenario generate the same event sequences. The seed of a run is logged when it starts.
+
+		--start-time and --speed run sessions on a virtual clock, events are stamped with simulated timestamps. The clock
+		starts at --start-time and runs --speed times faster than the wall clock, --speed 0 jumps straight to the next
+		event so a month of history takes as long as publishing it. With --end-time devices keep starting sessions until
+		their clock passes it. Connections, tokens and state reports keep the wall clock.`,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if sessions < 1 {
-			return fmt.Errorf("invalid value for sessions %s", sessions)
+			return fmt.Errorf("invalid value for sessions %d", sessions)
 		} else if iterations < 1 {
-			return fmt.Errorf("invalid value for iterations %s", iterations)
+			return fmt.Errorf("invalid value for iterations %d", iterations)
 		}
 
 		if sessions > 5 {
-			return fmt.Errorf("for demonstration purposes simulator cannot create more than 5 sessions at a time")
+			return fmt.Errorf("for demonstration purposes simulator cannot create more than 5 sessions at a time, use simulator loadtest for more devices")
 		} else if iterations > 20 {
-			return fmt.Errorf("for demonstration purposes simulator cannot do more than 20 iterations %s", iterations)
+			return fmt.Errorf("for demonstration purposes simulator cannot do more than 20 iterations %d", iterations)
 		}
 
-		return nil
+		if err := validateSimulatorFlags(cmd); err != nil {
+			return err
+		}
+
+		var err error
+		if simulation, err = simulatorScenario(cmd, sessions); err != nil {
+			return err
+		}
+
+		return simulatorClock()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return StartDeviceSimulation()
+		return StartDeviceSimulation(rootCtx)
 	},
 }
 
-func StartDeviceSimulation() error {
-	for i := 0; i < iterations; i++ {
+// validateSimulatorFlags checks the transport, key and gateway flags the simulator and its load tests share
+func validateSimulatorFlags(cmd *cobra.Command) error {
+	if !core.ValidKeyAlgorithm(viper.GetString("key-algorithm")) {
+		return fmt.Errorf("invalid value for key-algorithm %s", viper.GetString("key-algorithm"))
+	}
+
+	if viper.GetBool("local") {
+		if !cmd.Flags().Changed("transport") {
+			transport = core.TransportMQTT
+		}
+
+		if broker == "" {
+			broker = core.DefaultLocalBrokerURL
+		}
+
+		if inIoTCore() {
+			return fmt.Errorf("the %s transport can not be used with --local, use mqtt or memory", transport)
+		}
+	}
+
+	switch transport {
+	case core.TransportGoogle, core.TransportHTTP, core.TransportMemory:
+	case core.TransportMQTT:
+		if broker == "" {
+			return fmt.Errorf("--broker is required when using the %s transport", core.TransportMQTT)
+		}
+	default:
+		return fmt.Errorf("invalid value for transport %s", transport)
+	}
+
+	if children := viper.GetInt("children"); children < 0 {
+		return fmt.Errorf("invalid value for children %d", children)
+	} else if children > 0 && transport == core.TransportHTTP {
+		return fmt.Errorf("gateways are not supported by the %s transport", core.TransportHTTP)
+	}
+
+	return nil
+}
+
+// StartDeviceSimulation runs the configured iterations of sessions, once ctx is done running sessions end,
+// devices are closed and cleaned up and no further iteration is started
+func StartDeviceSimulation(ctx context.Context) error {
+	fleet, err := prepareFleet(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < iterations && ctx.Err() == nil; i++ {
+		if err = fleet.open(ctx); err != nil {
+			return err
+		}
+
+		simulated := fleet.simulated()
 		wg := &sync.WaitGroup{}
-		wg.Add(sessions)
-		for i := 0; i < sessions; i++ {
-			go StartSimulation(wg)
+		wg.Add(len(simulated))
+		for _, device := range simulated {
+			go StartSimulation(ctx, device, fleet.group(device), wg)
 		}
 
 		wg.Wait()
+		fleet.close()
 	}
 
+	core.Metrics().Log()
 	return nil
 }
 
-func StartSimulation(wg *sync.WaitGroup) {
-	defer wg.Done()
-	registry, err := core.NewDeviceRegistry(projectID, region, registryID, topicID).Init(true)
+// simulatedFleet holds the registry, keystore and connections of the devices of one iteration of a simulation
+type simulatedFleet struct {
+	registry     *core.DeviceRegistry
+	registryPath string
+	store        core.KeyStore
+	manager      *core.ConnectionManager
+	childManager *core.ConnectionManager
+	devices      []*core.Device
+	children     []*core.Device
+	groups       map[string]*core.DeviceGroup
+}
+
+// prepareFleet looks up the registry, opens the keystore and seeds the random streams of the devices
+func prepareFleet(ctx context.Context) (*simulatedFleet, error) {
+	fleet := &simulatedFleet{
+		registryPath: core.RegistryName(projectID, region, registryID),
+		manager:      core.NewConnectionManager(core.DefaultMaxConnecting),
+		childManager: core.NewConnectionManager(core.DefaultMaxConnecting),
+	}
+
+	var err error
+	if registersDevices() {
+		fleet.registry, err = newDeviceRegistry().Init(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+
+		fleet.registryPath = fleet.registry.RegistryName()
+	}
+
+	fleet.store, err = openKeyStore()
 	if err != nil {
-		logger.Fatalln(err)
+		return nil, err
 	}
 
-	device, err := core.NewDevice(projectID, region, registryID, registry.RegistryName()).Init()
+	tlsConfig, err = newTLSConfig()
 	if err != nil {
-		logger.Fatalln(err)
+		return nil, err
 	}
 
-	err = device.ConnectMQTT()
+	seed := viper.GetInt64("seed")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	logger.WithField("seed", seed).Infoln("seeding simulation")
+	core.Seed(seed)
+	return fleet, nil
+}
+
+// open creates and connects the devices of the simulation and their children
+func (f *simulatedFleet) open(ctx context.Context) error {
+	var err error
+	f.devices, f.groups, err = newSimulatedFleet(ctx, f.registryPath, f.store)
 	if err != nil {
-		logger.Fatalln(err)
+		return err
 	}
 
-	device.StartSession(wg)
+	f.children, err = newSimulatedChildren(ctx, f.registry, f.devices)
+	if err != nil {
+		return err
+	}
+
+	// children attach through their gateway so gateways have to be connected first
+	err = f.manager.OpenAll(ctx, f.devices)
+	if err == nil {
+		err = f.childManager.OpenAll(ctx, f.children)
+	}
 
-	err = device.CleanUp()
 	if err != nil {
-		logger.Fatalln(err)
+		_ = f.childManager.CloseAll()
+		_ = f.manager.CloseAll()
+		return err
+	}
+
+	return nil
+}
+
+// simulated returns the devices that publish events, the children when devices are gateways
+func (f *simulatedFleet) simulated() []*core.Device {
+	if len(f.children) > 0 {
+		return f.children
+	}
+
+	return f.devices
+}
+
+// group returns the device group of device, children belong to the group of their gateway
+func (f *simulatedFleet) group(device *core.Device) *core.DeviceGroup {
+	if device.GatewayID() != "" {
+		return f.groups[device.GatewayID()]
+	}
+
+	return f.groups[device.DeviceID]
+}
+
+// close disconnects the devices and deletes the ones the keystore does not keep
+func (f *simulatedFleet) close() {
+	if err := f.childManager.CloseAll(); err != nil {
+		logger.Errorln(err)
+	}
+
+	if err := f.manager.CloseAll(); err != nil {
+		logger.Errorln(err)
+	}
+
+	cleanUpChildren(f.registry, f.children)
+	if f.store == nil {
+		cleanUpDevices(f.devices)
+	}
+}
+
+// StartSimulation runs the sessions of group on device one after another, waiting the idle time of the group before each
+func StartSimulation(ctx context.Context, device *core.Device, group *core.DeviceGroup, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for i := 0; i < group.Sessions || !simulationEnd.IsZero(); i++ {
+		if idle := group.IdleTime(device.Rand(), device.Clock.Now()); idle > 0 {
+			logger.WithField("device-id", device.DeviceID).WithField("idle", idle.Round(time.Second)).Debugln("waiting for next session")
+			wait := device.Clock.NewTimer(idle)
+			device.Clock.Advance()
+			select {
+			case <-ctx.Done():
+				wait.Stop()
+				return
+			case <-wait.C():
+			}
+		}
+
+		if ctx.Err() != nil || (!simulationEnd.IsZero() && device.Clock.Now().After(simulationEnd)) {
+			return
+		}
+
+		device.StartSession(ctx)
+	}
+}
+
+// newSimulatedFleet creates the devices of every group of the simulation and returns the group of each device by id,
+// with a keystore the first identities are reused and missing ones are generated and saved so the fleet is stable across runs,
+// identities whose cert was replaced on load are saved again
+func newSimulatedFleet(ctx context.Context, registryPath string, store core.KeyStore) ([]*core.Device, map[string]*core.DeviceGroup, error) {
+	var identities []*core.Identity
+	if store != nil {
+		var err error
+		identities, err = store.List()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	devices := make([]*core.Device, 0, simulation.Devices())
+	groups := make(map[string]*core.DeviceGroup, simulation.Devices())
+	for _, group := range simulation.Groups {
+		for i := 0; i < group.Devices; i++ {
+			var identity *core.Identity
+			if n := len(devices); n < len(identities) {
+				identity = identities[n]
+			}
+
+			device, err := newSimulatedDevice(ctx, registryPath, group, identity)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if store != nil && (identity == nil || identity.Certificate != device.Certs.Pem) {
+				err = saveIdentity(store, device)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error saving identity of %s: %s", device.DeviceID, err)
+				}
+			}
+
+			devices = append(devices, device)
+			groups[device.DeviceID] = group
+		}
+	}
+
+	return devices, groups, nil
+}
+
+func saveIdentity(store core.KeyStore, device *core.Device) error {
+	if device.Certs.Key == nil {
+		if err := device.NewKey(); err != nil {
+			return err
+		}
+	}
+
+	identity, err := device.Identity()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(identity)
+}
+
+// newSimulatedDevice creates a device wired to the transport selected on the command line,
+// devices are only created in the registry when registersDevices
+func newSimulatedDevice(ctx context.Context, registryPath string, group *core.DeviceGroup, identity *core.Identity) (*core.Device, error) {
+	device := core.NewDevice(clients, projectID, region, registryID, registryPath)
+	device.TokenTTL = tokenTTL
+	device.CertValidity = certValidity
+	device.KeyAlgorithm = viper.GetString("key-algorithm")
+	device.Gateway = viper.GetInt("children") > 0
+	device.Metadata = group.Metadata
+	device.Reconfigure(group.SessionConfig())
+	if identity != nil {
+		if err := device.LoadIdentity(identity); err != nil {
+			return nil, err
+		}
+	}
+
+	if registersDevices() {
+		if _, err := device.Init(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := configureDevice(device); err != nil {
+		return nil, err
+	}
+
+	switch transport {
+	case core.TransportGoogle:
+		device.Transport = core.NewGoogleTransport(device, tlsConfig)
+	case core.TransportHTTP:
+		httpTransport := core.NewHTTPTransport(device, tlsConfig)
+		httpTransport.BaseURL = viper.GetString("http-bridge")
+		device.Transport = httpTransport
+	case core.TransportMQTT:
+		mqttTransport := core.NewMQTTTransport(broker, device.DeviceID)
+		mqttTransport.TLS = tlsConfig
+		device.Transport = mqttTransport
+	case core.TransportMemory:
+		device.Transport = core.NewMemoryTransport(memoryBroker)
+	}
+
+	return device, nil
+}
+
+// newSimulatedChildren creates and binds the children of every gateway, children publish through the
+// connection of their gateway and have no credentials of their own
+func newSimulatedChildren(ctx context.Context, registry *core.DeviceRegistry, gateways []*core.Device) ([]*core.Device, error) {
+	n := viper.GetInt("children")
+	children := make([]*core.Device, 0, len(gateways)*n)
+	for _, gateway := range gateways {
+		for i := 0; i < n; i++ {
+			child := core.NewChildDevice(gateway, i)
+			child.Metadata = gateway.Metadata
+			child.Reconfigure(gateway.SessionConfig())
+			if registry != nil {
+				if _, err := child.Init(ctx); err != nil {
+					return nil, err
+				}
+
+				if err := registry.BindDeviceToGateway(ctx, gateway.DeviceID, child.DeviceID); err != nil {
+					return nil, fmt.Errorf("error binding %s to gateway %s: %s", child.DeviceID, gateway.DeviceID, err)
+				}
+			}
+
+			if err := configureDevice(child); err != nil {
+				return nil, err
+			}
+
+			children = append(children, child)
+		}
+	}
+
+	return children, nil
+}
+
+// simulatorMetadata returns the metadata every simulated device is created with
+func simulatorMetadata() core.DeviceMetadata {
+	return core.DeviceMetadata{
+		StoreID:  viper.GetString("store-id"),
+		Fixture:  viper.GetString("fixture"),
+		Aisle:    viper.GetString("aisle"),
+		Timezone: viper.GetString("timezone"),
+	}
+}
+
+// simulatorScenario loads --scenario, without one the simulator flags describe a single group of devices
+func simulatorScenario(cmd *cobra.Command, devices int) (*core.Scenario, error) {
+	path := viper.GetString("scenario")
+	if path == "" {
+		group := &core.DeviceGroup{Name: "default", Devices: devices, Metadata: simulatorMetadata()}
+		if viper.GetBool("shopper") {
+			group.Session.Shopper = core.DefaultShopperModel()
+		}
+
+		scenario := &core.Scenario{Groups: []*core.DeviceGroup{group}}
+		if catalog := viper.GetString("catalog"); catalog != "" {
+			var err error
+			if scenario.Catalog, err = core.LoadCatalog(catalog); err != nil {
+				return nil, err
+			}
+		}
+
+		return scenario, scenario.Validate()
+	}
+
+	for _, flag := range []string{"sessions", "iterations", "devices", "store-id", "fixture", "aisle", "timezone", "shopper", "catalog"} {
+		if cmd.Flags().Changed(flag) {
+			return nil, fmt.Errorf("--%s can not be used with --scenario, set it in the scenario", flag)
+		}
+	}
+
+	return core.LoadScenario(path)
+}
+
+// simulatorClock sets the clock of the simulation from --start-time, --end-time and --speed, sessions stay on
+// the wall clock unless one of them is set
+func simulatorClock() error {
+	speed := viper.GetFloat64("speed")
+	if speed < 0 {
+		return fmt.Errorf("invalid value for speed %v", speed)
+	}
+
+	simulationStart = time.Now()
+	if start := viper.GetString("start-time"); start != "" {
+		var err error
+		if simulationStart, err = time.Parse(time.RFC3339, start); err != nil {
+			return fmt.Errorf("invalid value for start-time %s, expected RFC3339 e.g. 2019-06-01T09:00:00Z", start)
+		}
+	}
+
+	simulationEnd = time.Time{}
+	if end := viper.GetString("end-time"); end != "" {
+		var err error
+		if simulationEnd, err = time.Parse(time.RFC3339, end); err != nil {
+			return fmt.Errorf("invalid value for end-time %s, expected RFC3339 e.g. 2019-07-01T00:00:00Z", end)
+		}
+
+		if !simulationEnd.After(simulationStart) {
+			return fmt.Errorf("end-time %s is not after the start of the simulation", end)
+		}
+	}
+
+	switch {
+	case speed == 0:
+		simulationClock = nil
+	case speed == 1 && viper.GetString("start-time") == "":
+		simulationClock = core.WallClock()
+	default:
+		simulationClock = core.ScaledClock(simulationStart, speed)
+	}
+
+	return nil
+}
+
+// deviceClock returns the clock a simulated device runs its sessions on, virtual clocks only serve one device
+func deviceClock() core.Clock {
+	if simulationClock == nil {
+		return core.VirtualClock(simulationStart)
+	}
+
+	return simulationClock
+}
+
+// configureDevice applies the state reporting and outbox flags to device
+func configureDevice(device *core.Device) error {
+	device.Clock = deviceClock()
+	device.StateInterval = stateInterval
+	device.FirmwareVersion = viper.GetString("firmware-version")
+
+	dir := viper.GetString("outbox")
+	if dir == "" {
+		return nil
+	}
+
+	outbox, err := core.OpenOutbox(filepath.Join(dir, device.DeviceID), viper.GetInt64("outbox-max-bytes"), viper.GetDuration("outbox-max-age"))
+	if err != nil {
+		return err
+	}
+
+	device.Outbox = outbox
+	return nil
+}
+
+// newTLSConfig builds the tls config devices connect with, brokers other than IoT Core are verified
+// against the system roots unless a CA file is given
+func newTLSConfig() (*tls.Config, error) {
+	opts := tlsOptions()
+	switch {
+	case transport == core.TransportGoogle:
+		return opts.Config(core.GoogleRoots())
+	case transport != core.TransportMemory && !opts.Empty():
+		return opts.Config(nil)
+	}
+
+	return nil, nil
+}
+
+// inIoTCore reports whether the selected transport authenticates devices against IoT Core,
+// those devices have to be created in the registry before they connect
+func inIoTCore() bool {
+	return transport == core.TransportGoogle || transport == core.TransportHTTP
+}
+
+// registersDevices reports whether devices are created in the registry, devices publishing to the local broker
+// are created in the local IoT Core API so their metadata and states can be looked up
+func registersDevices() bool {
+	return inIoTCore() || viper.GetBool("local")
+}
+
+func cleanUpDevices(devices []*core.Device) {
+	if !registersDevices() {
+		return
+	}
+
+	ctx, cancel := cleanupContext()
+	defer cancel()
+
+	for _, device := range devices {
+		if err := device.CleanUp(ctx); err != nil {
+			logger.WithError(err).WithField("device-id", device.DeviceID).Errorln("error deleting device")
+		}
+	}
+}
+
+// cleanUpChildren unbinds children from their gateway and deletes them, gateways with bound devices can not be deleted
+func cleanUpChildren(registry *core.DeviceRegistry, children []*core.Device) {
+	if registry == nil {
+		return
+	}
+
+	ctx, cancel := cleanupContext()
+	defer cancel()
+
+	for _, child := range children {
+		entry := logger.WithField("device-id", child.DeviceID).WithField("gateway-id", child.GatewayID())
+		if err := registry.UnbindDeviceFromGateway(ctx, child.GatewayID(), child.DeviceID); err != nil {
+			entry.WithError(err).Errorln("error unbinding device")
+			continue
+		}
+
+		if err := child.CleanUp(ctx); err != nil {
+			entry.WithError(err).Errorln("error deleting device")
+		}
 	}
 }
 
 func init() {
 	sessionCmd.PersistentFlags().IntVarP(&sessions, "sessions", "S", 2, "Number of device simulations to start in parallel")
 	sessionCmd.PersistentFlags().IntVarP(&iterations, "iterations", "I", 1, "How many iterations of simulation should device make")
+	sessionCmd.PersistentFlags().StringVarP(&transport, "transport", "T", core.TransportGoogle, "Transport devices publish through: google, http, mqtt or memory")
+	sessionCmd.PersistentFlags().StringVarP(&broker, "broker", "B", "", "MQTT broker url used by the mqtt transport e.g. tcp://localhost:1883")
+
+	sessionCmd.PersistentFlags().Int("children", 0, "Turns every simulated device into a gateway with this many child devices, sessions run on the children")
+	sessionCmd.PersistentFlags().String("http-bridge", core.DefaultHTTPBridgeURL, "Base url of the IoT Core HTTP bridge used by the http transport")
+	sessionCmd.PersistentFlags().DurationVar(&tokenTTL, "token-ttl", core.DefaultTokenTTL, "Lifetime of device JWTs, tokens are re-minted and connections refreshed before they expire")
+	sessionCmd.PersistentFlags().DurationVar(&certValidity, "cert-validity", core.DefaultCertValidity, "Lifetime of device certs, certs are renewed and registered again before they expire")
+
+	sessionCmd.PersistentFlags().DurationVar(&stateInterval, "state-interval", time.Minute, "How often devices report their state, 0 disables state reporting")
+	sessionCmd.PersistentFlags().String("firmware-version", core.DefaultFirmwareVersion, "Firmware version devices report in their state")
+	sessionCmd.PersistentFlags().String("outbox", "", "Directory devices queue events in while they can not publish, queued events are replayed in order once they reconnect. Use with --keystore to replay events left by a previous run")
+	sessionCmd.PersistentFlags().Int64("outbox-max-bytes", core.DefaultOutboxMaxBytes, "Size a device outbox may grow to before its oldest events are dropped")
+	sessionCmd.PersistentFlags().Duration("outbox-max-age", core.DefaultOutboxMaxAge, "Queued events older than this are dropped instead of replayed")
+	sessionCmd.PersistentFlags().String("store-id", "", "ID of the store simulated devices are installed in, saved as device metadata")
+	sessionCmd.PersistentFlags().String("fixture", "", "Fixture simulated devices are mounted on, saved as device metadata")
+	sessionCmd.PersistentFlags().String("aisle", "", "Aisle of the fixture, saved as device metadata")
+	sessionCmd.PersistentFlags().String("timezone", "", "IANA timezone of the store e.g. America/New_York, saved as device metadata")
+	sessionCmd.PersistentFlags().String("scenario", "", "Yaml file describing the device groups to simulate and the traffic they generate")
+	sessionCmd.PersistentFlags().Bool("shopper", false, "Sessions follow a shopper moving between products instead of publishing independent random events")
+	sessionCmd.PersistentFlags().String("start-time", "", "RFC3339 time the clock of simulated sessions starts at, defaults to now")
+	sessionCmd.PersistentFlags().String("end-time", "", "RFC3339 time devices stop starting sessions at, replaces the number of sessions of a device")
+	sessionCmd.PersistentFlags().Float64("speed", 1, "How many times faster than the wall clock sessions run, 0 runs them as fast as events can be published")
+	sessionCmd.PersistentFlags().Int64("seed", 0, "Seed of the random streams devices draw their IDs, sessions and events from, 0 picks a random seed")
+	sessionCmd.PersistentFlags().String("key-algorithm", core.KeyAlgorithmRS256, "Algorithm of generated device keys: RS256 or ES256")
+
+	_ = viper.BindPFlag("transport", sessionCmd.PersistentFlags().Lookup("transport"))
+	_ = viper.BindPFlag("broker", sessionCmd.PersistentFlags().Lookup("broker"))
+	_ = viper.BindPFlag("children", sessionCmd.PersistentFlags().Lookup("children"))
+	_ = viper.BindPFlag("http-bridge", sessionCmd.PersistentFlags().Lookup("http-bridge"))
+	_ = viper.BindPFlag("token-ttl", sessionCmd.PersistentFlags().Lookup("token-ttl"))
+	_ = viper.BindPFlag("cert-validity", sessionCmd.PersistentFlags().Lookup("cert-validity"))
+	_ = viper.BindPFlag("key-algorithm", sessionCmd.PersistentFlags().Lookup("key-algorithm"))
+	_ = viper.BindPFlag("state-interval", sessionCmd.PersistentFlags().Lookup("state-interval"))
+	_ = viper.BindPFlag("firmware-version", sessionCmd.PersistentFlags().Lookup("firmware-version"))
+	_ = viper.BindPFlag("outbox", sessionCmd.PersistentFlags().Lookup("outbox"))
+	_ = viper.BindPFlag("outbox-max-bytes", sessionCmd.PersistentFlags().Lookup("outbox-max-bytes"))
+	_ = viper.BindPFlag("outbox-max-age", sessionCmd.PersistentFlags().Lookup("outbox-max-age"))
+	_ = viper.BindPFlag("store-id", sessionCmd.PersistentFlags().Lookup("store-id"))
+	_ = viper.BindPFlag("fixture", sessionCmd.PersistentFlags().Lookup("fixture"))
+	_ = viper.BindPFlag("aisle", sessionCmd.PersistentFlags().Lookup("aisle"))
+	_ = viper.BindPFlag("timezone", sessionCmd.PersistentFlags().Lookup("timezone"))
+	_ = viper.BindPFlag("scenario", sessionCmd.PersistentFlags().Lookup("scenario"))
+	_ = viper.BindPFlag("seed", sessionCmd.PersistentFlags().Lookup("seed"))
+	_ = viper.BindPFlag("start-time", sessionCmd.PersistentFlags().Lookup("start-time"))
+	_ = viper.BindPFlag("end-time", sessionCmd.PersistentFlags().Lookup("end-time"))
+	_ = viper.BindPFlag("speed", sessionCmd.PersistentFlags().Lookup("speed"))
+	_ = viper.BindPFlag("shopper", sessionCmd.PersistentFlags().Lookup("shopper"))
+
+	sessionCmd.AddCommand(loadTestCmd)
 }
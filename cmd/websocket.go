@@ -16,24 +16,23 @@ var websocketCmd = &cobra.Command{
 		websocket connections. We make use of rethinkdbs change sets which allows us to watch all updates on our events table and 
 		stream them to the ui via websocket in real time.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		store, err := core.NewStore(host, database)
+		store, err := core.NewStore(clients, host, database)
 		if err != nil {
 			return fmt.Errorf("unable to start websocket err when connecting to event store %s", err)
 		}
 
-		err = store.Init()
+		err = store.Init(rootCtx)
 		if err != nil {
 			return fmt.Errorf("error initializing store %s", err)
 		}
 
-		store.StartWSProxy()
-		return nil
+		return store.StartWSProxy(rootCtx)
 	},
 }
 
-func init()  {
+func init() {
 	websocketCmd.PersistentFlags().StringVarP(&host, "rethinkdb", "H", "127.0.0.1:28015", "Full endpoint to rethinkdb server")
 	websocketCmd.PersistentFlags().StringVarP(&database, "database", "D", "interactions", "Name of rethinkdb database to store events")
 	_ = viper.BindPFlag("rethinkdb", websocketCmd.PersistentFlags().Lookup("rethinkdb"))
 	_ = viper.BindPFlag("database", websocketCmd.PersistentFlags().Lookup("database"))
-}
\ No newline at end of file
+}
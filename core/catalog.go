@@ -0,0 +1,263 @@
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// catalogColumns are the columns of a csv catalog, sku and name are required
+var catalogColumns = []string{"sku", "name", "category", "price", "buttons", "popularity"}
+
+// Product is an entry of a product catalog. Buttons are the buttons of its product screen and Popularity
+// weights how often it is picked compared to the others, it defaults to 1
+type Product struct {
+	SKU        string   `json:"sku"`
+	Name       string   `json:"name"`
+	Category   string   `json:"category,omitempty"`
+	Price      float64  `json:"price,omitempty"`
+	Buttons    []string `json:"buttons,omitempty"`
+	Popularity float64  `json:"popularity,omitempty"`
+}
+
+// productNamespace scopes the version 5 uuids of products simulated without a catalog
+var productNamespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/kc1116/perch-interactive-challenge/products")
+
+// namedProduct returns the product name stands for when there is no catalog, its SKU is derived from the
+// name so every event for the same product carries the same product ID
+func namedProduct(name string) *Product {
+	return &Product{SKU: uuid.NewV5(productNamespace, name).String(), Name: name}
+}
+
+// button draws one of the screen buttons of the product from rng, products without buttons use the default ones
+func (p *Product) button(rng *rand.Rand) string {
+	if len(p.Buttons) == 0 {
+		return randomButton(rng)
+	}
+
+	return buttonName(p.Buttons[rng.Intn(len(p.Buttons))])
+}
+
+// buttonName is the name events carry for a screen button, catalog and default buttons look the same
+func buttonName(button string) string {
+	return "button-" + button
+}
+
+// Catalog is a set of products identified by SKU, it is safe for concurrent use once created
+type Catalog struct {
+	Products []*Product
+	bySKU    map[string]*Product
+	total    float64
+}
+
+// NewCatalog validates products and indexes them by SKU
+func NewCatalog(products []*Product) (*Catalog, error) {
+	if len(products) == 0 {
+		return nil, fmt.Errorf("catalog has no products")
+	}
+
+	c := &Catalog{Products: products, bySKU: make(map[string]*Product, len(products))}
+	for i, product := range products {
+		if product.SKU == "" {
+			return nil, fmt.Errorf("product %d has no sku", i+1)
+		}
+
+		if _, ok := c.bySKU[product.SKU]; ok {
+			return nil, fmt.Errorf("sku %s is listed twice", product.SKU)
+		}
+
+		if product.Name == "" {
+			return nil, fmt.Errorf("product %s has no name", product.SKU)
+		}
+
+		if product.Price < 0 || math.IsNaN(product.Price) || math.IsInf(product.Price, 0) {
+			return nil, fmt.Errorf("invalid price %v for %s", product.Price, product.SKU)
+		}
+
+		if product.Popularity < 0 || math.IsNaN(product.Popularity) || math.IsInf(product.Popularity, 0) {
+			return nil, fmt.Errorf("invalid popularity %v for %s", product.Popularity, product.SKU)
+		} else if product.Popularity == 0 {
+			product.Popularity = 1
+		}
+
+		c.bySKU[product.SKU] = product
+		c.total += product.Popularity
+	}
+
+	return c, nil
+}
+
+// Product returns the product with sku
+func (c *Catalog) Product(sku string) (*Product, bool) {
+	product, ok := c.bySKU[sku]
+	return product, ok
+}
+
+// Filter returns the products of categories as a catalog of their own, every product when categories is empty
+func (c *Catalog) Filter(categories []string) (*Catalog, error) {
+	if len(categories) == 0 {
+		return c, nil
+	}
+
+	var products []*Product
+	for _, product := range c.Products {
+		for _, category := range categories {
+			if strings.EqualFold(product.Category, category) {
+				products = append(products, product)
+				break
+			}
+		}
+	}
+
+	if len(products) == 0 {
+		return nil, fmt.Errorf("catalog has no products in categories %v", categories)
+	}
+
+	return NewCatalog(products)
+}
+
+// Sample draws a product from rng in proportion to its popularity
+func (c *Catalog) Sample(rng *rand.Rand) *Product {
+	return c.sampleExcept(rng, "")
+}
+
+// sampleExcept draws a product other than sku from rng, sku itself when it is the only product
+func (c *Catalog) sampleExcept(rng *rand.Rand, sku string) *Product {
+	total := c.total
+	except, ok := c.bySKU[sku]
+	if ok && len(c.Products) > 1 {
+		total -= except.Popularity
+	} else {
+		except = nil
+	}
+
+	n := rng.Float64() * total
+	last := c.Products[len(c.Products)-1]
+	for _, product := range c.Products {
+		if product == except {
+			continue
+		}
+
+		if n < product.Popularity {
+			return product
+		}
+
+		n -= product.Popularity
+		last = product
+	}
+
+	return last
+}
+
+// LoadCatalog reads a csv or json product catalog, files ending in .csv are read as csv. A csv catalog
+// has a header naming its columns out of sku, name, category, price, buttons and popularity, buttons
+// are separated by |. A json catalog is an array of products
+func LoadCatalog(path string) (*Catalog, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading catalog %s", err)
+	}
+
+	var products []*Product
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		products, err = parseCatalogCSV(b)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&products)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error decoding catalog %s: %s", path, err)
+	}
+
+	catalog, err := NewCatalog(products)
+	if err != nil {
+		return nil, fmt.Errorf("invalid catalog %s: %s", path, err)
+	}
+
+	return catalog, nil
+}
+
+func parseCatalogCSV(b []byte) ([]*Product, error) {
+	reader := csv.NewReader(bytes.NewReader(b))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %s", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !validCatalogColumn(column) {
+			return nil, fmt.Errorf("invalid column %s, expected %v", column, catalogColumns)
+		}
+
+		columns[column] = i
+	}
+
+	for _, column := range catalogColumns[:2] {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("missing column %s", column)
+		}
+	}
+
+	var products []*Product
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return products, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		field := func(column string) string {
+			if i, ok := columns[column]; ok {
+				return strings.TrimSpace(record[i])
+			}
+
+			return ""
+		}
+
+		product := &Product{SKU: field("sku"), Name: field("name"), Category: field("category")}
+		if price := field("price"); price != "" {
+			if product.Price, err = strconv.ParseFloat(price, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid price %s", line, price)
+			}
+		}
+
+		if popularity := field("popularity"); popularity != "" {
+			if product.Popularity, err = strconv.ParseFloat(popularity, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid popularity %s", line, popularity)
+			}
+		}
+
+		for _, button := range strings.Split(field("buttons"), "|") {
+			if button = strings.TrimSpace(button); button != "" {
+				product.Buttons = append(product.Buttons, button)
+			}
+		}
+
+		products = append(products, product)
+	}
+}
+
+func validCatalogColumn(column string) bool {
+	for _, c := range catalogColumns {
+		if c == column {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewCatalog(t *testing.T) {
+	cases := []struct {
+		name     string
+		products []*Product
+		wantErr  string
+	}{
+		{name: "empty", wantErr: "no products"},
+		{name: "missing sku", products: []*Product{{Name: "Tempo Knit"}}, wantErr: "has no sku"},
+		{name: "missing name", products: []*Product{{SKU: "RUN-1003"}}, wantErr: "has no name"},
+		{name: "duplicate sku", products: []*Product{{SKU: "RUN-1003", Name: "Tempo Knit"}, {SKU: "RUN-1003", Name: "Tempo Knit 2"}}, wantErr: "listed twice"},
+		{name: "negative price", products: []*Product{{SKU: "RUN-1003", Name: "Tempo Knit", Price: -1}}, wantErr: "invalid price"},
+		{name: "negative popularity", products: []*Product{{SKU: "RUN-1003", Name: "Tempo Knit", Popularity: -1}}, wantErr: "invalid popularity"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewCatalog(tc.products); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("NewCatalog() error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	catalog, err := NewCatalog([]*Product{{SKU: "RUN-1003", Name: "Tempo Knit"}})
+	if err != nil {
+		t.Fatalf("NewCatalog() error %s", err)
+	}
+
+	if product, ok := catalog.Product("RUN-1003"); !ok || product.Popularity != 1 {
+		t.Errorf("Product() = %+v %t, want the product with the default popularity of 1", product, ok)
+	}
+}
+
+func TestCatalogSample(t *testing.T) {
+	catalog, err := NewCatalog([]*Product{
+		{SKU: "RUN-1001", Name: "Trail Runner GTX", Popularity: 6},
+		{SKU: "RUN-1002", Name: "Road Racer 3", Popularity: 3},
+		{SKU: "RUN-1003", Name: "Tempo Knit"},
+	})
+	if err != nil {
+		t.Fatalf("NewCatalog() error %s", err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	const draws = 20000
+	for i := 0; i < draws; i++ {
+		counts[catalog.Sample(rng).SKU]++
+	}
+
+	for sku, want := range map[string]float64{"RUN-1001": 0.6, "RUN-1002": 0.3, "RUN-1003": 0.1} {
+		if got := float64(counts[sku]) / draws; math.Abs(got-want) > 0.02 {
+			t.Errorf("%s drawn %.3f of the time, want %.2f", sku, got, want)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		if product := catalog.sampleExcept(rng, "RUN-1001"); product.SKU == "RUN-1001" {
+			t.Fatalf("sampleExcept() = %s, want another product", product.SKU)
+		}
+	}
+
+	single, _ := NewCatalog([]*Product{{SKU: "RUN-1003", Name: "Tempo Knit"}})
+	if product := single.sampleExcept(rng, "RUN-1003"); product.SKU != "RUN-1003" {
+		t.Errorf("sampleExcept() of the only product = %s, want RUN-1003", product.SKU)
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	catalog, err := LoadCatalog(filepath.Join("..", "build", "catalogs", "shoes.csv"))
+	if err != nil {
+		t.Fatalf("LoadCatalog() error %s", err)
+	}
+
+	product, ok := catalog.Product("DRS-3001")
+	if len(catalog.Products) != 12 || !ok || product.Name != "Cap Toe Oxford" || product.Price != 189 || len(product.Buttons) != 4 {
+		t.Fatalf("LoadCatalog() %d products with DRS-3001 %+v, want 12 products and the cap toe oxford", len(catalog.Products), product)
+	}
+
+	running, err := catalog.Filter([]string{"running"})
+	if err != nil || len(running.Products) != 4 {
+		t.Errorf("Filter(running) = %v %v, want the 4 running shoes", running, err)
+	}
+
+	if _, err := catalog.Filter([]string{"sandals"}); err == nil {
+		t.Errorf("Filter(sandals) succeeded, want error")
+	}
+
+	dir, err := ioutil.TempDir("", "perch-catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	cases := []struct {
+		file    string
+		content string
+		wantErr string
+	}{
+		{file: "catalog.json", content: `[{"sku": "RUN-1003", "name": "Tempo Knit", "buttons": ["colors"], "popularity": 2}]`},
+		{file: "catalog.csv", content: "SKU, Name\nRUN-1003, Tempo Knit\n"},
+		{file: "unknown-field.json", content: `[{"sku": "RUN-1003", "name": "Tempo Knit", "colour": "red"}]`, wantErr: "unknown field"},
+		{file: "missing-name.csv", content: "sku,price\nRUN-1003,99.99\n", wantErr: "missing column name"},
+		{file: "unknown-column.csv", content: "sku,name,colour\nRUN-1003,Tempo Knit,red\n", wantErr: "invalid column colour"},
+		{file: "invalid-price.csv", content: "sku,name,price\nRUN-1003,Tempo Knit,cheap\n", wantErr: "line 2: invalid price cheap"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.file, func(t *testing.T) {
+			path := filepath.Join(dir, tc.file)
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			catalog, err := LoadCatalog(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("LoadCatalog() error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("LoadCatalog() error %s", err)
+			}
+
+			if product, ok := catalog.Product("RUN-1003"); !ok || product.Name != "Tempo Knit" {
+				t.Errorf("LoadCatalog() product RUN-1003 = %+v, want Tempo Knit", product)
+			}
+		})
+	}
+}
@@ -3,54 +3,144 @@ package core
 import (
 	"cloud.google.com/go/pubsub"
 	"context"
+	"fmt"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/cloudiot/v1"
+	"google.golang.org/api/option"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v5"
+	"os"
+	"strings"
 	"sync"
 )
 
-var (
-	httpClientOnce   sync.Once
-	pubSubClientOnce sync.Once
-	gcClient         *cloudiot.Service
-	pubSubClient     *pubsub.Client
-)
+// CloudIoTEmulatorHostEnv points the cloudiot client at a fake like fakeiot instead of GCP, it is a host:port
+// or a base url. PUBSUB_EMULATOR_HOST does the same for pubsub, the pubsub client reads it itself
+const CloudIoTEmulatorHostEnv = "CLOUDIOT_EMULATOR_HOST"
 
-// GCHttpClient initializes google cloud Client from credentials in env
-func GCHttpClient() (*cloudiot.Service, error) {
-	var clientErr error
-	httpClientOnce.Do(func() {
-		ctx := context.Background()
-		httpClient, err := google.DefaultClient(ctx, cloudiot.CloudPlatformScope)
-		if err != nil {
-			clientErr = err
-			return
-		}
+// Clients creates the API clients registries, devices, aggregators and stores use and shares them. Clients
+// are created on first use so commands only need credentials for the APIs they call, failures are not
+// cached and the next call tries again. Commands create one Clients and close it when they are done
+type Clients struct {
+	iot       *cloudiot.Service
+	pubsub    map[string]*pubsub.Client
+	rethinkdb map[string]*r.Session
+	mu        sync.Mutex
+}
 
-		gcClient, err = cloudiot.New(httpClient)
-		if err != nil {
-			clientErr = err
-			return
-		}
+// CloudIoT returns the IoT Core client, authenticated from credentials in env unless CLOUDIOT_EMULATOR_HOST is set
+func (c *Clients) CloudIoT() (*cloudiot.Service, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.iot != nil {
+		return c.iot, nil
+	}
+
+	ctx := context.Background()
+	var err error
+	if endpoint := CloudIoTEmulatorEndpoint(); endpoint != "" {
+		c.iot, err = cloudiot.NewService(ctx, option.WithEndpoint(endpoint), option.WithoutAuthentication())
+		return c.iot, err
+	}
+
+	httpClient, err := google.DefaultClient(ctx, cloudiot.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+
+	c.iot, err = cloudiot.New(httpClient)
+	return c.iot, err
+}
+
+// PubSub returns the pubsub client of projectID, authenticated from credentials in env
+func (c *Clients) PubSub(projectID string) (*pubsub.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.pubsub[projectID]; ok {
+		return client, nil
+	}
+
+	client, err := pubsub.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.pubsub[projectID] = client
+	return client, nil
+}
 
+// RethinkDB returns a session connected to database on host e.g. 127.0.0.1:28015
+func (c *Clients) RethinkDB(host, database string) (*r.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := host + "/" + database
+	if session, ok := c.rethinkdb[key]; ok {
+		return session, nil
+	}
+
+	session, err := r.Connect(r.ConnectOpts{
+		Address:    host,
+		Database:   database,
+		InitialCap: 10,
+		MaxOpen:    10,
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return gcClient, clientErr
+	c.rethinkdb[key] = session
+	return session, nil
 }
 
-// PubSubClient initializes google cloud pubsub Client from credentials in env
-func PubSubClient(projectID string) (*pubsub.Client, error) {
-	var clientErr error
-	pubSubClientOnce.Do(func() {
-		ctx := context.Background()
-		client, err := pubsub.NewClient(ctx, projectID)
-		if err != nil {
-			clientErr = err
-			return
+// Close closes every client that was created
+func (c *Clients) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []string
+	for projectID, client := range c.pubsub {
+		if err := client.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("pubsub %s: %s", projectID, err))
 		}
+	}
 
-		pubSubClient = client
-		return
-	})
+	for key, session := range c.rethinkdb {
+		if err := session.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("rethinkdb %s: %s", key, err))
+		}
+	}
+
+	c.pubsub = make(map[string]*pubsub.Client)
+	c.rethinkdb = make(map[string]*r.Session)
+	c.iot = nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error closing clients %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// CloudIoTEmulatorEndpoint returns the base url of the cloudiot emulator, it is empty when none is set
+func CloudIoTEmulatorEndpoint() string {
+	host := os.Getenv(CloudIoTEmulatorHostEnv)
+	if host == "" {
+		return ""
+	}
+
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	return strings.TrimSuffix(host, "/") + "/"
+}
 
-	return pubSubClient, clientErr
+// NewClients returns a container that has not created any client yet
+func NewClients() *Clients {
+	return &Clients{
+		pubsub:    make(map[string]*pubsub.Client),
+		rethinkdb: make(map[string]*r.Session),
+	}
 }
@@ -0,0 +1,316 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells sessions the time and when to act. Advance must be called by the goroutine waiting on the
+// channels of the clock every time before it blocks on them, a virtual clock only moves and fires then
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Timer
+	Advance()
+}
+
+// Timer fires on C once, or every period for tickers. Reset makes a timer fire d from now and changes the
+// period of a ticker to d
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// WallClock returns the clock of the machine
+func WallClock() Clock {
+	return wallClock{}
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (wallClock) NewTimer(d time.Duration) Timer {
+	return &wallTimer{timer: time.NewTimer(d)}
+}
+
+func (wallClock) NewTicker(d time.Duration) Timer {
+	return &wallTicker{ticker: time.NewTicker(d)}
+}
+
+func (wallClock) Advance() {}
+
+type wallTimer struct {
+	timer *time.Timer
+}
+
+func (t *wallTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *wallTimer) Reset(d time.Duration) {
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+
+	t.timer.Reset(d)
+}
+
+func (t *wallTimer) Stop() {
+	t.timer.Stop()
+}
+
+type wallTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *wallTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *wallTicker) Reset(d time.Duration) {
+	t.ticker.Reset(d)
+}
+
+func (t *wallTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// ScaledClock returns a clock starting at start that runs speed times faster than the wall clock, every
+// goroutine can share it
+func ScaledClock(start time.Time, speed float64) Clock {
+	return &scaledClock{start: start, origin: time.Now(), speed: speed}
+}
+
+type scaledClock struct {
+	start  time.Time
+	origin time.Time
+	speed  float64
+}
+
+func (c *scaledClock) Now() time.Time {
+	return c.virtual(time.Now())
+}
+
+func (c *scaledClock) virtual(t time.Time) time.Time {
+	return c.start.Add(time.Duration(float64(t.Sub(c.origin)) * c.speed))
+}
+
+func (c *scaledClock) real(d time.Duration) time.Duration {
+	if d = time.Duration(float64(d) / c.speed); d > 0 {
+		return d
+	}
+
+	// tickers need a positive interval
+	return time.Nanosecond
+}
+
+func (c *scaledClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// NewTimer fires from the goroutine of time.AfterFunc, nothing keeps running once it fired or was stopped
+func (c *scaledClock) NewTimer(d time.Duration) Timer {
+	t := &scaledTimer{clock: c, c: make(chan time.Time, 1)}
+	t.timer = &wallTimer{timer: time.AfterFunc(c.real(d), func() {
+		t.send(time.Now())
+	})}
+
+	return t
+}
+
+// NewTicker converts the wall times the ticker fires at to times of the clock until it is stopped
+func (c *scaledClock) NewTicker(d time.Duration) Timer {
+	t := &scaledTimer{clock: c, c: make(chan time.Time, 1), stop: make(chan struct{})}
+	t.timer = &wallTicker{ticker: time.NewTicker(c.real(d))}
+	go t.forward()
+	return t
+}
+
+func (c *scaledClock) Advance() {}
+
+type scaledTimer struct {
+	clock *scaledClock
+	timer Timer
+	c     chan time.Time
+	// stop ends the goroutine forwarding a ticker, timers have none
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *scaledTimer) forward() {
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-t.timer.C():
+			t.send(now)
+		}
+	}
+}
+
+// send delivers the clock time of the wall time now unless a time is still waiting to be received
+func (t *scaledTimer) send(now time.Time) {
+	select {
+	case t.c <- t.clock.virtual(now):
+	default:
+	}
+}
+
+func (t *scaledTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *scaledTimer) Reset(d time.Duration) {
+	t.timer.Reset(t.clock.real(d))
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+func (t *scaledTimer) Stop() {
+	t.timer.Stop()
+	if t.stop == nil {
+		return
+	}
+
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
+
+// VirtualClock returns a clock starting at start that jumps straight to the next timer whenever it is
+// advanced, a simulation runs as fast as it can publish. Only one goroutine may wait on it
+func VirtualClock(start time.Time) Clock {
+	return &virtualClock{now: start}
+}
+
+type virtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *virtualClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *virtualClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *virtualClock) NewTicker(d time.Duration) Timer {
+	return c.newTimer(d, d)
+}
+
+func (c *virtualClock) newTimer(d, period time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &virtualTimer{clock: c, c: make(chan time.Time, 1), when: c.now.Add(d), period: period}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock to the earliest timer and fires it, unless a fired time is still waiting
+// to be received
+func (c *virtualClock) Advance() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var next *virtualTimer
+	for _, t := range c.timers {
+		if len(t.c) > 0 {
+			return
+		}
+
+		if next == nil || t.when.Before(next.when) {
+			next = t
+		}
+	}
+
+	if next == nil {
+		return
+	}
+
+	if next.when.After(c.now) {
+		c.now = next.when
+	}
+
+	next.c <- next.when
+	if next.period > 0 {
+		next.when = next.when.Add(next.period)
+	} else {
+		c.remove(next)
+	}
+}
+
+// remove forgets t, the lock must be held
+func (c *virtualClock) remove(t *virtualTimer) {
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+type virtualTimer struct {
+	clock  *virtualClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTimer) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	select {
+	case <-t.c:
+	default:
+	}
+
+	t.clock.remove(t)
+	t.when = t.clock.now.Add(d)
+	if t.period > 0 {
+		t.period = d
+	}
+
+	t.clock.timers = append(t.clock.timers, t)
+}
+
+func (t *virtualTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	select {
+	case <-t.c:
+	default:
+	}
+
+	t.clock.remove(t)
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// receive returns the time waiting on c, it fails when the clock fired nothing
+func receive(t *testing.T, c <-chan time.Time) time.Time {
+	t.Helper()
+
+	select {
+	case fired := <-c:
+		return fired
+	default:
+		t.Fatalf("nothing fired")
+		return time.Time{}
+	}
+}
+
+func TestVirtualClockAdvance(t *testing.T) {
+	start := time.Date(2020, 1, 6, 9, 0, 0, 0, time.UTC)
+	clock := VirtualClock(start)
+
+	ticker := clock.NewTicker(2 * time.Second)
+	timer := clock.NewTimer(3 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+	stopped.Stop()
+
+	// timers fire in the order they are due whatever the order they were created in
+	steps := []struct {
+		c     <-chan time.Time
+		after time.Duration
+	}{
+		{ticker.C(), 2 * time.Second},
+		{timer.C(), 3 * time.Second},
+		{ticker.C(), 4 * time.Second},
+		{ticker.C(), 6 * time.Second},
+	}
+
+	for i, step := range steps {
+		clock.Advance()
+		want := start.Add(step.after)
+		if fired := receive(t, step.c); !fired.Equal(want) {
+			t.Fatalf("step %d fired at %s, want %s", i, fired, want)
+		}
+
+		if now := clock.Now(); !now.Equal(want) {
+			t.Fatalf("step %d Now() = %s, want %s", i, now, want)
+		}
+	}
+
+	// a fired time that was not received holds the clock back
+	clock.Advance()
+	clock.Advance()
+	if now := clock.Now(); !now.Equal(start.Add(8 * time.Second)) {
+		t.Fatalf("Now() = %s after advancing past an unreceived tick, want the clock held at 8s", now)
+	}
+
+	// reset timers are due from the time of the clock and replace what was waiting
+	ticker.Reset(5 * time.Second)
+	after := clock.After(time.Second)
+	clock.Advance()
+	if fired := receive(t, after); !fired.Equal(start.Add(9 * time.Second)) {
+		t.Fatalf("After(1s) fired at %s, want 9s", fired)
+	}
+
+	clock.Advance()
+	if fired := receive(t, ticker.C()); !fired.Equal(start.Add(13 * time.Second)) {
+		t.Fatalf("reset ticker fired at %s, want 13s", fired)
+	}
+
+	ticker.Stop()
+	clock.Advance()
+	if now := clock.Now(); !now.Equal(start.Add(13 * time.Second)) {
+		t.Errorf("Now() = %s after advancing without timers, want the clock to stay at 13s", now)
+	}
+}
+
+func TestScaledClock(t *testing.T) {
+	start := time.Date(2020, 1, 6, 9, 0, 0, 0, time.UTC)
+	clock := ScaledClock(start, 1000)
+
+	// a second of the clock passes in a millisecond
+	before := time.Now()
+	fired := <-clock.NewTimer(time.Second).C()
+	if elapsed := time.Since(before); elapsed > 500*time.Millisecond {
+		t.Errorf("a 1s timer took %s, want it scaled down to about 1ms", elapsed)
+	}
+
+	if fired.Before(start.Add(time.Second)) {
+		t.Errorf("timer fired at %s, want at least 1s after the start", fired)
+	}
+
+	ticker := clock.NewTicker(10 * time.Second)
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		tick := <-ticker.C()
+		if !tick.After(last) {
+			t.Fatalf("tick %d at %s, want it after %s", i, tick, last)
+		}
+		last = tick
+	}
+
+	ticker.Stop()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-ticker.C():
+	default:
+	}
+
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("stopped ticker fired at %s", tick)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if now := clock.Now(); now.Sub(start) < time.Second {
+		t.Errorf("Now() = %s, want the clock to run ahead of the wall clock", now)
+	}
+}
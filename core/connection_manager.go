@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const DefaultMaxConnecting = 50
+
+// ConnectionManager opens, tracks and closes the transport connections of many devices
+type ConnectionManager struct {
+	devices map[string]*Device
+	sem     chan struct{}
+	sync.Mutex
+}
+
+// Open connects device and tracks it, at most maxConnecting connects are in flight at once
+func (m *ConnectionManager) Open(ctx context.Context, d *Device) error {
+	select {
+	case m.sem <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("error connecting device %s: %s", d.DeviceID, ctx.Err())
+	}
+
+	err := d.Connect(ctx)
+	<-m.sem
+	if err != nil {
+		return fmt.Errorf("error connecting device %s: %s", d.DeviceID, err)
+	}
+
+	m.Lock()
+	m.devices[d.DeviceID] = d
+	m.Unlock()
+
+	logger.WithField("device-id", d.DeviceID).Debugln("device connected")
+	return nil
+}
+
+// OpenAll connects every device concurrently and returns the first error encountered
+func (m *ConnectionManager) OpenAll(ctx context.Context, devices []*Device) error {
+	errs := make(chan error, len(devices))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(devices))
+	for _, d := range devices {
+		go func(d *Device) {
+			defer wg.Done()
+			if err := m.Open(ctx, d); err != nil {
+				errs <- err
+			}
+		}(d)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// Get returns the tracked device with deviceID
+func (m *ConnectionManager) Get(deviceID string) (*Device, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	d, ok := m.devices[deviceID]
+	return d, ok
+}
+
+// Len returns the number of open connections
+func (m *ConnectionManager) Len() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.devices)
+}
+
+// Close disconnects deviceID and stops tracking it
+func (m *ConnectionManager) Close(deviceID string) error {
+	m.Lock()
+	d, ok := m.devices[deviceID]
+	delete(m.devices, deviceID)
+	m.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return d.Close()
+}
+
+// CloseAll disconnects every tracked device concurrently and returns the first error encountered
+func (m *ConnectionManager) CloseAll() error {
+	m.Lock()
+	devices := m.devices
+	m.devices = make(map[string]*Device)
+	m.Unlock()
+
+	errs := make(chan error, len(devices))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(devices))
+	for _, d := range devices {
+		go func(d *Device) {
+			defer wg.Done()
+			if err := d.Close(); err != nil {
+				errs <- fmt.Errorf("error closing device %s: %s", d.DeviceID, err)
+			}
+		}(d)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// NewConnectionManager returns an empty ConnectionManager
+func NewConnectionManager(maxConnecting int) *ConnectionManager {
+	if maxConnecting < 1 {
+		maxConnecting = DefaultMaxConnecting
+	}
+
+	return &ConnectionManager{
+		devices: make(map[string]*Device),
+		sem:     make(chan struct{}, maxConnecting),
+	}
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedTransport blocks Connect until the gate is closed and records how many connects overlapped
+type gatedTransport struct {
+	*MemoryTransport
+	gate    chan struct{}
+	tracker *connectTracker
+	fail    bool
+}
+
+type connectTracker struct {
+	connecting int
+	max        int
+	sync.Mutex
+}
+
+func (t *gatedTransport) Connect(ctx context.Context) error {
+	t.tracker.Lock()
+	t.tracker.connecting++
+	if t.tracker.connecting > t.tracker.max {
+		t.tracker.max = t.tracker.connecting
+	}
+	t.tracker.Unlock()
+
+	<-t.gate
+
+	t.tracker.Lock()
+	t.tracker.connecting--
+	t.tracker.Unlock()
+
+	if t.fail {
+		return fmt.Errorf("connect refused")
+	}
+
+	return t.MemoryTransport.Connect(ctx)
+}
+
+func TestConnectionManagerOpenAll(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name          string
+		maxConnecting int
+		devices       int
+		failing       int
+		wantMax       int
+		wantOpen      int
+		wantErr       bool
+	}{
+		{name: "bounded by max connecting", maxConnecting: 3, devices: 10, wantMax: 3, wantOpen: 10},
+		{name: "fewer devices than the bound", maxConnecting: 5, devices: 2, wantMax: 2, wantOpen: 2},
+		{name: "default bound", maxConnecting: 0, devices: DefaultMaxConnecting + 5, wantMax: DefaultMaxConnecting, wantOpen: DefaultMaxConnecting + 5},
+		{name: "failed connects are not tracked", maxConnecting: 2, devices: 4, failing: 1, wantMax: 2, wantOpen: 3, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gate := make(chan struct{})
+			tracker := &connectTracker{}
+			broker := NewMemoryBroker()
+			devices := make([]*Device, tc.devices)
+			for i := range devices {
+				devices[i] = &Device{DeviceID: fmt.Sprintf("device-%d", i)}
+				devices[i].Transport = &gatedTransport{
+					MemoryTransport: NewMemoryTransport(broker),
+					gate:            gate,
+					tracker:         tracker,
+					fail:            i < tc.failing,
+				}
+			}
+
+			manager := NewConnectionManager(tc.maxConnecting)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- manager.OpenAll(ctx, devices)
+			}()
+
+			// give every device the chance to start connecting before any connect completes
+			time.Sleep(50 * time.Millisecond)
+			close(gate)
+
+			err := <-errs
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("OpenAll() error %v, want error %t", err, tc.wantErr)
+			}
+
+			if tracker.max != tc.wantMax {
+				t.Errorf("%d devices connected at once, want %d", tracker.max, tc.wantMax)
+			}
+
+			if manager.Len() != tc.wantOpen {
+				t.Errorf("Len() = %d, want %d", manager.Len(), tc.wantOpen)
+			}
+
+			if err := manager.CloseAll(); err != nil {
+				t.Errorf("CloseAll() error %s", err)
+			}
+
+			if manager.Len() != 0 {
+				t.Errorf("Len() after CloseAll() = %d, want 0", manager.Len())
+			}
+		})
+	}
+}
@@ -1,18 +1,17 @@
 package core
 
 import (
-	"crypto/rsa"
-	"crypto/tls"
+	"context"
+	"crypto"
 	"crypto/x509"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/kc1116/perch-interactive-challenge/core/protos"
 	"google.golang.org/api/cloudiot/v1"
-	"io/ioutil"
 	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,61 +21,113 @@ const (
 	qos        = 1
 	retain     = false
 	username   = "unused"
-)
-
-var mqttPool = &MqttPool{}
 
-type MqttPool struct {
-	certs *x509.CertPool
-	conn  mqtt.Client
-	sync.Once
-	sync.Mutex
-}
+	DefaultTokenTTL = 24 * time.Hour
+	// DefaultCertValidity is how long device certs are valid, they are renewed before they expire
+	DefaultCertValidity = 365 * 24 * time.Hour
+)
 
 type Device struct {
-	Region      string
-	DeviceID    string
-	RegistryID  string
-	DevicePath  string
-	projectID   string
-	parent      string
-	eventTopic  string
-	tokenString string
-	device      *cloudiot.Device
-	client      *cloudiot.Service
-	mqttconn    mqtt.Client
-	Certs       TLSCerts
+	Region          string
+	DeviceID        string
+	RegistryID      string
+	DevicePath      string
+	projectID       string
+	parent          string
+	eventTopic      string
+	tokenString     string
+	tokenExpiry     time.Time
+	tokenLock       sync.Mutex
+	cancel          context.CancelFunc
+	device          *cloudiot.Device
+	client          *cloudiot.Service
+	Certs           TLSCerts
+	Transport       Transport
+	TokenTTL        time.Duration
+	KeyAlgorithm    string
+	sessionLock     sync.Mutex
+	sessionConfig   SessionConfig
+	session         *Session
+	commands        map[string]CommandHandler
+	StateInterval   time.Duration
+	FirmwareVersion string
+	eventsSent      int64
+	lastError       string
+	connectedAt     time.Time
+	Outbox          *Outbox
+	outboxKick      chan struct{}
+	// Gateway devices are created as IoT Core gateways and hold the connection of their children
+	Gateway     bool
+	gatewayID   string
+	children    []*Device
+	reattaching bool
+	// CertValidity is how long the certs of new and renewed keys are valid, DefaultCertValidity when 0
+	CertValidity time.Duration
+	// Metadata is saved with the device in IoT Core, the aggregator adds it to the events of the device
+	Metadata DeviceMetadata
+	clients  *Clients
+	rng      *rand.Rand
+	// Clock is the time sessions run on and stamp their events with, connections and tokens keep the wall clock
+	Clock Clock
 }
 
 type TLSCerts struct {
 	RootCertTmpl *x509.Certificate
 	Cert         *x509.Certificate
 	Pem          string
-	Key          *rsa.PrivateKey
+	Key          crypto.Signer
 }
 
 // Init
-func (d *Device) Init() (*Device, error) {
+func (d *Device) Init(ctx context.Context) (*Device, error) {
 	var err error
 
-	d.client, err = GCHttpClient()
+	d.client, err = d.clients.CloudIoT()
 	if err != nil {
 		return nil, err
 	}
 
-	err = d.CreateDevice()
+	err = d.CreateDevice(ctx)
 
 	return d, err
 }
 
-// CreateDevice creates our device in google cloud
-func (d *Device) CreateDevice() error {
+// CreateDevice creates our device in google cloud, devices with a loaded identity keep their key
+// and are only created when they do not exist yet, an existing device gets the loaded cert registered
+// when it was created with another one
+func (d *Device) CreateDevice(ctx context.Context) error {
+	if d.gatewayID != "" {
+		return d.createChild(ctx)
+	}
+
 	var err error
-	_ = d.CleanUp()
+	if d.Certs.Key != nil {
+		if device := d.GetDevice(ctx); device != nil {
+			if d.Gateway && !IsGateway(device) {
+				return fmt.Errorf("device %s already exists and is not a gateway", d.DeviceID)
+			}
+
+			d.device = device
+			if !hasCredential(device, d.Certs.Pem) {
+				d.device, err = d.registerCert(ctx, d.Certs.Pem)
+				if err != nil {
+					return err
+				}
+			}
+
+			if err = d.updateMetadata(ctx); err != nil {
+				return err
+			}
+
+			return d.JWT()
+		}
+	} else {
+		_ = d.CleanUp(ctx)
 
-	err = d.NewKey()
-	if err != nil {
-		return err
+		err = d.NewKey()
+		if err != nil {
+			return err
+		}
 	}
 
 	err = d.JWT()
@@ -85,18 +136,19 @@ func (d *Device) CreateDevice() error {
 	}
 
 	device := cloudiot.Device{
-		Id: d.DeviceID,
-		Credentials: []*cloudiot.DeviceCredential{
-			{
-				PublicKey: &cloudiot.PublicKeyCredential{
-					Format: "RSA_X509_PEM",
-					Key:    d.Certs.Pem,
-				},
-			},
-		},
+		Id:          d.DeviceID,
+		Credentials: []*cloudiot.DeviceCredential{d.Credential()},
+		Metadata:    d.Metadata.Map(),
+	}
+
+	if d.Gateway {
+		device.GatewayConfig = &cloudiot.GatewayConfig{
+			GatewayType:       gatewayTypeGateway,
+			GatewayAuthMethod: gatewayAuthAssociated,
+		}
 	}
 
-	d.device, err = d.client.Projects.Locations.Registries.Devices.Create(d.parent, &device).Do()
+	d.device, err = d.client.Projects.Locations.Registries.Devices.Create(d.parent, &device).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
@@ -104,9 +156,36 @@ func (d *Device) CreateDevice() error {
 	return nil
 }
 
+// updateMetadata saves Metadata on an existing device when it changed since the device was created
+func (d *Device) updateMetadata(ctx context.Context) error {
+	if !metadataDiffers(d.device, d.Metadata) {
+		return nil
+	}
+
+	// metadata is replaced as a whole, keys set by others are kept
+	metadata := d.Metadata.Map()
+	for key, value := range d.device.Metadata {
+		if _, ok := metadata[key]; !ok {
+			metadata[key] = value
+		}
+	}
+
+	device, err := d.client.Projects.Locations.Registries.Devices.
+		Patch(d.DevicePath, &cloudiot.Device{Metadata: metadata}).
+		UpdateMask("metadata").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return fmt.Errorf("error updating metadata of %s: %s", d.DeviceID, err)
+	}
+
+	d.device = device
+	return nil
+}
+
 // GetDevice
-func (d *Device) GetDevice() *cloudiot.Device {
-	if device, err := d.client.Projects.Locations.Registries.Devices.Get(d.DevicePath).Do(); err == nil {
+func (d *Device) GetDevice(ctx context.Context) *cloudiot.Device {
+	if device, err := d.client.Projects.Locations.Registries.Devices.Get(d.DevicePath).Context(ctx).Do(); err == nil {
 		return device
 	}
 
@@ -114,9 +193,9 @@ func (d *Device) GetDevice() *cloudiot.Device {
 }
 
 // CleanUp
-func (d *Device) CleanUp() error {
-	if device := d.GetDevice(); device != nil {
-		_, err := d.client.Projects.Locations.Registries.Devices.Delete(d.DevicePath).Do()
+func (d *Device) CleanUp(ctx context.Context) error {
+	if device := d.GetDevice(ctx); device != nil {
+		_, err := d.client.Projects.Locations.Registries.Devices.Delete(d.DevicePath).Context(ctx).Do()
 		if err != nil {
 			return err
 		}
@@ -127,8 +206,33 @@ func (d *Device) CleanUp() error {
 
 // NewKey
 func (d *Device) NewKey() error {
-	key, rootCertTempl, err := CreateKey()
-	rootCert, rootCertPEM, err := CreateCert(rootCertTempl, rootCertTempl, &key.PublicKey, key)
+	key, rootCertTempl, err := CreateKey(d.keyAlgorithm())
+	if err != nil {
+		return err
+	}
+
+	return d.certify(key, rootCertTempl)
+}
+
+// UseKey makes key the device key, a self signed cert is created for it, this is how keys of real devices are imported
+func (d *Device) UseKey(key crypto.Signer) error {
+	algorithm, err := KeyAlgorithmOf(key)
+	if err != nil {
+		return err
+	}
+
+	d.KeyAlgorithm = algorithm
+	rootCertTempl, err := RootCertTemplate(algorithm)
+	if err != nil {
+		return err
+	}
+
+	return d.certify(key, rootCertTempl)
+}
+
+func (d *Device) certify(key crypto.Signer, rootCertTempl *x509.Certificate) error {
+	rootCertTempl.NotAfter = rootCertTempl.NotBefore.Add(d.certValidity())
+	rootCert, rootCertPEM, err := CreateCert(rootCertTempl, rootCertTempl, key.Public(), key)
 	if err != nil {
 		return fmt.Errorf("error creating cert: %v", err)
 	}
@@ -143,13 +247,173 @@ func (d *Device) NewKey() error {
 	return nil
 }
 
-// JWT
+// Credential returns the certificate of the device as an IoT Core credential
+func (d *Device) Credential() *cloudiot.DeviceCredential {
+	return &cloudiot.DeviceCredential{
+		PublicKey: &cloudiot.PublicKeyCredential{
+			Format: CredentialFormat(d.keyAlgorithm()),
+			Key:    d.Certs.Pem,
+		},
+	}
+}
+
+// RenewCert registers a new cert for the device key in place of the current one, IoT Core refuses the key
+// once its cert has expired while the key itself stays valid
+func (d *Device) RenewCert(ctx context.Context) error {
+	fresh, err := CertTemplate(d.keyAlgorithm())
+	if err != nil {
+		return err
+	}
+
+	d.tokenLock.Lock()
+	template := *d.Certs.Cert
+	key := d.Certs.Key
+	d.tokenLock.Unlock()
+
+	// the cert keeps the subject and usages of the current one, only its serial and validity change
+	template.SerialNumber = fresh.SerialNumber
+	template.NotBefore = fresh.NotBefore
+	template.NotAfter = fresh.NotBefore.Add(d.certValidity())
+	cert, certPEM, err := CreateCert(&template, &template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("error creating cert: %v", err)
+	}
+
+	device, err := d.registerCert(ctx, string(certPEM))
+	if err != nil {
+		return err
+	}
+
+	d.tokenLock.Lock()
+	d.device = device
+	d.Certs.Cert = cert
+	d.Certs.Pem = string(certPEM)
+	d.tokenLock.Unlock()
+
+	logger.WithField("device-id", d.DeviceID).
+		WithField("expires", cert.NotAfter.Format(time.RFC3339)).
+		Infoln("renewed device cert")
+	return nil
+}
+
+// registerCert makes certPEM the only credential of the device in IoT Core
+func (d *Device) registerCert(ctx context.Context, certPEM string) (*cloudiot.Device, error) {
+	credentials := []*cloudiot.DeviceCredential{
+		{
+			PublicKey: &cloudiot.PublicKeyCredential{
+				Format: CredentialFormat(d.keyAlgorithm()),
+				Key:    certPEM,
+			},
+		},
+	}
+
+	device, err := d.client.Projects.Locations.Registries.Devices.
+		Patch(d.DevicePath, &cloudiot.Device{Credentials: credentials}).
+		UpdateMask("credentials").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, fmt.Errorf("error registering cert of %s: %s", d.DeviceID, err)
+	}
+
+	return device, nil
+}
+
+func hasCredential(device *cloudiot.Device, certPEM string) bool {
+	for _, credential := range device.Credentials {
+		if credential.PublicKey != nil && credential.PublicKey.Key == certPEM {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Device) certValidity() time.Duration {
+	if d.CertValidity > 0 {
+		return d.CertValidity
+	}
+
+	return DefaultCertValidity
+}
+
+// certRenewAt is the point after which the cert is renewed, a tenth of its lifetime before expiry. Devices
+// without a cert have nothing to renew
+func (d *Device) certRenewAt() (time.Time, bool) {
+	cert := d.Certs.Cert
+	if cert == nil {
+		return time.Time{}, false
+	}
+
+	return cert.NotAfter.Add(-cert.NotAfter.Sub(cert.NotBefore) / 10), true
+}
+
+// Identity returns the device ID, key and cert so they can be saved to a KeyStore
+func (d *Device) Identity() (*Identity, error) {
+	if d.Certs.Key == nil {
+		return nil, fmt.Errorf("device %s has no key", d.DeviceID)
+	}
+
+	return NewIdentity(d.DeviceID, d.Certs.Key, d.Certs.Pem)
+}
+
+// LoadIdentity takes over the ID, key and cert of a saved identity, a cert that is expired or due for
+// renewal is replaced by a new self signed cert for the same key, CreateDevice registers it in IoT Core
+// and the caller saves the identity again
+func (d *Device) LoadIdentity(identity *Identity) error {
+	key, err := identity.Key()
+	if err != nil {
+		return fmt.Errorf("error loading key of %s: %s", identity.DeviceID, err)
+	}
+
+	cert, err := identity.Cert()
+	if err != nil {
+		return fmt.Errorf("error loading cert of %s: %s", identity.DeviceID, err)
+	}
+
+	d.SetID(identity.DeviceID)
+	d.KeyAlgorithm = identity.KeyAlgorithm
+	d.Certs = TLSCerts{
+		Cert: cert,
+		Pem:  identity.Certificate,
+		Key:  key,
+	}
+
+	if renewAt, _ := d.certRenewAt(); time.Now().Before(renewAt) {
+		return nil
+	}
+
+	logger.WithField("device-id", d.DeviceID).
+		WithField("expires", cert.NotAfter.Format(time.RFC3339)).
+		Infoln("saved device cert is expiring, creating a new one")
+	rootCertTempl, err := RootCertTemplate(d.keyAlgorithm())
+	if err != nil {
+		return err
+	}
+
+	return d.certify(key, rootCertTempl)
+}
+
+// SetID changes the ID of the device and the paths derived from it
+func (d *Device) SetID(deviceID string) {
+	d.DeviceID = deviceID
+	d.DevicePath = fmt.Sprintf("%s/devices/%s", d.parent, deviceID)
+	d.eventTopic = fmt.Sprintf("/devices/%s/events", deviceID)
+}
+
+// JWT mints a new token signed by the device key that is valid for TokenTTL
 func (d *Device) JWT() error {
-	token := jwt.New(jwt.SigningMethodRS256)
+	ttl := d.TokenTTL
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+
+	now := time.Now()
+	token := jwt.New(SigningMethod(d.keyAlgorithm()))
 	token.Claims = jwt.StandardClaims{
 		Audience:  d.projectID,
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
 	}
 
 	tokenString, err := token.SignedString(d.Certs.Key)
@@ -158,59 +422,206 @@ func (d *Device) JWT() error {
 	}
 
 	d.tokenString = tokenString
+	d.tokenExpiry = now.Add(ttl)
 	return nil
 }
 
-// ConnectMQTT
-func (d *Device) ConnectMQTT() error {
-	var err error
-	mqttPool.Do(func() {
-		mqttPool.Lock()
+func (d *Device) keyAlgorithm() string {
+	if d.KeyAlgorithm == "" {
+		return KeyAlgorithmRS256
+	}
+
+	return d.KeyAlgorithm
+}
+
+// Token returns the current JWT, minting a new one first if the current token is close to expiring
+func (d *Device) Token() string {
+	d.tokenLock.Lock()
+	defer d.tokenLock.Unlock()
+
+	if time.Now().Before(d.refreshAt()) {
+		return d.tokenString
+	}
+
+	if err := d.JWT(); err != nil {
+		logger.WithError(err).WithField("device-id", d.DeviceID).Errorln("error refreshing device jwt")
+		return d.tokenString
+	}
+
+	atomic.AddInt64(&connectionMetrics.TokenRefreshes, 1)
+	logger.WithField("device-id", d.DeviceID).
+		WithField("expires", d.tokenExpiry.Format(time.RFC3339)).
+		Infoln("refreshed device jwt")
+
+	return d.tokenString
+}
+
+// refreshAt is the point after which the token is considered stale, a tenth of its lifetime before expiry
+func (d *Device) refreshAt() time.Time {
+	ttl := d.TokenTTL
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
 
-		config := &tls.Config{
-			RootCAs:    mqttPool.certs,
-			MinVersion: tls.VersionTLS12,
+	return d.tokenExpiry.Add(-ttl / 10)
+}
+
+// refreshToken reconnects the transport with a fresh JWT before the current one expires and renews the cert
+// before it expires until ctx is done, IoT Core drops connections whose token has expired and refuses keys
+// whose cert has
+func (d *Device) refreshToken(ctx context.Context, reconnector Reconnector) {
+	var renewRetry time.Time
+	for {
+		d.tokenLock.Lock()
+		refresh := d.refreshAt()
+		renew, renewable := d.certRenewAt()
+		d.tokenLock.Unlock()
+
+		// a failed renewal is retried a minute later rather than on every wake up
+		if renew.Before(renewRetry) {
+			renew = renewRetry
 		}
 
-		opts := mqtt.NewClientOptions().
-			AddBroker(mqttServer).
-			SetTLSConfig(config).
-			SetClientID(d.DevicePath).
-			SetUsername(username).
-			SetPassword(d.tokenString).
-			SetProtocolVersion(4)
-
-		mqttPool.conn = mqtt.NewClient(opts)
-		if token := mqttPool.conn.Connect(); token.Wait() && token.Error() != nil {
-			err = token.Error()
+		next := refresh
+		if renewable && renew.Before(next) {
+			next = renew
 		}
 
-		mqttPool.Unlock()
-	})
+		wait := time.Until(next)
+		if wait < time.Second {
+			wait = time.Second
+		}
 
-	return err
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-time.After(wait):
+			if renewable && !now.Before(renew) {
+				if err := d.RenewCert(ctx); err != nil {
+					renewRetry = now.Add(time.Minute)
+					logger.WithError(err).WithField("device-id", d.DeviceID).Errorln("error renewing device cert")
+				}
+			}
+
+			if now.Before(refresh) {
+				continue
+			}
+
+			d.Token()
+			if err := reconnector.Reconnect(ctx); err != nil {
+				logger.WithError(err).WithField("device-id", d.DeviceID).Errorln("error reconnecting with refreshed jwt")
+			}
+		}
+	}
+}
+
+// Connect opens the device transport, devices without a transport default to the Google IoT Core bridge.
+// ctx bounds connecting, the token refresh, state and outbox loops started once connected run until ctx is
+// done or the device is closed
+func (d *Device) Connect(ctx context.Context) error {
+	if d.Transport == nil {
+		d.Transport = NewGoogleTransport(d, nil)
+	}
+
+	err := d.Transport.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := d.SubscribeControl(ctx); err != nil {
+		logger.WithError(err).WithField("device-id", d.DeviceID).Warnln("device will not receive config or commands")
+	}
+
+	if d.Gateway {
+		if err := d.subscribeGatewayErrors(ctx); err != nil {
+			logger.WithError(err).WithField("device-id", d.DeviceID).Warnln("gateway will not receive errors")
+		}
+
+		// children are reattached by a single callback however often the gateway connects, it runs while the
+		// transport reconnects on its own so it is not bound to any Connect
+		if notifier, ok := d.Transport.(ConnectNotifier); ok && !d.reattaching {
+			d.reattaching = true
+			notifier.OnReconnect(func() {
+				d.reattachChildren(context.Background())
+			})
+		}
+	}
+
+	// connecting again replaces the background work started by the previous Connect
+	d.stopBackground()
+	background, cancel := context.WithCancel(ctx)
+	d.cancel = cancel
+	d.connectedAt = time.Now()
+	if reconnector, ok := d.Transport.(Reconnector); ok && d.tokenString != "" {
+		go d.refreshToken(background, reconnector)
+	}
+
+	if d.StateInterval > 0 {
+		go d.reportState(background)
+	}
+
+	if d.Outbox != nil {
+		// the kick channel outlives reconnects so the transport is only asked to notify once
+		if d.outboxKick == nil {
+			d.outboxKick = make(chan struct{}, 1)
+			if notifier, ok := d.Transport.(ConnectNotifier); ok {
+				notifier.OnReconnect(d.kickOutbox)
+			}
+		}
+
+		go d.drainOutbox(background, d.outboxKick)
+	}
+
+	return nil
 }
 
 // Publish
-func (d *Device) Publish(evt *protos.Event) error {
+func (d *Device) Publish(ctx context.Context, evt *protos.Event) error {
 	encoded, err := EncodeEvent(evt)
 	if err != nil {
 		return fmt.Errorf("error encoding evt during publish %s", err)
 	}
-	topic := fmt.Sprintf(interactionsTopicFMT, d.device.Id)
+	topic := fmt.Sprintf(interactionsTopicFMT, d.DeviceID)
+	if d.Outbox != nil {
+		return d.publishOrQueue(ctx, topic, []byte(encoded))
+	}
 
-	mqttPool.Lock()
-	if token := mqttPool.conn.Publish(topic, qos, retain, encoded); token.Wait() && token.Error() != nil {
-		return token.Error()
+	err = d.Transport.Publish(ctx, topic, []byte(encoded))
+	d.recordPublish(err)
+	return err
+}
+
+// Close stops the background work of the device and closes its transport
+func (d *Device) Close() error {
+	d.stopBackground()
+	if d.Transport == nil {
+		return nil
 	}
-	mqttPool.Unlock()
 
-	return nil
+	return d.Transport.Close()
+}
+
+// stopBackground cancels the token refresh, state reports and outbox draining started by Connect
+func (d *Device) stopBackground() {
+	if d.cancel != nil {
+		d.cancel()
+		d.cancel = nil
+	}
 }
 
-// StartSession
-func (d *Device) StartSession(wg *sync.WaitGroup) {
-	NewSession(d.DeviceID, d.Publish).Start(wg)
+// StartSession runs a session with the current session config until it times out or ctx is done,
+// config received while it runs is applied to it
+func (d *Device) StartSession(ctx context.Context) {
+	d.sessionLock.Lock()
+	session := NewSession(d.DeviceID, d.Publish, d.sessionConfig, d.rng, d.Clock)
+	d.session = session
+	d.sessionLock.Unlock()
+
+	session.Start(ctx)
+
+	d.sessionLock.Lock()
+	d.session = nil
+	d.sessionLock.Unlock()
 }
 
 // String
@@ -225,31 +636,32 @@ func (d *Device) String() string {
 	return builder.String()
 }
 
-// ID
-func ID() string {
-	return fmt.Sprintf("perchdevice-%04X%04X", rand.Intn(0x10000), rand.Intn(0x10000))
+// Rand returns the random stream the IDs, sessions and events of the device are drawn from, it must only
+// be used by the goroutine running the sessions of the device
+func (d *Device) Rand() *rand.Rand {
+	return d.rng
 }
 
-// NewDevice returns unintialized device struct
-func NewDevice(projectID, region, registryID, registryPath string) *Device {
-	deviceID := ID()
-	return &Device{
-		Region:     region,
-		projectID:  projectID,
-		RegistryID: registryID,
-		DeviceID:   deviceID,
-		parent:     registryPath,
-		DevicePath: fmt.Sprintf("%s/devices/%s", registryPath, deviceID),
-		eventTopic: fmt.Sprintf("/devices/%s/events", deviceID),
-	}
+// ID returns a device ID drawn from rng
+func ID(rng *rand.Rand) string {
+	return fmt.Sprintf("perchdevice-%04X%04X", rng.Intn(0x10000), rng.Intn(0x10000))
 }
 
-func init() {
-	mqttPool.certs = x509.NewCertPool()
-	pemCerts, err := ioutil.ReadFile("/tmp/google-cert/roots.pem")
-	if err != nil {
-		logger.Fatalf("can not load google certs %s", err)
+// NewDevice returns unintialized device struct, Init creates its IoT Core client with clients
+func NewDevice(clients *Clients, projectID, region, registryID, registryPath string) *Device {
+	d := &Device{
+		clients:       clients,
+		Region:        region,
+		projectID:     projectID,
+		RegistryID:    registryID,
+		parent:        registryPath,
+		sessionConfig: DefaultSessionConfig(),
+		commands:      make(map[string]CommandHandler),
+		rng:           NewRand(),
+		Clock:         WallClock(),
 	}
 
-	mqttPool.certs.AppendCertsFromPEM(pemCerts)
+	d.SetID(ID(d.rng))
+	d.HandleCommand(CommandEndSession, d.endSession)
+	return d
 }
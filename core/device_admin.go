@@ -0,0 +1,52 @@
+package core
+
+import (
+	"context"
+	"google.golang.org/api/cloudiot/v1"
+)
+
+// deviceListFields are requested when listing devices, the API only returns ids otherwise
+const deviceListFields = "blocked,gatewayConfig,metadata,lastEventTime,lastHeartbeatTime,lastStateTime,lastErrorTime,lastErrorStatus"
+
+// ListDevices returns every device in the registry
+func (d *DeviceRegistry) ListDevices(ctx context.Context) ([]*cloudiot.Device, error) {
+	var devices []*cloudiot.Device
+	err := d.Client.Projects.Locations.Registries.Devices.List(d.RegistryName()).
+		FieldMask(deviceListFields).
+		Pages(ctx, func(resp *cloudiot.ListDevicesResponse) error {
+			devices = append(devices, resp.Devices...)
+			return nil
+		})
+
+	return devices, err
+}
+
+// GetDevice returns every field of deviceID
+func (d *DeviceRegistry) GetDevice(ctx context.Context, deviceID string) (*cloudiot.Device, error) {
+	return d.Client.Projects.Locations.Registries.Devices.Get(d.DevicePath(deviceID)).Context(ctx).Do()
+}
+
+// DeleteDevice deletes deviceID, gateways can only be deleted once no device is bound to them
+func (d *DeviceRegistry) DeleteDevice(ctx context.Context, deviceID string) error {
+	_, err := d.Client.Projects.Locations.Registries.Devices.Delete(d.DevicePath(deviceID)).Context(ctx).Do()
+	return err
+}
+
+// SetDeviceBlocked blocks or unblocks deviceID, blocked devices can not connect
+func (d *DeviceRegistry) SetDeviceBlocked(ctx context.Context, deviceID string, blocked bool) (*cloudiot.Device, error) {
+	// blocked is omitted from the request when false unless it is forced
+	device := &cloudiot.Device{Blocked: blocked, ForceSendFields: []string{"Blocked"}}
+	return d.Client.Projects.Locations.Registries.Devices.Patch(d.DevicePath(deviceID), device).UpdateMask("blocked").Context(ctx).Do()
+}
+
+// SetDeviceCredentials replaces the credentials deviceID can authenticate with
+func (d *DeviceRegistry) SetDeviceCredentials(ctx context.Context, deviceID string, credentials []*cloudiot.DeviceCredential) (*cloudiot.Device, error) {
+	device := &cloudiot.Device{Credentials: credentials}
+	return d.Client.Projects.Locations.Registries.Devices.Patch(d.DevicePath(deviceID), device).UpdateMask("credentials").Context(ctx).Do()
+}
+
+// SetDeviceMetadata replaces the metadata of deviceID
+func (d *DeviceRegistry) SetDeviceMetadata(ctx context.Context, deviceID string, metadata DeviceMetadata) (*cloudiot.Device, error) {
+	device := &cloudiot.Device{Metadata: metadata.Map()}
+	return d.Client.Projects.Locations.Registries.Devices.Patch(d.DevicePath(deviceID), device).UpdateMask("metadata").Context(ctx).Do()
+}
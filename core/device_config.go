@@ -0,0 +1,185 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const CommandEndSession = "end-session"
+
+// CommandHandler handles the payload of a command sent to a device
+type CommandHandler func(payload []byte) error
+
+// DeviceConfig is the json document delivered on /devices/{id}/config, durations are go duration strings e.g. "10s".
+// Fields that are left empty keep their current value
+type DeviceConfig struct {
+	TickInterval string   `json:"tickInterval,omitempty"`
+	MinDuration  string   `json:"minDuration,omitempty"`
+	MaxDuration  string   `json:"maxDuration,omitempty"`
+	Products     []string `json:"products,omitempty"`
+}
+
+// DecodeDeviceConfig parses a config document
+func DecodeDeviceConfig(payload []byte) (*DeviceConfig, error) {
+	config := &DeviceConfig{}
+	err := json.Unmarshal(payload, config)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding device config: %s", err)
+	}
+
+	return config, nil
+}
+
+// Apply returns current with every field set in the config replaced
+func (c *DeviceConfig) Apply(current SessionConfig) (SessionConfig, error) {
+	next := current
+	var err error
+	if c.TickInterval != "" {
+		if next.TickInterval, err = time.ParseDuration(c.TickInterval); err != nil || next.TickInterval <= 0 {
+			return current, fmt.Errorf("invalid tickInterval %s", c.TickInterval)
+		}
+	}
+
+	if c.MinDuration != "" {
+		if next.MinDuration, err = time.ParseDuration(c.MinDuration); err != nil || next.MinDuration < 0 {
+			return current, fmt.Errorf("invalid minDuration %s", c.MinDuration)
+		}
+	}
+
+	if c.MaxDuration != "" {
+		if next.MaxDuration, err = time.ParseDuration(c.MaxDuration); err != nil || next.MaxDuration < 0 {
+			return current, fmt.Errorf("invalid maxDuration %s", c.MaxDuration)
+		}
+	}
+
+	// a duration range sent as config replaces the distribution of a scenario
+	if c.MinDuration != "" || c.MaxDuration != "" {
+		next.Duration = nil
+	}
+
+	if next.MaxDuration < next.MinDuration {
+		return current, fmt.Errorf("maxDuration %s is shorter than minDuration %s", next.MaxDuration, next.MinDuration)
+	}
+
+	// products sent as config replace the catalog of a scenario
+	if len(c.Products) > 0 {
+		next.Products = c.Products
+		next.Catalog = nil
+	}
+
+	return next, nil
+}
+
+// SubscribeControl subscribes the device to its config and commands topics, topics the transport can not
+// receive are skipped, e.g. the http bridge has no commands
+func (d *Device) SubscribeControl(ctx context.Context) error {
+	err := d.Transport.Subscribe(ctx, fmt.Sprintf(configTopicFMT, d.DeviceID), d.onConfig)
+	if err == ErrTopicNotSupported {
+		logger.WithField("device-id", d.DeviceID).Debugln("transport does not receive config")
+	} else if err != nil {
+		return fmt.Errorf("error subscribing to config: %s", err)
+	}
+
+	err = d.Transport.Subscribe(ctx, fmt.Sprintf(commandsTopicFMT, d.DeviceID)+"/#", d.onCommand)
+	if err == ErrTopicNotSupported {
+		logger.WithField("device-id", d.DeviceID).Debugln("transport does not receive commands")
+	} else if err != nil {
+		return fmt.Errorf("error subscribing to commands: %s", err)
+	}
+
+	return nil
+}
+
+// HandleCommand registers handler for commands sent to the name subfolder, commands without a subfolder
+// are dispatched to the handler registered for ""
+func (d *Device) HandleCommand(name string, handler CommandHandler) {
+	d.sessionLock.Lock()
+	d.commands[name] = handler
+	d.sessionLock.Unlock()
+}
+
+// SessionConfig returns the parameters new sessions are started with
+func (d *Device) SessionConfig() SessionConfig {
+	d.sessionLock.Lock()
+	defer d.sessionLock.Unlock()
+
+	return d.sessionConfig
+}
+
+// Reconfigure changes the parameters of the running session and of sessions started afterwards
+func (d *Device) Reconfigure(config SessionConfig) {
+	d.sessionLock.Lock()
+	d.sessionConfig = config
+	session := d.session
+	d.sessionLock.Unlock()
+
+	if session != nil {
+		session.Reconfigure(config)
+	}
+}
+
+func (d *Device) onConfig(_ string, payload []byte) {
+	entry := logger.WithField("device-id", d.DeviceID)
+	if len(payload) == 0 {
+		entry.Debugln("received empty device config")
+		return
+	}
+
+	config, err := DecodeDeviceConfig(payload)
+	if err != nil {
+		entry.WithError(err).Warnln("ignoring device config")
+		return
+	}
+
+	sessionConfig, err := config.Apply(d.SessionConfig())
+	if err != nil {
+		entry.WithError(err).Warnln("ignoring device config")
+		return
+	}
+
+	d.Reconfigure(sessionConfig)
+	entry.WithField("tick-interval", sessionConfig.TickInterval).
+		WithField("min-duration", sessionConfig.MinDuration).
+		WithField("max-duration", sessionConfig.MaxDuration).
+		WithField("products", len(sessionConfig.Products)).
+		Infoln("applied device config")
+}
+
+func (d *Device) onCommand(topic string, payload []byte) {
+	prefix := fmt.Sprintf(commandsTopicFMT, d.DeviceID)
+	name := strings.TrimPrefix(strings.TrimPrefix(topic, prefix), "/")
+
+	d.sessionLock.Lock()
+	handler, ok := d.commands[name]
+	d.sessionLock.Unlock()
+
+	entry := logger.WithField("device-id", d.DeviceID).WithField("command", name)
+	if !ok {
+		entry.Warnln("no handler registered for command")
+		return
+	}
+
+	if err := handler(payload); err != nil {
+		entry.WithError(err).Warnln("error handling command")
+		return
+	}
+
+	entry.Infoln("handled command")
+}
+
+// endSession is the built in end-session command, it stops the running session early
+func (d *Device) endSession(_ []byte) error {
+	d.sessionLock.Lock()
+	session := d.session
+	d.sessionLock.Unlock()
+
+	if session == nil {
+		return fmt.Errorf("no session running")
+	}
+
+	session.End()
+	return nil
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/cloudiot/v1"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeviceConfigApply(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  string
+		wantErr bool
+		// want changes the default session config into the one the config applies
+		want func(config *SessionConfig)
+	}{
+		{
+			name:   "tick interval",
+			config: `{"tickInterval": "250ms"}`,
+			want:   func(config *SessionConfig) { config.TickInterval = 250 * time.Millisecond },
+		},
+		{
+			name:   "duration range",
+			config: `{"minDuration": "1s", "maxDuration": "5s"}`,
+			want: func(config *SessionConfig) {
+				config.MinDuration = time.Second
+				config.MaxDuration = 5 * time.Second
+			},
+		},
+		{
+			name:   "products",
+			config: `{"products": ["sku-1", "sku-2"]}`,
+			want:   func(config *SessionConfig) { config.Products = []string{"sku-1", "sku-2"} },
+		},
+		{
+			name:   "empty config keeps the session config",
+			config: `{}`,
+			want:   func(config *SessionConfig) {},
+		},
+		{name: "invalid tick interval", config: `{"tickInterval": "often"}`, wantErr: true},
+		{name: "zero tick interval", config: `{"tickInterval": "0s"}`, wantErr: true},
+		{name: "max shorter than min", config: `{"minDuration": "10s", "maxDuration": "5s"}`, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := DecodeDeviceConfig([]byte(tc.config))
+			if err != nil {
+				t.Fatalf("DecodeDeviceConfig() error %s", err)
+			}
+
+			got, err := config.Apply(DefaultSessionConfig())
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Apply() succeeded, want error")
+				}
+
+				if !reflect.DeepEqual(got, DefaultSessionConfig()) {
+					t.Errorf("Apply() = %+v, want the current config on error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Apply() error %s", err)
+			}
+
+			want := DefaultSessionConfig()
+			tc.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Apply() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	if _, err := DecodeDeviceConfig([]byte("not json")); err == nil {
+		t.Errorf("DecodeDeviceConfig() of a non json document succeeded, want error")
+	}
+}
+
+func TestDeviceControl(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+	device.Transport = NewMemoryTransport(broker)
+
+	var commands []string
+	device.HandleCommand("reboot", func(payload []byte) error {
+		commands = append(commands, string(payload))
+		return nil
+	})
+
+	if err := device.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error %s", err)
+	}
+	defer device.Close()
+
+	configTopic := fmt.Sprintf(configTopicFMT, device.DeviceID)
+	broker.Publish(configTopic, []byte(`{"tickInterval": "2s", "products": ["sku-1"]}`))
+	want := DefaultSessionConfig()
+	want.TickInterval = 2 * time.Second
+	want.Products = []string{"sku-1"}
+	if got := device.SessionConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SessionConfig() after config = %+v, want %+v", got, want)
+	}
+
+	// invalid and empty configs are ignored
+	broker.Publish(configTopic, []byte(`{"tickInterval": "often"}`))
+	broker.Publish(configTopic, nil)
+	if got := device.SessionConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SessionConfig() after invalid config = %+v, want %+v", got, want)
+	}
+
+	commandsTopic := fmt.Sprintf(commandsTopicFMT, device.DeviceID)
+	broker.Publish(commandsTopic+"/reboot", []byte("now"))
+	broker.Publish(commandsTopic+"/unknown", []byte("ignored"))
+	broker.Publish(fmt.Sprintf(commandsTopicFMT, "other-device")+"/reboot", []byte("other device"))
+	if !reflect.DeepEqual(commands, []string{"now"}) {
+		t.Errorf("reboot handler received %v, want [now]", commands)
+	}
+}
+
+func TestSendDeviceConfig(t *testing.T) {
+	ctx := context.Background()
+	registry := NewDeviceRegistry(NewClients(), "perch-test", "us-central1", "perch-test", "perch-test")
+	config := &DeviceConfig{TickInterval: "250ms", Products: []string{"sku-1"}}
+
+	var received *DeviceConfig
+	registry.Client = newTestIoTService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/"+registry.DevicePath("device-1")+":modifyCloudToDeviceConfig" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+
+		req := &cloudiot.ModifyCloudToDeviceConfigRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("error decoding request %s", err)
+		}
+
+		payload, err := base64.StdEncoding.DecodeString(req.BinaryData)
+		if err != nil {
+			t.Errorf("config is not base64 %s", err)
+		}
+
+		received, err = DecodeDeviceConfig(payload)
+		if err != nil {
+			t.Errorf("DecodeDeviceConfig() error %s", err)
+		}
+
+		_ = json.NewEncoder(w).Encode(&cloudiot.DeviceConfig{Version: 2, BinaryData: req.BinaryData})
+	})
+
+	if err := registry.SendDeviceConfig(ctx, "device-1", config); err != nil {
+		t.Fatalf("SendDeviceConfig() error %s", err)
+	}
+
+	if !reflect.DeepEqual(received, config) {
+		t.Errorf("device received %+v, want %+v", received, config)
+	}
+}
@@ -3,8 +3,11 @@ package core
 import (
 	"cloud.google.com/go/pubsub"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"google.golang.org/api/cloudiot/v1"
+	"os"
 	"strings"
 )
 
@@ -18,29 +21,30 @@ type DeviceRegistry struct {
 	Topic        *pubsub.Topic
 	Client       *cloudiot.Service
 	PubSubClient *pubsub.Client
+	// Local registries live in the Pub/Sub and cloudiot emulators the local command starts
+	Local bool
+	// Routes are the subfolder routes registries are created with, topics may be IDs or full names
+	Routes  []EventRoute
+	clients *Clients
 }
 
 // Init initializes our DeviceRegistry by creating the device Registry and pub/sub Topic in google cloud
-func (d *DeviceRegistry) Init(create bool) (*DeviceRegistry, error) {
-	gcclient, err := GCHttpClient()
-	if err != nil {
-		return nil, err
+func (d *DeviceRegistry) Init(ctx context.Context, create bool) (*DeviceRegistry, error) {
+	if d.Local && (os.Getenv(PubSubEmulatorHostEnv) == "" || os.Getenv(CloudIoTEmulatorHostEnv) == "") {
+		return nil, fmt.Errorf("%s and %s must point at the local command", PubSubEmulatorHostEnv, CloudIoTEmulatorHostEnv)
 	}
 
-	pubsubClient, err := PubSubClient(d.projectID)
+	err := d.InitClients()
 	if err != nil {
 		return nil, err
 	}
 
-	d.Client = gcclient
-	d.PubSubClient = pubsubClient
-
-	err = d.CreateTopic()
+	err = d.CreateTopic(ctx)
 	if err != nil {
 		return d, err
 	}
 
-	if registry := d.GetRegistry(); registry != nil {
+	if registry := d.GetRegistry(ctx); registry != nil {
 		d.Registry = registry
 		return d, nil
 	}
@@ -49,7 +53,7 @@ func (d *DeviceRegistry) Init(create bool) (*DeviceRegistry, error) {
 		return nil, fmt.Errorf("Registry not found %s, if you want to create the Registry pass true for create", d.RegistryName())
 	}
 
-	registry, err := d.CreateRegistry(d.Topic.String())
+	registry, err := d.CreateRegistry(ctx, d.Topic.String())
 	if err != nil {
 		return d, err
 	}
@@ -58,30 +62,38 @@ func (d *DeviceRegistry) Init(create bool) (*DeviceRegistry, error) {
 	return d, nil
 }
 
-// CreateRegistry creates a device Registry if it does not already exists
-func (d *DeviceRegistry) CreateRegistry(fullTopicPath string) (*cloudiot.DeviceRegistry, error) {
-	registry := &cloudiot.DeviceRegistry{
-		Id: d.RegistryID,
-		EventNotificationConfigs: []*cloudiot.EventNotificationConfig{
-			{
-				PubsubTopicName: fullTopicPath,
-			},
-		},
+// InitClients connects to IoT Core and Pub/Sub without touching the Registry or Topic
+func (d *DeviceRegistry) InitClients() error {
+	gcclient, err := d.clients.CloudIoT()
+	if err != nil {
+		return err
 	}
 
-	_, err := d.Client.Projects.Locations.Registries.Create(d.parent, registry).Do()
+	pubsubClient, err := d.clients.PubSub(d.projectID)
 	if err != nil {
-		return registry, err
+		return err
 	}
 
-	d.Registry = registry
+	d.Client = gcclient
+	d.PubSubClient = pubsubClient
+	return nil
+}
+
+// CreateRegistry creates a device Registry if it does not already exists
+func (d *DeviceRegistry) CreateRegistry(ctx context.Context, fullTopicPath string) (*cloudiot.DeviceRegistry, error) {
+	routes, err := d.EnsureRouteTopics(ctx, d.Routes)
+	if err != nil {
+		return nil, err
+	}
 
-	return registry, err
+	settings := DefaultRegistrySettings(fullTopicPath)
+	settings.EventRoutes = routes
+	return d.CreateRegistryWithSettings(ctx, settings)
 }
 
 // GetRegistry gets Registry details from GCP
-func (d *DeviceRegistry) GetRegistry() *cloudiot.DeviceRegistry {
-	if registry, err := d.Client.Projects.Locations.Registries.Get(d.RegistryName()).Do(); err == nil {
+func (d *DeviceRegistry) GetRegistry(ctx context.Context) *cloudiot.DeviceRegistry {
+	if registry, err := d.Client.Projects.Locations.Registries.Get(d.RegistryName()).Context(ctx).Do(); err == nil {
 		return registry
 	}
 
@@ -89,14 +101,8 @@ func (d *DeviceRegistry) GetRegistry() *cloudiot.DeviceRegistry {
 }
 
 // CreateTopic creates a Topic if it does not already exists
-func (d *DeviceRegistry) CreateTopic() error {
-	topic := d.PubSubClient.Topic(d.TopicID)
-	if ok, _ := topic.Exists(context.Background()); ok {
-		d.Topic = topic
-		return nil
-	}
-
-	topic, err := d.PubSubClient.CreateTopic(context.Background(), d.TopicID)
+func (d *DeviceRegistry) CreateTopic(ctx context.Context) error {
+	topic, err := d.EnsureTopic(ctx, d.TopicID)
 	if err != nil {
 		return err
 	}
@@ -105,10 +111,46 @@ func (d *DeviceRegistry) CreateTopic() error {
 	return nil
 }
 
+// EnsureTopic returns the topic with topicID creating it if it does not exist yet
+func (d *DeviceRegistry) EnsureTopic(ctx context.Context, topicID string) (*pubsub.Topic, error) {
+	topic := d.PubSubClient.Topic(topicID)
+	if ok, _ := topic.Exists(ctx); ok {
+		return topic, nil
+	}
+
+	return d.PubSubClient.CreateTopic(ctx, topicID)
+}
+
+// SendDeviceConfig pushes a new config version to deviceID, it is delivered on the device config topic
+func (d *DeviceRegistry) SendDeviceConfig(ctx context.Context, deviceID string, config *DeviceConfig) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	req := &cloudiot.ModifyCloudToDeviceConfigRequest{
+		BinaryData: base64.StdEncoding.EncodeToString(b),
+	}
+
+	_, err = d.Client.Projects.Locations.Registries.Devices.ModifyCloudToDeviceConfig(d.DevicePath(deviceID), req).Context(ctx).Do()
+	return err
+}
+
+// SendCommand sends payload to the name subfolder of the device commands topic, the device must be connected
+func (d *DeviceRegistry) SendCommand(ctx context.Context, deviceID, name string, payload []byte) error {
+	req := &cloudiot.SendCommandToDeviceRequest{
+		BinaryData: base64.StdEncoding.EncodeToString(payload),
+		Subfolder:  name,
+	}
+
+	_, err := d.Client.Projects.Locations.Registries.Devices.SendCommandToDevice(d.DevicePath(deviceID), req).Context(ctx).Do()
+	return err
+}
+
 // CleanUp destroys Registry resource in GCP
-func (d *DeviceRegistry) CleanUp() error {
-	if registry := d.GetRegistry(); registry != nil {
-		_, err := d.Client.Projects.Locations.Registries.Delete(d.RegistryName()).Do()
+func (d *DeviceRegistry) CleanUp(ctx context.Context) error {
+	if registry := d.GetRegistry(ctx); registry != nil {
+		_, err := d.Client.Projects.Locations.Registries.Delete(d.RegistryName()).Context(ctx).Do()
 		if err != nil {
 			return err
 		}
@@ -118,7 +160,12 @@ func (d *DeviceRegistry) CleanUp() error {
 
 // RegistryName
 func (d *DeviceRegistry) RegistryName() string {
-	return fmt.Sprintf("projects/%s/locations/%s/registries/%s", d.projectID, d.Region, d.RegistryID)
+	return RegistryName(d.projectID, d.Region, d.RegistryID)
+}
+
+// DevicePath returns the full resource name of deviceID in the registry
+func (d *DeviceRegistry) DevicePath(deviceID string) string {
+	return fmt.Sprintf("%s/devices/%s", d.RegistryName(), deviceID)
 }
 
 // String
@@ -133,9 +180,10 @@ func (d *DeviceRegistry) String() string {
 	return builder.String()
 }
 
-// NewDeviceRegistry returns uninitialized DeviceRegistry struct
-func NewDeviceRegistry(projectID, region, registryID, topicID string) *DeviceRegistry {
+// NewDeviceRegistry returns uninitialized DeviceRegistry struct, Init creates its API clients with clients
+func NewDeviceRegistry(clients *Clients, projectID, region, registryID, topicID string) *DeviceRegistry {
 	return &DeviceRegistry{
+		clients:    clients,
 		projectID:  projectID,
 		RegistryID: registryID,
 		Region:     region,
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeviceRegistryInit(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t)
+	if registry.Registry == nil || registry.Registry.Name != registry.RegistryName() {
+		t.Fatalf("Init() registry %v, want %s", registry.Registry, registry.RegistryName())
+	}
+
+	if ok, err := registry.Topic.Exists(ctx); err != nil || !ok {
+		t.Errorf("topic %s exists %t error %v, want it created", registry.Topic, ok, err)
+	}
+
+	configs := registry.Registry.EventNotificationConfigs
+	if len(configs) != 1 || configs[0].PubsubTopicName != registry.Topic.String() {
+		t.Errorf("event configs %+v, want the registry topic", configs)
+	}
+
+	// a registry that exists is found without create
+	existing, err := NewDeviceRegistry(registry.clients, testProjectID, testRegion, registry.RegistryID, registry.TopicID).Init(ctx, false)
+	if err != nil || existing.Registry.Name != registry.RegistryName() {
+		t.Errorf("Init() of the existing registry error %v, want it found", err)
+	}
+
+	if _, err = NewDeviceRegistry(registry.clients, testProjectID, testRegion, testRegistryID(t), "missing-events").Init(ctx, false); err == nil {
+		t.Errorf("Init() of a missing registry without create succeeded, want error")
+	}
+}
+
+func TestDeviceRegistryRoutes(t *testing.T) {
+	ctx := context.Background()
+	clients := NewClients()
+	defer clients.Close()
+
+	registryID := testRegistryID(t)
+	registry := NewDeviceRegistry(clients, testProjectID, testRegion, registryID, registryID+"-events")
+	registry.Routes = []EventRoute{{SubFolder: SubFolderTelemetry, Topic: registryID + "-telemetry"}}
+	if _, err := registry.Init(ctx, true); err != nil {
+		t.Fatalf("Init() error %s", err)
+	}
+	defer registry.CleanUp(ctx)
+
+	if ok, err := registry.PubSubClient.Topic(registryID + "-telemetry").Exists(ctx); err != nil || !ok {
+		t.Errorf("route topic exists %t error %v, want it created", ok, err)
+	}
+
+	if got, want := registry.TopicFor(SubFolderTelemetry), TopicName(testProjectID, registryID+"-telemetry"); got != want {
+		t.Errorf("TopicFor(telemetry) = %s, want %s", got, want)
+	}
+
+	if got := registry.TopicFor(SubFolderInteractions); got != registry.Topic.String() {
+		t.Errorf("TopicFor(interactions) = %s, want the registry topic", got)
+	}
+}
+
+func TestDeviceRegistryCleanUp(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t)
+	if err := registry.CleanUp(ctx); err != nil {
+		t.Fatalf("CleanUp() error %s", err)
+	}
+
+	if got := registry.GetRegistry(ctx); got != nil {
+		t.Errorf("GetRegistry() after CleanUp() = %s, want nil", got.Name)
+	}
+
+	if err := registry.CleanUp(ctx); err != nil {
+		t.Errorf("CleanUp() of a missing registry error %s, want none", err)
+	}
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultFirmwareVersion = "perch-sim-1.0.0"
+
+// DeviceState is the json document devices report on /devices/{id}/state
+type DeviceState struct {
+	SessionID       string `json:"sessionId,omitempty"`
+	EventsSent      int64  `json:"eventsSent"`
+	LastError       string `json:"lastError,omitempty"`
+	Uptime          string `json:"uptime"`
+	FirmwareVersion string `json:"firmwareVersion"`
+	ReportedAt      string `json:"reportedAt"`
+}
+
+// DeviceStateRecord is a state document as stored by IoT Core
+type DeviceStateRecord struct {
+	UpdateTime string
+	State      *DeviceState
+}
+
+// State returns what the device is currently doing
+func (d *Device) State() *DeviceState {
+	d.sessionLock.Lock()
+	sessionID := ""
+	if d.session != nil {
+		sessionID = d.session.ID
+	}
+	lastError := d.lastError
+	d.sessionLock.Unlock()
+
+	uptime := time.Duration(0)
+	if !d.connectedAt.IsZero() {
+		uptime = time.Since(d.connectedAt).Round(time.Second)
+	}
+
+	firmware := d.FirmwareVersion
+	if firmware == "" {
+		firmware = DefaultFirmwareVersion
+	}
+
+	return &DeviceState{
+		SessionID:       sessionID,
+		EventsSent:      atomic.LoadInt64(&d.eventsSent),
+		LastError:       lastError,
+		Uptime:          uptime.String(),
+		FirmwareVersion: firmware,
+		ReportedAt:      time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// ReportState publishes the current state to the device state topic
+func (d *Device) ReportState(ctx context.Context) error {
+	b, err := json.Marshal(d.State())
+	if err != nil {
+		return err
+	}
+
+	return d.Transport.Publish(ctx, fmt.Sprintf(stateTopicFMT, d.DeviceID), b)
+}
+
+// reportState publishes the device state every StateInterval until ctx is done
+func (d *Device) reportState(ctx context.Context) {
+	ticker := time.NewTicker(d.StateInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.ReportState(ctx); err != nil {
+			logger.WithError(err).WithField("device-id", d.DeviceID).Warnln("error reporting device state")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Device) recordPublish(err error) {
+	if err == nil {
+		atomic.AddInt64(&d.eventsSent, 1)
+		return
+	}
+
+	d.sessionLock.Lock()
+	d.lastError = err.Error()
+	d.sessionLock.Unlock()
+}
+
+// DeviceStates returns up to n of the most recent states reported by deviceID, newest first
+func (d *DeviceRegistry) DeviceStates(ctx context.Context, deviceID string, n int64) ([]*DeviceStateRecord, error) {
+	resp, err := d.Client.Projects.Locations.Registries.Devices.States.List(d.DevicePath(deviceID)).NumStates(n).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*DeviceStateRecord, 0, len(resp.DeviceStates))
+	for _, state := range resp.DeviceStates {
+		record := &DeviceStateRecord{UpdateTime: state.UpdateTime, State: &DeviceState{}}
+		b, err := base64.StdEncoding.DecodeString(state.BinaryData)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding state of %s: %s", deviceID, err)
+		}
+
+		if err = json.Unmarshal(b, record.State); err != nil {
+			logger.WithError(err).WithField("device-id", deviceID).Warnln("skipping state that is not a device state document")
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
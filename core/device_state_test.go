@@ -0,0 +1,173 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core/protos"
+	"google.golang.org/api/cloudiot/v1"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeviceStates(t *testing.T) {
+	ctx := context.Background()
+	first := &DeviceState{SessionID: "session-1", EventsSent: 3, Uptime: "1m0s", FirmwareVersion: DefaultFirmwareVersion}
+	second := &DeviceState{EventsSent: 7, LastError: "publish failed", Uptime: "2m0s", FirmwareVersion: DefaultFirmwareVersion}
+
+	cases := []struct {
+		name     string
+		reported [][]byte
+		status   int
+		wantErr  bool
+		want     []*DeviceState
+	}{
+		{
+			name:     "states in the order IoT Core returns them",
+			reported: [][]byte{stateJSON(t, second), stateJSON(t, first)},
+			want:     []*DeviceState{second, first},
+		},
+		{
+			name:     "skips documents that are not device states",
+			reported: [][]byte{stateJSON(t, first), []byte("not json")},
+			want:     []*DeviceState{first},
+		},
+		{name: "device without states", want: []*DeviceState{}},
+		{name: "missing device", status: http.StatusNotFound, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := NewDeviceRegistry(NewClients(), "perch-test", "us-central1", "perch-test", "perch-test")
+			registry.Client = newTestIoTService(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/"+registry.DevicePath("device-1")+"/states" || r.URL.Query().Get("numStates") != "10" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				}
+
+				if tc.status != 0 {
+					w.WriteHeader(tc.status)
+					return
+				}
+
+				resp := &cloudiot.ListDeviceStatesResponse{}
+				for i, state := range tc.reported {
+					resp.DeviceStates = append(resp.DeviceStates, &cloudiot.DeviceState{
+						BinaryData: base64.StdEncoding.EncodeToString(state),
+						UpdateTime: fmt.Sprintf("2020-01-01T00:00:0%dZ", i),
+					})
+				}
+
+				_ = json.NewEncoder(w).Encode(resp)
+			})
+
+			records, err := registry.DeviceStates(ctx, "device-1", 10)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("DeviceStates() succeeded, want error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("DeviceStates() error %s", err)
+			}
+
+			got := make([]*DeviceState, 0, len(records))
+			for _, record := range records {
+				if record.UpdateTime == "" {
+					t.Errorf("state %+v has no update time", record.State)
+				}
+				got = append(got, record.State)
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("DeviceStates() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeviceReportState(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+	device.FirmwareVersion = "perch-test-2.0.0"
+	device.StateInterval = 10 * time.Millisecond
+	device.Transport = NewMemoryTransport(broker)
+
+	// publishing before the transport is connected fails and is recorded as the last error
+	if err := device.Publish(ctx, &protos.Event{}); err == nil {
+		t.Fatalf("Publish() before Connect() succeeded, want error")
+	}
+
+	var lock sync.Mutex
+	var states []*DeviceState
+	broker.Subscribe(fmt.Sprintf(stateTopicFMT, device.DeviceID), func(_ string, payload []byte) {
+		state := &DeviceState{}
+		if err := json.Unmarshal(payload, state); err != nil {
+			t.Errorf("state is not a device state document %s", err)
+		}
+
+		lock.Lock()
+		states = append(states, state)
+		lock.Unlock()
+	})
+
+	// connecting twice leaves a single report loop running
+	for i := 0; i < 2; i++ {
+		if err := device.Connect(ctx); err != nil {
+			t.Fatalf("Connect() error %s", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := device.Publish(ctx, &protos.Event{}); err != nil {
+			t.Fatalf("Publish() error %s", err)
+		}
+	}
+
+	if err := device.ReportState(ctx); err != nil {
+		t.Fatalf("ReportState() error %s", err)
+	}
+
+	time.Sleep(55 * time.Millisecond)
+	if err := device.Close(); err != nil {
+		t.Fatalf("Close() error %s", err)
+	}
+
+	lock.Lock()
+	reported := len(states)
+	last := states[len(states)-1]
+	lock.Unlock()
+
+	if last.EventsSent != 3 || last.LastError == "" || last.FirmwareVersion != "perch-test-2.0.0" {
+		t.Errorf("reported state %+v, want 3 events sent, the publish error and firmware perch-test-2.0.0", last)
+	}
+
+	// one report per Connect, the explicit one and a report every 10ms, a leaked loop would report twice as often
+	if reported < 3 || reported > 12 {
+		t.Errorf("%d states reported in 55ms, want one report loop", reported)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(states) != reported {
+		t.Errorf("%d states reported after Close(), want none", len(states)-reported)
+	}
+}
+
+func stateJSON(t *testing.T, state *DeviceState) []byte {
+	t.Helper()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("error encoding state %s", err)
+	}
+
+	return b
+}
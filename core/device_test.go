@@ -0,0 +1,388 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/api/cloudiot/v1"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testRegistryPath = "projects/perch-test/locations/us-central1/registries/perch-test"
+
+// newTestIoTService returns a cloudiot client sending every request to handler
+func newTestIoTService(t *testing.T, handler http.HandlerFunc) *cloudiot.Service {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	service, err := cloudiot.New(server.Client())
+	if err != nil {
+		t.Fatalf("error creating cloudiot client %s", err)
+	}
+
+	service.BasePath = server.URL + "/"
+	return service
+}
+
+func TestDeviceNewKey(t *testing.T) {
+	cases := []struct {
+		name      string
+		algorithm string
+		validity  time.Duration
+		want      time.Duration
+	}{
+		{name: "default validity", want: DefaultCertValidity},
+		{name: "configured validity", validity: 72 * time.Hour, want: 72 * time.Hour},
+		{name: "es256 key", algorithm: KeyAlgorithmES256, want: DefaultCertValidity},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+			device.KeyAlgorithm = tc.algorithm
+			device.CertValidity = tc.validity
+			if err := device.NewKey(); err != nil {
+				t.Fatalf("NewKey() error %s", err)
+			}
+
+			cert := device.Certs.Cert
+			if err := cert.CheckSignatureFrom(cert); err != nil {
+				t.Errorf("cert is not self signed %s", err)
+			}
+
+			if got := cert.NotAfter.Sub(cert.NotBefore); got != tc.want {
+				t.Errorf("cert is valid for %s, want %s", got, tc.want)
+			}
+
+			renew, ok := device.certRenewAt()
+			if want := cert.NotAfter.Add(-tc.want / 10); !ok || !renew.Equal(want) {
+				t.Errorf("certRenewAt() = %s %t, want %s", renew, ok, want)
+			}
+		})
+	}
+}
+
+func TestDeviceRenewCert(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name      string
+		algorithm string
+		status    int
+		wantErr   bool
+	}{
+		{name: "registers the renewed cert", status: http.StatusOK},
+		{name: "registers the renewed es256 cert", algorithm: KeyAlgorithmES256, status: http.StatusOK},
+		{name: "keeps the cert when registering fails", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+			device.KeyAlgorithm = tc.algorithm
+			device.CertValidity = time.Hour
+			if err := device.NewKey(); err != nil {
+				t.Fatalf("NewKey() error %s", err)
+			}
+
+			previous := device.Certs
+			var registered *cloudiot.Device
+			device.client = newTestIoTService(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPatch || r.URL.Path != "/v1/"+device.DevicePath || r.URL.Query().Get("updateMask") != "credentials" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				}
+
+				registered = &cloudiot.Device{}
+				if err := json.NewDecoder(r.Body).Decode(registered); err != nil {
+					t.Errorf("error decoding request %s", err)
+				}
+
+				w.WriteHeader(tc.status)
+				_ = json.NewEncoder(w).Encode(registered)
+			})
+
+			err := device.RenewCert(ctx)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("RenewCert() succeeded, want error")
+				}
+
+				if !reflect.DeepEqual(device.Certs, previous) {
+					t.Errorf("RenewCert() changed the cert of the device")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("RenewCert() error %s", err)
+			}
+
+			if len(registered.Credentials) != 1 || registered.Credentials[0].PublicKey.Key != device.Certs.Pem {
+				t.Fatalf("registered credentials %v, want the renewed cert only", registered.Credentials)
+			}
+
+			if format := registered.Credentials[0].PublicKey.Format; format != CredentialFormat(device.keyAlgorithm()) {
+				t.Errorf("registered credential format %s, want %s", format, CredentialFormat(device.keyAlgorithm()))
+			}
+
+			block, _ := pem.Decode([]byte(device.Certs.Pem))
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatalf("renewed cert does not parse %s", err)
+			}
+
+			if cert.SerialNumber.Cmp(previous.Cert.SerialNumber) == 0 {
+				t.Errorf("renewed cert has the serial of the previous one")
+			}
+
+			if !reflect.DeepEqual(cert.PublicKey, previous.Cert.PublicKey) {
+				t.Errorf("renewed cert is for another key")
+			}
+
+			if err := cert.CheckSignatureFrom(cert); err != nil {
+				t.Errorf("renewed cert is not self signed %s", err)
+			}
+
+			if got := cert.NotAfter.Sub(cert.NotBefore); got != time.Hour {
+				t.Errorf("renewed cert is valid for %s, want 1h", got)
+			}
+		})
+	}
+}
+
+func TestCreateKey(t *testing.T) {
+	cases := []struct {
+		algorithm  string
+		wantFormat string
+		wantErr    bool
+	}{
+		{algorithm: KeyAlgorithmRS256, wantFormat: "RSA_X509_PEM"},
+		{algorithm: KeyAlgorithmES256, wantFormat: "ES256_X509_PEM"},
+		{algorithm: "HS256", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.algorithm, func(t *testing.T) {
+			key, template, err := CreateKey(tc.algorithm)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("CreateKey(%s) succeeded, want error", tc.algorithm)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("CreateKey(%s) error %s", tc.algorithm, err)
+			}
+
+			switch public := key.Public().(type) {
+			case *rsa.PublicKey:
+				if tc.algorithm != KeyAlgorithmRS256 || public.N.BitLen() != 2048 {
+					t.Errorf("%s key is RSA-%d, want RSA-2048 for RS256 only", tc.algorithm, public.N.BitLen())
+				}
+			case *ecdsa.PublicKey:
+				if tc.algorithm != KeyAlgorithmES256 || public.Curve != elliptic.P256() {
+					t.Errorf("%s key is ECDSA %s, want P-256 for ES256 only", tc.algorithm, public.Curve.Params().Name)
+				}
+			default:
+				t.Fatalf("%s key is %T", tc.algorithm, public)
+			}
+
+			if template.SignatureAlgorithm != SignatureAlgorithm(tc.algorithm) {
+				t.Errorf("cert signature algorithm %s, want %s", template.SignatureAlgorithm, SignatureAlgorithm(tc.algorithm))
+			}
+
+			if got := CredentialFormat(tc.algorithm); got != tc.wantFormat {
+				t.Errorf("CredentialFormat(%s) = %s, want %s", tc.algorithm, got, tc.wantFormat)
+			}
+		})
+	}
+}
+
+func TestDeviceJWT(t *testing.T) {
+	for _, algorithm := range []string{KeyAlgorithmRS256, KeyAlgorithmES256} {
+		t.Run(algorithm, func(t *testing.T) {
+			device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+			device.KeyAlgorithm = algorithm
+			if err := device.NewKey(); err != nil {
+				t.Fatalf("NewKey() error %s", err)
+			}
+
+			if err := device.JWT(); err != nil {
+				t.Fatalf("JWT() error %s", err)
+			}
+
+			claims := &jwt.StandardClaims{}
+			token, err := jwt.ParseWithClaims(device.Token(), claims, func(token *jwt.Token) (interface{}, error) {
+				if token.Method != SigningMethod(algorithm) {
+					t.Errorf("token is signed with %s, want %s", token.Method.Alg(), algorithm)
+				}
+				return device.Certs.Cert.PublicKey, nil
+			})
+			if err != nil || !token.Valid {
+				t.Fatalf("token does not verify against the device cert %v", err)
+			}
+
+			if claims.Audience != "perch-test" {
+				t.Errorf("token audience %s, want perch-test", claims.Audience)
+			}
+		})
+	}
+}
+
+// newTestIdentity returns the identity of a new key whose cert was valid from notBefore to notAfter
+func newTestIdentity(t *testing.T, deviceID string, notBefore, notAfter time.Time) *Identity {
+	t.Helper()
+
+	key, template, err := CreateKey(KeyAlgorithmES256)
+	if err != nil {
+		t.Fatalf("CreateKey() error %s", err)
+	}
+
+	template.NotBefore = notBefore
+	template.NotAfter = notAfter
+	_, certPEM, err := CreateCert(template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("CreateCert() error %s", err)
+	}
+
+	identity, err := NewIdentity(deviceID, key, string(certPEM))
+	if err != nil {
+		t.Fatalf("NewIdentity() error %s", err)
+	}
+
+	return identity
+}
+
+func TestDeviceLoadIdentity(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		wantNew   bool
+	}{
+		{name: "valid cert is kept", notBefore: now.Add(-time.Hour), notAfter: now.Add(24 * time.Hour)},
+		{name: "cert due for renewal is replaced", notBefore: now.Add(-9 * 24 * time.Hour), notAfter: now.Add(12 * time.Hour), wantNew: true},
+		{name: "expired cert is replaced", notBefore: now.Add(-48 * time.Hour), notAfter: now.Add(-24 * time.Hour), wantNew: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			identity := newTestIdentity(t, "device-identity", tc.notBefore, tc.notAfter)
+			device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+			device.CertValidity = 72 * time.Hour
+			if err := device.LoadIdentity(identity); err != nil {
+				t.Fatalf("LoadIdentity() error %s", err)
+			}
+
+			if device.DeviceID != identity.DeviceID || device.DevicePath != testRegistryPath+"/devices/device-identity" {
+				t.Errorf("device %s at %s, want the saved identity", device.DeviceID, device.DevicePath)
+			}
+
+			if device.KeyAlgorithm != KeyAlgorithmES256 {
+				t.Errorf("key algorithm %s, want %s", device.KeyAlgorithm, KeyAlgorithmES256)
+			}
+
+			saved, err := identity.Cert()
+			if err != nil {
+				t.Fatalf("Cert() error %s", err)
+			}
+
+			cert := device.Certs.Cert
+			if !tc.wantNew {
+				if device.Certs.Pem != identity.Certificate {
+					t.Errorf("cert was replaced, want the saved cert")
+				}
+				return
+			}
+
+			if device.Certs.Pem == identity.Certificate {
+				t.Fatalf("saved cert is kept, want a new cert")
+			}
+
+			if !reflect.DeepEqual(cert.PublicKey, saved.PublicKey) {
+				t.Errorf("new cert is for another key")
+			}
+
+			if !cert.NotAfter.After(now.Add(71*time.Hour)) || cert.NotAfter.Sub(cert.NotBefore) != 72*time.Hour {
+				t.Errorf("new cert is valid from %s to %s, want 72h from now", cert.NotBefore, cert.NotAfter)
+			}
+		})
+	}
+}
+
+func TestDeviceCreateDeviceRegistersLoadedCert(t *testing.T) {
+	ctx := context.Background()
+	identity := newTestIdentity(t, "device-identity", time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	cases := []struct {
+		name        string
+		registered  string
+		wantPatched bool
+	}{
+		{name: "registered cert is kept", registered: identity.Certificate},
+		{name: "other cert is replaced", registered: "previous cert", wantPatched: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+			if err := device.LoadIdentity(identity); err != nil {
+				t.Fatalf("LoadIdentity() error %s", err)
+			}
+
+			patched := false
+			device.client = newTestIoTService(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/"+device.DevicePath {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				}
+
+				registered := &cloudiot.Device{
+					Id: device.DeviceID,
+					Credentials: []*cloudiot.DeviceCredential{
+						{PublicKey: &cloudiot.PublicKeyCredential{Format: "ES256_X509_PEM", Key: tc.registered}},
+					},
+				}
+
+				switch r.Method {
+				case http.MethodGet:
+				case http.MethodPatch:
+					patched = true
+					if err := json.NewDecoder(r.Body).Decode(registered); err != nil {
+						t.Errorf("error decoding request %s", err)
+					}
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				}
+
+				_ = json.NewEncoder(w).Encode(registered)
+			})
+
+			if err := device.CreateDevice(ctx); err != nil {
+				t.Fatalf("CreateDevice() error %s", err)
+			}
+
+			if patched != tc.wantPatched {
+				t.Errorf("credentials patched %t, want %t", patched, tc.wantPatched)
+			}
+
+			if !hasCredential(device.device, identity.Certificate) {
+				t.Errorf("registered credentials %v, want the loaded cert", device.device.Credentials)
+			}
+
+			if device.Token() == "" {
+				t.Errorf("Token() is empty, want a JWT")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"cloud.google.com/go/pubsub/pstest"
+	"context"
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core/fakeiot"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	testProjectID = "perch-test"
+	testRegion    = "us-central1"
+)
+
+// registryCount keeps the registries of a test apart from those of earlier runs when tests are repeated with -count
+var registryCount int64
+
+// TestMain points the cloudiot and pubsub clients at fakes every test shares, tests keep apart by using
+// registries of their own
+func TestMain(m *testing.M) {
+	iot := httptest.NewServer(fakeiot.NewServer())
+	pubsub := pstest.NewServer()
+
+	_ = os.Setenv(CloudIoTEmulatorHostEnv, iot.URL)
+	_ = os.Setenv(PubSubEmulatorHostEnv, pubsub.Addr)
+
+	code := m.Run()
+
+	iot.Close()
+	_ = pubsub.Close()
+	os.Exit(code)
+}
+
+// testRegistryID returns a registry ID no other test or run uses
+func testRegistryID(t *testing.T) string {
+	name := strings.NewReplacer("/", "-", " ", "-").Replace(strings.ToLower(t.Name()))
+	return fmt.Sprintf("%s-%d", name, atomic.AddInt64(&registryCount, 1))
+}
+
+// newTestRegistry creates a registry with a topic of its own in the fakes, it is deleted with its devices
+// when the test ends unless the test deleted it already
+func newTestRegistry(t *testing.T) *DeviceRegistry {
+	ctx := context.Background()
+	t.Helper()
+
+	clients := NewClients()
+	t.Cleanup(func() { _ = clients.Close() })
+
+	registryID := testRegistryID(t)
+	registry, err := NewDeviceRegistry(clients, testProjectID, testRegion, registryID, registryID+"-events").Init(ctx, true)
+	if err != nil {
+		t.Fatalf("error creating registry %s: %s", registryID, err)
+	}
+
+	t.Cleanup(func() {
+		if registry.GetRegistry(ctx) == nil {
+			return
+		}
+
+		if err := registry.DeleteRegistry(ctx, true); err != nil {
+			t.Errorf("error deleting registry %s: %s", registryID, err)
+		}
+	})
+
+	return registry
+}
+
+// newTestDevice creates deviceID in registry
+func newTestDevice(t *testing.T, registry *DeviceRegistry, deviceID string, gateway bool) *Device {
+	ctx := context.Background()
+	t.Helper()
+
+	device := NewDevice(registry.clients, testProjectID, testRegion, registry.RegistryID, registry.RegistryName())
+	device.SetID(deviceID)
+	device.Gateway = gateway
+	if _, err := device.Init(ctx); err != nil {
+		t.Fatalf("error creating device %s: %s", deviceID, err)
+	}
+
+	return device
+}
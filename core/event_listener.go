@@ -5,33 +5,82 @@ import (
 	"context"
 	"fmt"
 	"github.com/satori/go.uuid"
-	"gopkg.in/vrecan/death.v3"
-	"os"
-	SYS "syscall"
+	"sync"
+	"time"
 )
 
+// CleanupTimeout bounds deleting the resources of a component once the context it ran with is done
+const CleanupTimeout = 30 * time.Second
+
+// EventHandler processes an event published to a subfolder, messages are acked when it returns nil
+// and redelivered otherwise
+type EventHandler func(ctx context.Context, msg *pubsub.Message) error
+
+// Delivery is a message waiting in the queue with the handler of the subscription it came from
+type Delivery struct {
+	Msg     *pubsub.Message
+	Handler EventHandler
+}
+
 type EventAggregator struct {
-	Registry    *DeviceRegistry
-	Threads     int
-	StopWorkers chan bool
-	MsgQueue    chan *pubsub.Message
-	Stop        bool
-	sub         *pubsub.Subscription
-	Store       *Store
+	Registry *DeviceRegistry
+	Threads  int
+	MsgQueue chan *Delivery
+	subs     []*pubsub.Subscription
+	handlers map[string]EventHandler
+	Store    *Store
+	// Metadata adds where a device is installed to its interactions
+	Metadata *MetadataCache
+	// Catalog adds the category and price of products to interactions when set, interactions with product
+	// IDs missing from it are dropped
+	Catalog *Catalog
+	clients *Clients
 }
 
 type Worker struct {
-	MsgQueue chan *pubsub.Message
-	Store    *Store
+	MsgQueue chan *Delivery
+}
+
+// Work handles deliveries with ctx until the queue is closed, deliveries handled after ctx is done are redelivered
+func (w *Worker) Work(ctx context.Context) {
+	for delivery := range w.MsgQueue {
+		w.ProcessMsg(ctx, delivery)
+	}
+}
+
+func (w *Worker) ProcessMsg(ctx context.Context, delivery *Delivery) {
+	if err := delivery.Handler(ctx, delivery.Msg); err != nil {
+		logger.WithError(err).
+			WithField("device-id", delivery.Msg.Attributes["deviceId"]).
+			WithField("sub-folder", delivery.Msg.Attributes["subFolder"]).
+			Errorln("worker failed to process event")
+		delivery.Msg.Nack()
+		return
+	}
+
+	delivery.Msg.Ack()
+}
+
+// Handle sets the handler of events published to subFolder, the handler of the empty subfolder
+// receives the events no other handler is set for
+func (e *EventAggregator) Handle(subFolder string, handler EventHandler) {
+	e.handlers[subFolder] = handler
 }
 
-func (w *Worker) Work() {
-	for msg := range w.MsgQueue {
-		w.ProcessMsg(context.Background(), msg)
+func (e *EventAggregator) handler(subFolder string) EventHandler {
+	if handler, ok := e.handlers[subFolder]; ok {
+		return handler
 	}
+
+	return e.handlers[""]
 }
 
-func (w *Worker) ProcessMsg(ctx context.Context, msg *pubsub.Message) {
+// dispatch picks the handler from the subFolder attribute IoT Core sets, it handles topics several routes share
+func (e *EventAggregator) dispatch(ctx context.Context, msg *pubsub.Message) error {
+	return e.handler(msg.Attributes["subFolder"])(ctx, msg)
+}
+
+func (e *EventAggregator) storeInteraction(ctx context.Context, msg *pubsub.Message) error {
 	interactionEvt := DecodeEvt(string(msg.Data))
 	logger.
 		WithField("product-name", interactionEvt.GetProductName()).
@@ -41,82 +90,171 @@ func (w *Worker) ProcessMsg(ctx context.Context, msg *pubsub.Message) {
 		WithField("button-name", interactionEvt.GetButtonName()).
 		Infoln("incoming interaction event")
 
-	err := w.Store.PutEvt(interactionEvt)
+	deviceID := msg.Attributes["deviceId"]
+	interaction := NewInteraction(interactionEvt)
+	if e.Catalog != nil {
+		product, ok := e.Catalog.Product(interactionEvt.GetProductId())
+		if !ok {
+			// redelivering would not make the product known, ack and drop it
+			logger.
+				WithField("device-id", deviceID).
+				WithField("productid", interactionEvt.GetProductId()).
+				Warnln("dropping interaction with a product missing from the catalog")
+			return nil
+		}
+
+		interaction.WithProduct(product)
+	}
+
+	metadata, err := e.Metadata.Get(ctx, deviceID)
 	if err != nil {
-		logger.Errorln("worker failed to store event")
+		return err
 	}
 
-	msg.Ack()
+	return e.Store.PutInteraction(ctx, interaction.WithDevice(deviceID, metadata))
+}
+
+func (e *EventAggregator) logEvent(ctx context.Context, msg *pubsub.Message) error {
+	logger.
+		WithField("device-id", msg.Attributes["deviceId"]).
+		WithField("sub-folder", msg.Attributes["subFolder"]).
+		WithField("bytes", len(msg.Data)).
+		Infoln("incoming device event")
+
+	return nil
 }
 
-func (e *EventAggregator) Start(host, database string) error {
-	store, err := NewStore(host, database)
+// Start subscribes to the topics the registry routes events to and processes events until ctx is done,
+// queued events are handled and the subscriptions deleted before it returns
+func (e *EventAggregator) Start(ctx context.Context, host, database string) error {
+	store, err := NewStore(e.clients, host, database)
 	if err != nil {
 		return fmt.Errorf("unable to start event aggregator err when connecting to event store %s", err)
 	}
 
 	e.Store = store
 
-	subConf := pubsub.SubscriptionConfig{
-		Topic: e.Registry.Topic,
-	}
+	handlers := make(map[*pubsub.Subscription]EventHandler)
+	for topicName, handler := range e.topicHandlers() {
+		topicID, err := TopicID(e.Registry.projectID, topicName)
+		if err != nil {
+			e.deleteSubscriptions()
+			return err
+		}
 
-	sub, err := e.Registry.PubSubClient.CreateSubscription(context.Background(), fmt.Sprintf("sub-%s", uuid.NewV1().String()), subConf)
-	if err != nil {
-		return fmt.Errorf("error creating subscription %s", err)
+		subConf := pubsub.SubscriptionConfig{
+			Topic: e.Registry.PubSubClient.Topic(topicID),
+		}
+
+		sub, err := e.Registry.PubSubClient.CreateSubscription(ctx, fmt.Sprintf("sub-%s", uuid.NewV1().String()), subConf)
+		if err != nil {
+			e.deleteSubscriptions()
+			return fmt.Errorf("error creating subscription to %s %s", topicName, err)
+		}
+
+		e.subs = append(e.subs, sub)
+		handlers[sub] = handler
 	}
 
-	e.sub = sub
-	go e.StartWorkers(sub, e.Store)
+	workers := &sync.WaitGroup{}
+	workers.Add(e.Threads)
+	for i := 0; i < e.Threads; i++ {
+		w := &Worker{MsgQueue: e.MsgQueue}
+		go func() {
+			defer workers.Done()
+			w.Work(ctx)
+		}()
+	}
 
-	signalWatcher := death.NewDeath(SYS.SIGINT, SYS.SIGTERM, SYS.SIGKILL, os.Interrupt)
+	receivers := &sync.WaitGroup{}
+	receivers.Add(len(handlers))
+	for sub, handler := range handlers {
+		go func(sub *pubsub.Subscription, handler EventHandler) {
+			defer receivers.Done()
+			e.StartWorkers(ctx, sub, handler)
+		}(sub, handler)
+	}
 
 	logger.Infoln("listening for incoming pubsub events . . .")
-	err = signalWatcher.WaitForDeath(e)
-	if err != nil {
-		return err
-	}
+	receivers.Wait()
+
+	logger.Infof("received stop signal, killing worker threads and exiting gracefully\n")
+	close(e.MsgQueue)
+	workers.Wait()
 
+	e.deleteSubscriptions()
 	return nil
 }
 
-func (e *EventAggregator) StartWorkers(sub *pubsub.Subscription, store *Store) {
-	logger.Infof("starting event aggregate workers (subscription: %s, num of workers: %x) ", sub.String(), e.Threads)
-	for i := 0; i < e.Threads; i++ {
-		w := &Worker{MsgQueue: e.MsgQueue, Store: store}
-		go w.Work()
+// topicHandlers returns the handler of every topic the registry routes events to, a topic only one
+// subfolder is routed to gets the handler of that subfolder
+func (e *EventAggregator) topicHandlers() map[string]EventHandler {
+	subFolders := make(map[string][]string)
+	for _, route := range EventRoutes(e.Registry.Registry) {
+		subFolders[route.Topic] = append(subFolders[route.Topic], route.SubFolder)
 	}
 
-	for e.Stop == false {
-		err := sub.Receive(context.Background(), func(ctx context.Context, msg *pubsub.Message) {
-			e.MsgQueue <- msg
+	if len(subFolders) == 0 {
+		subFolders[e.Registry.Topic.String()] = []string{""}
+	}
+
+	handlers := make(map[string]EventHandler, len(subFolders))
+	for topicName, folders := range subFolders {
+		if len(folders) == 1 && folders[0] != "" {
+			handlers[topicName] = e.handler(folders[0])
+		} else {
+			handlers[topicName] = e.dispatch
+		}
+	}
+
+	return handlers
+}
+
+// StartWorkers queues the events received on sub for the worker threads until ctx is done
+func (e *EventAggregator) StartWorkers(ctx context.Context, sub *pubsub.Subscription, handler EventHandler) {
+	logger.Infof("receiving events (subscription: %s, num of workers: %d) ", sub.String(), e.Threads)
+	for ctx.Err() == nil {
+		err := sub.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+			e.MsgQueue <- &Delivery{Msg: msg, Handler: handler}
 		})
 		if err != nil {
 			logger.Warnln("error receiving publish", err)
+			_ = sleep(ctx, initialBackoff)
 		}
 	}
-
-	close(e.StopWorkers)
 }
 
-func (e *EventAggregator) Close() error {
-	logger.Infof("received stop signal, killing worker threads and exiting gracefully\n")
-	close(e.MsgQueue)
-	e.Stop = true
+// deleteSubscriptions runs once ctx is done so it gets its own deadline
+func (e *EventAggregator) deleteSubscriptions() {
+	ctx, cancel := context.WithTimeout(context.Background(), CleanupTimeout)
+	defer cancel()
 
-	logger.Infof("deleting subscription %s\n", e.sub.String())
-	err := e.sub.Delete(context.Background())
-	if err != nil {
-		logger.Errorf("error deleting subscription: %s %s", e.sub.String(), err)
+	for _, sub := range e.subs {
+		logger.Infof("deleting subscription %s\n", sub.String())
+		err := sub.Delete(ctx)
+		if err != nil {
+			logger.Errorf("error deleting subscription: %s %s", sub.String(), err)
+		}
 	}
-	return nil
+
+	e.subs = nil
 }
 
-func NewEventListener(registry *DeviceRegistry, threads int) *EventAggregator {
-	return &EventAggregator{
-		Registry:    registry,
-		StopWorkers: make(chan bool),
-		MsgQueue:    make(chan *pubsub.Message),
-		Threads:     threads,
+// NewEventListener returns an aggregator storing interactions and logging telemetry and diagnostics,
+// Handle replaces the handler of a subfolder
+func NewEventListener(clients *Clients, registry *DeviceRegistry, threads int) *EventAggregator {
+	e := &EventAggregator{
+		clients:  clients,
+		Registry: registry,
+		MsgQueue: make(chan *Delivery),
+		Threads:  threads,
+		handlers: make(map[string]EventHandler),
+		Metadata: NewMetadataCache(registry, DefaultMetadataTTL),
 	}
+
+	e.Handle("", e.storeInteraction)
+	e.Handle(SubFolderInteractions, e.storeInteraction)
+	e.Handle(SubFolderTelemetry, e.logEvent)
+	e.Handle(SubFolderDiagnostics, e.logEvent)
+	return e
 }
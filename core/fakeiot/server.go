@@ -0,0 +1,787 @@
+// Package fakeiot is an in-memory stand-in for the Cloud IoT Core v1 REST API. It implements the registry and
+// device calls the perch tools make so they can run without GCP, point a cloudiot client at it with
+// CLOUDIOT_EMULATOR_HOST. Devices never connect to it, states and commands are only recorded.
+package fakeiot
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/cloudiot/v1"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gatewayTypeGateway    = "GATEWAY"
+	gatewayTypeNonGateway = "NON_GATEWAY"
+
+	defaultPageSize = 100
+)
+
+// Server serves the IoT Core API from memory, the zero value is not usable, use NewServer
+type Server struct {
+	// OnConfig is called with every config pushed to a device and OnCommand with every command sent to one,
+	// commands are accepted whether the device is connected or not. Hooks must not call the server
+	OnConfig  func(deviceName string, data []byte)
+	OnCommand func(deviceName, subFolder string, data []byte)
+
+	registries map[string]*registry
+	nextNumID  uint64
+	mu         sync.Mutex
+	server     *http.Server
+}
+
+type registry struct {
+	registry *cloudiot.DeviceRegistry
+	devices  map[string]*device
+}
+
+type device struct {
+	device  *cloudiot.Device
+	configs []*cloudiot.DeviceConfig
+	states  []*cloudiot.DeviceState
+	// bound holds the ids of the devices bound to a gateway
+	bound map[string]bool
+}
+
+// apiError is written in the format google api clients decode into a googleapi.Error
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func errorf(code int, status, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func notFound(name string) *apiError {
+	return errorf(http.StatusNotFound, "NOT_FOUND", "%s not found", name)
+}
+
+func badRequest(format string, args ...interface{}) *apiError {
+	return errorf(http.StatusBadRequest, "INVALID_ARGUMENT", format, args...)
+}
+
+func failedPrecondition(format string, args ...interface{}) *apiError {
+	return errorf(http.StatusBadRequest, "FAILED_PRECONDITION", format, args...)
+}
+
+// ListenAndServe serves the API on addr until the server is closed
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve serves the API on listener until the server is closed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.server = &http.Server{Handler: s}
+	server := s.server
+	s.mu.Unlock()
+
+	err := server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// Close stops serving, the registries are kept
+func (s *Server) Close() error {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	return server.Close()
+}
+
+// ReportState records data as the latest state of the device with the full name deviceName, devices
+// report state through the MQTT or HTTP bridge which the fake does not have
+func (s *Server) ReportState(deviceName string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, apiErr := s.device(deviceName)
+	if apiErr != nil {
+		return fmt.Errorf("%s", apiErr.Message)
+	}
+
+	now := timestamp()
+	d.device.LastStateTime = now
+	d.device.State = &cloudiot.DeviceState{BinaryData: base64.StdEncoding.EncodeToString(data), UpdateTime: now}
+	d.states = append([]*cloudiot.DeviceState{d.device.State}, d.states...)
+	return nil
+}
+
+// ServeHTTP routes v1 requests by the resource name in the path, custom methods follow a colon
+// e.g. /v1/projects/p/locations/l/registries/r:bindDeviceToGateway
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == r.URL.Path {
+		writeError(w, notFound(r.URL.Path))
+		return
+	}
+
+	method := ""
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+		path, method = path[:i], path[i+1:]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp, apiErr := s.route(r, strings.Split(path, "/"), method)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) route(r *http.Request, segments []string, method string) (interface{}, *apiError) {
+	// projects/{p}/locations/{l}/registries/{r}/devices/{d}/{states|configVersions}
+	if len(segments) < 5 || segments[0] != "projects" || segments[2] != "locations" || segments[4] != "registries" {
+		return nil, notFound(strings.Join(segments, "/"))
+	}
+
+	name := strings.Join(segments, "/")
+	switch {
+	case len(segments) == 5 && r.Method == http.MethodGet:
+		return s.listRegistries(r, strings.Join(segments[:4], "/"))
+	case len(segments) == 5 && r.Method == http.MethodPost:
+		return s.createRegistry(r, strings.Join(segments[:4], "/"))
+	case len(segments) == 6 && method == "bindDeviceToGateway":
+		return s.bind(r, name, true)
+	case len(segments) == 6 && method == "unbindDeviceFromGateway":
+		return s.bind(r, name, false)
+	case len(segments) == 6 && r.Method == http.MethodGet:
+		return s.getRegistry(name)
+	case len(segments) == 6 && r.Method == http.MethodPatch:
+		return s.patchRegistry(r, name)
+	case len(segments) == 6 && r.Method == http.MethodDelete:
+		return s.deleteRegistry(name)
+	case len(segments) < 7 || segments[6] != "devices":
+	case len(segments) == 7 && r.Method == http.MethodGet:
+		return s.listDevices(r, strings.Join(segments[:6], "/"))
+	case len(segments) == 7 && r.Method == http.MethodPost:
+		return s.createDevice(r, strings.Join(segments[:6], "/"))
+	case len(segments) == 8 && method == "modifyCloudToDeviceConfig":
+		return s.modifyConfig(r, name)
+	case len(segments) == 8 && method == "sendCommandToDevice":
+		return s.sendCommand(r, name)
+	case len(segments) == 8 && r.Method == http.MethodGet:
+		return s.getDevice(r, name)
+	case len(segments) == 8 && r.Method == http.MethodPatch:
+		return s.patchDevice(r, name)
+	case len(segments) == 8 && r.Method == http.MethodDelete:
+		return s.deleteDevice(name)
+	case len(segments) == 9 && segments[8] == "states" && r.Method == http.MethodGet:
+		return s.listStates(r, strings.Join(segments[:8], "/"))
+	case len(segments) == 9 && segments[8] == "configVersions" && r.Method == http.MethodGet:
+		return s.listConfigVersions(r, strings.Join(segments[:8], "/"))
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "UNIMPLEMENTED", "%s %s is not implemented by the fake", r.Method, r.URL.Path)
+}
+
+func (s *Server) listRegistries(r *http.Request, parent string) (interface{}, *apiError) {
+	var names []string
+	for name := range s.registries {
+		if strings.HasPrefix(name, parent+"/") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	page, next, apiErr := paginate(r, len(names))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	resp := &cloudiot.ListDeviceRegistriesResponse{NextPageToken: next}
+	for _, i := range page {
+		resp.DeviceRegistries = append(resp.DeviceRegistries, s.registries[names[i]].registry)
+	}
+
+	return resp, nil
+}
+
+func (s *Server) createRegistry(r *http.Request, parent string) (interface{}, *apiError) {
+	reg := &cloudiot.DeviceRegistry{}
+	if apiErr := decode(r.Body, reg); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if reg.Id == "" {
+		return nil, badRequest("registry id is required")
+	}
+
+	reg.Name = fmt.Sprintf("%s/registries/%s", parent, reg.Id)
+	if _, ok := s.registries[reg.Name]; ok {
+		return nil, errorf(http.StatusConflict, "ALREADY_EXISTS", "registry %s already exists", reg.Name)
+	}
+
+	if apiErr := validateEventConfigs(reg.EventNotificationConfigs); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if reg.MqttConfig == nil {
+		reg.MqttConfig = &cloudiot.MqttConfig{MqttEnabledState: "MQTT_ENABLED"}
+	}
+
+	if reg.HttpConfig == nil {
+		reg.HttpConfig = &cloudiot.HttpConfig{HttpEnabledState: "HTTP_ENABLED"}
+	}
+
+	s.registries[reg.Name] = &registry{registry: reg, devices: make(map[string]*device)}
+	return reg, nil
+}
+
+func (s *Server) getRegistry(name string) (interface{}, *apiError) {
+	reg, ok := s.registries[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+
+	return reg.registry, nil
+}
+
+func (s *Server) patchRegistry(r *http.Request, name string) (interface{}, *apiError) {
+	reg, ok := s.registries[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+
+	patch := &cloudiot.DeviceRegistry{}
+	if apiErr := decode(r.Body, patch); apiErr != nil {
+		return nil, apiErr
+	}
+
+	mask, apiErr := updateMask(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	for _, field := range mask {
+		switch field {
+		case "eventnotificationconfigs":
+			if apiErr := validateEventConfigs(patch.EventNotificationConfigs); apiErr != nil {
+				return nil, apiErr
+			}
+			reg.registry.EventNotificationConfigs = patch.EventNotificationConfigs
+		case "statenotificationconfig":
+			reg.registry.StateNotificationConfig = patch.StateNotificationConfig
+		case "mqttconfig":
+			reg.registry.MqttConfig = patch.MqttConfig
+		case "httpconfig":
+			reg.registry.HttpConfig = patch.HttpConfig
+		case "loglevel":
+			reg.registry.LogLevel = patch.LogLevel
+		case "credentials":
+			reg.registry.Credentials = patch.Credentials
+		default:
+			return nil, badRequest("registry field %s can not be updated", field)
+		}
+	}
+
+	return reg.registry, nil
+}
+
+func (s *Server) deleteRegistry(name string) (interface{}, *apiError) {
+	reg, ok := s.registries[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+
+	if len(reg.devices) > 0 {
+		return nil, failedPrecondition("registry %s is not empty, it has %d devices", name, len(reg.devices))
+	}
+
+	delete(s.registries, name)
+	return &cloudiot.Empty{}, nil
+}
+
+func (s *Server) bind(r *http.Request, name string, bind bool) (interface{}, *apiError) {
+	reg, ok := s.registries[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+
+	req := &cloudiot.BindDeviceToGatewayRequest{}
+	if apiErr := decode(r.Body, req); apiErr != nil {
+		return nil, apiErr
+	}
+
+	gateway, ok := reg.devices[req.GatewayId]
+	if !ok {
+		return nil, notFound(req.GatewayId)
+	}
+
+	child, ok := reg.devices[req.DeviceId]
+	if !ok {
+		return nil, notFound(req.DeviceId)
+	}
+
+	if !isGateway(gateway.device) {
+		return nil, failedPrecondition("device %s is not a gateway", req.GatewayId)
+	}
+
+	if bind {
+		if isGateway(child.device) {
+			return nil, failedPrecondition("gateway %s can not be bound to a gateway", req.DeviceId)
+		}
+
+		gateway.bound[req.DeviceId] = true
+		return &cloudiot.BindDeviceToGatewayResponse{}, nil
+	}
+
+	if !gateway.bound[req.DeviceId] {
+		return nil, notFound(fmt.Sprintf("association between %s and %s", req.GatewayId, req.DeviceId))
+	}
+
+	delete(gateway.bound, req.DeviceId)
+	return &cloudiot.UnbindDeviceFromGatewayResponse{}, nil
+}
+
+func (s *Server) listDevices(r *http.Request, registryName string) (interface{}, *apiError) {
+	reg, ok := s.registries[registryName]
+	if !ok {
+		return nil, notFound(registryName)
+	}
+
+	query := r.URL.Query()
+	gatewayID := query.Get("gatewayListOptions.associationsGatewayId")
+	deviceID := query.Get("gatewayListOptions.associationsDeviceId")
+	gatewayType := query.Get("gatewayListOptions.gatewayType")
+	ids := query["deviceIds"]
+
+	var matches []string
+	for id, d := range reg.devices {
+		switch {
+		case gatewayID != "" && !(reg.devices[gatewayID] != nil && reg.devices[gatewayID].bound[id]):
+		case deviceID != "" && !d.bound[deviceID]:
+		case gatewayType == gatewayTypeGateway && !isGateway(d.device):
+		case gatewayType == gatewayTypeNonGateway && isGateway(d.device):
+		case len(ids) > 0 && !contains(ids, id):
+		default:
+			matches = append(matches, id)
+		}
+	}
+
+	sort.Strings(matches)
+	page, next, apiErr := paginate(r, len(matches))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	// like the real API only ids are listed unless more fields are asked for
+	fields := append([]string{"id", "name", "numId"}, fieldMask(r)...)
+	devices := make([]json.RawMessage, 0, len(page))
+	for _, i := range page {
+		b, apiErr := maskFields(reg.devices[matches[i]].device, fields)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+
+		devices = append(devices, b)
+	}
+
+	return struct {
+		Devices       []json.RawMessage `json:"devices"`
+		NextPageToken string            `json:"nextPageToken,omitempty"`
+	}{devices, next}, nil
+}
+
+func (s *Server) createDevice(r *http.Request, registryName string) (interface{}, *apiError) {
+	reg, ok := s.registries[registryName]
+	if !ok {
+		return nil, notFound(registryName)
+	}
+
+	dev := &cloudiot.Device{}
+	if apiErr := decode(r.Body, dev); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if dev.Id == "" {
+		return nil, badRequest("device id is required")
+	}
+
+	if _, ok := reg.devices[dev.Id]; ok {
+		return nil, errorf(http.StatusConflict, "ALREADY_EXISTS", "device %s already exists", dev.Id)
+	}
+
+	if dev.GatewayConfig == nil {
+		dev.GatewayConfig = &cloudiot.GatewayConfig{}
+	}
+
+	if dev.GatewayConfig.GatewayType == "" {
+		dev.GatewayConfig.GatewayType = gatewayTypeNonGateway
+	}
+
+	s.nextNumID++
+	dev.Name = fmt.Sprintf("%s/devices/%s", registryName, dev.Id)
+	dev.NumId = s.nextNumID
+	dev.Config = &cloudiot.DeviceConfig{Version: 1, CloudUpdateTime: timestamp()}
+
+	reg.devices[dev.Id] = &device{
+		device:  dev,
+		configs: []*cloudiot.DeviceConfig{dev.Config},
+		bound:   make(map[string]bool),
+	}
+
+	return dev, nil
+}
+
+func (s *Server) getDevice(r *http.Request, name string) (interface{}, *apiError) {
+	d, apiErr := s.device(name)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	fields := fieldMask(r)
+	if len(fields) == 0 {
+		return d.device, nil
+	}
+
+	return maskFields(d.device, append([]string{"id", "name", "numId"}, fields...))
+}
+
+func (s *Server) patchDevice(r *http.Request, name string) (interface{}, *apiError) {
+	d, apiErr := s.device(name)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	patch := &cloudiot.Device{}
+	if apiErr := decode(r.Body, patch); apiErr != nil {
+		return nil, apiErr
+	}
+
+	mask, apiErr := updateMask(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	for _, field := range mask {
+		switch field {
+		case "blocked":
+			d.device.Blocked = patch.Blocked
+		case "credentials":
+			d.device.Credentials = patch.Credentials
+		case "metadata":
+			d.device.Metadata = patch.Metadata
+		case "loglevel":
+			d.device.LogLevel = patch.LogLevel
+		case "gatewayconfig.gatewayauthmethod":
+			if patch.GatewayConfig != nil {
+				d.device.GatewayConfig.GatewayAuthMethod = patch.GatewayConfig.GatewayAuthMethod
+			}
+		default:
+			return nil, badRequest("device field %s can not be updated", field)
+		}
+	}
+
+	return d.device, nil
+}
+
+func (s *Server) deleteDevice(name string) (interface{}, *apiError) {
+	d, apiErr := s.device(name)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if len(d.bound) > 0 {
+		return nil, failedPrecondition("gateway %s still has %d bound devices", d.device.Id, len(d.bound))
+	}
+
+	reg := s.registries[registryOf(name)]
+	for _, other := range reg.devices {
+		delete(other.bound, d.device.Id)
+	}
+
+	delete(reg.devices, d.device.Id)
+	return &cloudiot.Empty{}, nil
+}
+
+func (s *Server) modifyConfig(r *http.Request, name string) (interface{}, *apiError) {
+	d, apiErr := s.device(name)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	req := &cloudiot.ModifyCloudToDeviceConfigRequest{}
+	if apiErr := decode(r.Body, req); apiErr != nil {
+		return nil, apiErr
+	}
+
+	data, err := base64.StdEncoding.DecodeString(req.BinaryData)
+	if err != nil {
+		return nil, badRequest("binaryData is not base64 %s", err)
+	}
+
+	if req.VersionToUpdate != 0 && req.VersionToUpdate != d.device.Config.Version {
+		return nil, failedPrecondition("config version %d of %s is not the latest", req.VersionToUpdate, d.device.Id)
+	}
+
+	d.device.Config = &cloudiot.DeviceConfig{
+		BinaryData:      req.BinaryData,
+		CloudUpdateTime: timestamp(),
+		Version:         d.device.Config.Version + 1,
+	}
+	d.device.LastConfigSendTime = d.device.Config.CloudUpdateTime
+	d.configs = append([]*cloudiot.DeviceConfig{d.device.Config}, d.configs...)
+
+	if s.OnConfig != nil {
+		s.OnConfig(name, data)
+	}
+
+	return d.device.Config, nil
+}
+
+func (s *Server) sendCommand(r *http.Request, name string) (interface{}, *apiError) {
+	if _, apiErr := s.device(name); apiErr != nil {
+		return nil, apiErr
+	}
+
+	req := &cloudiot.SendCommandToDeviceRequest{}
+	if apiErr := decode(r.Body, req); apiErr != nil {
+		return nil, apiErr
+	}
+
+	data, err := base64.StdEncoding.DecodeString(req.BinaryData)
+	if err != nil {
+		return nil, badRequest("binaryData is not base64 %s", err)
+	}
+
+	if s.OnCommand != nil {
+		s.OnCommand(name, req.Subfolder, data)
+	}
+
+	return &cloudiot.SendCommandToDeviceResponse{}, nil
+}
+
+func (s *Server) listStates(r *http.Request, name string) (interface{}, *apiError) {
+	d, apiErr := s.device(name)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	n, apiErr := intParam(r, "numStates", len(d.states))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return &cloudiot.ListDeviceStatesResponse{DeviceStates: d.states[:minInt(n, len(d.states))]}, nil
+}
+
+func (s *Server) listConfigVersions(r *http.Request, name string) (interface{}, *apiError) {
+	d, apiErr := s.device(name)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	n, apiErr := intParam(r, "numVersions", len(d.configs))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return &cloudiot.ListDeviceConfigVersionsResponse{DeviceConfigs: d.configs[:minInt(n, len(d.configs))]}, nil
+}
+
+// device returns the device with the full name name, the caller holds the lock
+func (s *Server) device(name string) (*device, *apiError) {
+	reg, ok := s.registries[registryOf(name)]
+	if !ok {
+		return nil, notFound(registryOf(name))
+	}
+
+	d, ok := reg.devices[name[strings.LastIndex(name, "/")+1:]]
+	if !ok {
+		return nil, notFound(name)
+	}
+
+	return d, nil
+}
+
+func registryOf(deviceName string) string {
+	return deviceName[:strings.LastIndex(deviceName, "/devices/")]
+}
+
+func isGateway(device *cloudiot.Device) bool {
+	return device.GatewayConfig != nil && device.GatewayConfig.GatewayType == gatewayTypeGateway
+}
+
+// validateEventConfigs enforces the IoT Core rule that only the last config may match every subfolder
+func validateEventConfigs(configs []*cloudiot.EventNotificationConfig) *apiError {
+	for i, config := range configs {
+		if config.PubsubTopicName == "" {
+			return badRequest("event notification config %d has no topic", i)
+		}
+
+		if config.SubfolderMatches == "" && i != len(configs)-1 {
+			return badRequest("only the last event notification config may omit subfolderMatches")
+		}
+	}
+
+	return nil
+}
+
+// updateMask returns the fields of the updateMask parameter normalized so snake and camel case match
+func updateMask(r *http.Request) ([]string, *apiError) {
+	mask := r.URL.Query().Get("updateMask")
+	if mask == "" {
+		return nil, badRequest("updateMask is required")
+	}
+
+	var fields []string
+	for _, field := range strings.Split(mask, ",") {
+		fields = append(fields, strings.ToLower(strings.Replace(strings.TrimSpace(field), "_", "", -1)))
+	}
+
+	return fields, nil
+}
+
+// fieldMask returns the top level fields of the fieldMask parameter
+func fieldMask(r *http.Request) []string {
+	var fields []string
+	for _, field := range strings.Split(r.URL.Query().Get("fieldMask"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, strings.SplitN(field, ".", 2)[0])
+		}
+	}
+
+	return fields
+}
+
+// maskFields encodes v with only the json fields named in fields
+func maskFields(v interface{}, fields []string) (json.RawMessage, *apiError) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "INTERNAL", "%s", err)
+	}
+
+	all := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(b, &all); err != nil {
+		return nil, errorf(http.StatusInternalServerError, "INTERNAL", "%s", err)
+	}
+
+	masked := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			masked[field] = value
+		}
+	}
+
+	b, err = json.Marshal(masked)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "INTERNAL", "%s", err)
+	}
+
+	return b, nil
+}
+
+// paginate returns the indexes of the page of n items pageToken and pageSize select and the token of the next page
+func paginate(r *http.Request, n int) ([]int, string, *apiError) {
+	size, apiErr := intParam(r, "pageSize", defaultPageSize)
+	if apiErr != nil {
+		return nil, "", apiErr
+	}
+
+	start, apiErr := intParam(r, "pageToken", 0)
+	if apiErr != nil {
+		return nil, "", apiErr
+	}
+
+	end, next := minInt(start+size, n), ""
+	if end < n {
+		next = strconv.Itoa(end)
+	}
+
+	var page []int
+	for i := start; i < end; i++ {
+		page = append(page, i)
+	}
+
+	return page, next, nil
+}
+
+func intParam(r *http.Request, name string, fallback int) (int, *apiError) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, badRequest("invalid %s %s", name, value)
+	}
+
+	if n == 0 {
+		return fallback, nil
+	}
+
+	return n, nil
+}
+
+func decode(body io.Reader, v interface{}) *apiError {
+	if err := json.NewDecoder(body).Decode(v); err != nil && err != io.EOF {
+		return badRequest("invalid request body %s", err)
+	}
+
+	return nil
+}
+
+func writeError(w http.ResponseWriter, apiErr *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Code)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error *apiError `json:"error"`
+	}{apiErr})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// NewServer returns a server without registries that is not listening yet
+func NewServer() *Server {
+	return &Server{registries: make(map[string]*registry)}
+}
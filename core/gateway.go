@@ -0,0 +1,156 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/cloudiot/v1"
+)
+
+const (
+	attachTopicFMT = "/devices/%s/attach"
+	detachTopicFMT = "/devices/%s/detach"
+	errorsTopicFMT = "/devices/%s/errors"
+
+	gatewayTypeGateway    = "GATEWAY"
+	gatewayTypeNonGateway = "NON_GATEWAY"
+	gatewayAuthAssociated = "ASSOCIATION_ONLY"
+)
+
+// ChildTransport sends the messages of a child device over the connection of its gateway, connecting
+// attaches the child to the gateway and closing detaches it
+type ChildTransport struct {
+	gateway  *Device
+	deviceID string
+}
+
+// Connect attaches the child, the gateway must already be connected
+func (t *ChildTransport) Connect(ctx context.Context) error {
+	return t.gateway.attach(ctx, t.deviceID)
+}
+
+// Publish sends over the gateway connection on behalf of the child
+func (t *ChildTransport) Publish(ctx context.Context, topic string, payload []byte) error {
+	return t.gateway.Transport.Publish(ctx, topic, payload)
+}
+
+// Subscribe listens on the gateway connection, the broker only delivers topics of attached children
+func (t *ChildTransport) Subscribe(ctx context.Context, topic string, handler MessageHandler) error {
+	return t.gateway.Transport.Subscribe(ctx, topic, handler)
+}
+
+// Close detaches the child, the gateway connection stays open
+func (t *ChildTransport) Close() error {
+	return t.gateway.Transport.Publish(context.Background(), fmt.Sprintf(detachTopicFMT, t.deviceID), nil)
+}
+
+// AddChild makes child publish through the connection of gateway d, children are re-attached whenever
+// the gateway reconnects. The child must be bound with DeviceRegistry.BindDeviceToGateway before it connects
+func (d *Device) AddChild(child *Device) {
+	child.gatewayID = d.DeviceID
+	child.Transport = &ChildTransport{gateway: d, deviceID: child.DeviceID}
+
+	d.sessionLock.Lock()
+	d.children = append(d.children, child)
+	d.sessionLock.Unlock()
+}
+
+// Children returns the devices added to gateway d
+func (d *Device) Children() []*Device {
+	d.sessionLock.Lock()
+	defer d.sessionLock.Unlock()
+
+	return append([]*Device(nil), d.children...)
+}
+
+// GatewayID returns the id of the gateway the device publishes through, it is empty for devices with their own connection
+func (d *Device) GatewayID() string {
+	return d.gatewayID
+}
+
+func (d *Device) attach(ctx context.Context, childID string) error {
+	if d.Transport == nil {
+		return fmt.Errorf("gateway %s is not connected", d.DeviceID)
+	}
+
+	err := d.Transport.Publish(ctx, fmt.Sprintf(attachTopicFMT, childID), nil)
+	if err != nil {
+		return fmt.Errorf("error attaching %s to gateway %s: %s", childID, d.DeviceID, err)
+	}
+
+	logger.WithField("gateway-id", d.DeviceID).WithField("device-id", childID).Debugln("attached device")
+	return nil
+}
+
+// reattachChildren attaches every child again after the gateway connection was re-established
+func (d *Device) reattachChildren(ctx context.Context) {
+	for _, child := range d.Children() {
+		if err := d.attach(ctx, child.DeviceID); err != nil {
+			logger.WithError(err).WithField("gateway-id", d.DeviceID).Warnln("error re-attaching device")
+		}
+	}
+}
+
+// subscribeGatewayErrors logs the errors IoT Core reports for messages the gateway sent on behalf of its children
+func (d *Device) subscribeGatewayErrors(ctx context.Context) error {
+	return d.Transport.Subscribe(ctx, fmt.Sprintf(errorsTopicFMT, d.DeviceID), func(_ string, payload []byte) {
+		logger.WithField("gateway-id", d.DeviceID).WithField("error", string(payload)).Warnln("gateway error reported")
+	})
+}
+
+// createChild creates the device without credentials, children authenticate through their gateway
+func (d *Device) createChild(ctx context.Context) error {
+	if device := d.GetDevice(ctx); device != nil {
+		d.device = device
+		return d.updateMetadata(ctx)
+	}
+
+	device := cloudiot.Device{
+		Id:            d.DeviceID,
+		GatewayConfig: &cloudiot.GatewayConfig{GatewayType: gatewayTypeNonGateway},
+		Metadata:      d.Metadata.Map(),
+	}
+
+	var err error
+	d.device, err = d.client.Projects.Locations.Registries.Devices.Create(d.parent, &device).Context(ctx).Do()
+	return err
+}
+
+// BindDeviceToGateway allows gatewayID to attach deviceID
+func (d *DeviceRegistry) BindDeviceToGateway(ctx context.Context, gatewayID, deviceID string) error {
+	req := &cloudiot.BindDeviceToGatewayRequest{
+		GatewayId: gatewayID,
+		DeviceId:  deviceID,
+	}
+
+	_, err := d.Client.Projects.Locations.Registries.BindDeviceToGateway(d.RegistryName(), req).Context(ctx).Do()
+	return err
+}
+
+// UnbindDeviceFromGateway removes the binding between gatewayID and deviceID
+func (d *DeviceRegistry) UnbindDeviceFromGateway(ctx context.Context, gatewayID, deviceID string) error {
+	req := &cloudiot.UnbindDeviceFromGatewayRequest{
+		GatewayId: gatewayID,
+		DeviceId:  deviceID,
+	}
+
+	_, err := d.Client.Projects.Locations.Registries.UnbindDeviceFromGateway(d.RegistryName(), req).Context(ctx).Do()
+	return err
+}
+
+// NewChildDevice returns the uninitialized nth child of gateway, it publishes through the gateway connection
+func NewChildDevice(gateway *Device, n int) *Device {
+	child := NewDevice(gateway.clients, gateway.projectID, gateway.Region, gateway.RegistryID, gateway.parent)
+	child.SetID(ChildID(gateway.DeviceID, n))
+	gateway.AddChild(child)
+	return child
+}
+
+// IsGateway reports whether device was created as a gateway
+func IsGateway(device *cloudiot.Device) bool {
+	return device.GatewayConfig != nil && device.GatewayConfig.GatewayType == gatewayTypeGateway
+}
+
+// ChildID returns the id of the nth child of gatewayID, children of a gateway loaded from a keystore keep their ids across runs
+func ChildID(gatewayID string, n int) string {
+	return fmt.Sprintf("%s-child-%02d", gatewayID, n)
+}
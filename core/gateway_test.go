@@ -0,0 +1,255 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core/protos"
+	"google.golang.org/api/cloudiot/v1"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestGatewayChildren(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	gateway := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+	gateway.Gateway = true
+	gateway.Transport = NewMemoryTransport(broker)
+
+	var received []string
+	broker.Subscribe("#", func(topic string, _ []byte) {
+		received = append(received, topic)
+	})
+
+	first, second := NewChildDevice(gateway, 0), NewChildDevice(gateway, 1)
+	if err := first.Connect(ctx); err == nil {
+		t.Errorf("child Connect() before its gateway is connected succeeded, want error")
+	}
+
+	if err := gateway.Connect(ctx); err != nil {
+		t.Fatalf("gateway Connect() error %s", err)
+	}
+	defer gateway.Close()
+
+	for _, child := range []*Device{first, second} {
+		if child.GatewayID() != gateway.DeviceID {
+			t.Errorf("child GatewayID() = %s, want %s", child.GatewayID(), gateway.DeviceID)
+		}
+
+		if child.DevicePath != testRegistryPath+"/devices/"+child.DeviceID {
+			t.Errorf("child path %s is not in the gateway registry", child.DevicePath)
+		}
+
+		if err := child.Connect(ctx); err != nil {
+			t.Fatalf("child Connect() error %s", err)
+		}
+	}
+
+	if err := first.Publish(ctx, &protos.Event{}); err != nil {
+		t.Fatalf("child Publish() error %s", err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("child Close() error %s", err)
+	}
+
+	want := []string{
+		fmt.Sprintf(attachTopicFMT, first.DeviceID),
+		fmt.Sprintf(attachTopicFMT, second.DeviceID),
+		fmt.Sprintf(interactionsTopicFMT, first.DeviceID),
+		fmt.Sprintf(detachTopicFMT, first.DeviceID),
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("gateway published to %v, want %v", received, want)
+	}
+
+	received = nil
+	gateway.reattachChildren(ctx)
+	if want := want[:2]; !reflect.DeepEqual(received, want) {
+		t.Errorf("reattaching published to %v, want %v", received, want)
+	}
+
+	if got := len(gateway.Children()); got != 2 {
+		t.Errorf("gateway has %d children, want 2", got)
+	}
+}
+
+func TestChildID(t *testing.T) {
+	if got, want := ChildID("perchdevice-00AB00CD", 3), "perchdevice-00AB00CD-child-03"; got != want {
+		t.Errorf("ChildID() = %s, want %s", got, want)
+	}
+}
+
+func TestGatewayBinding(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name   string
+		method string
+		call   func(registry *DeviceRegistry) error
+	}{
+		{
+			name:   "bind",
+			method: "bindDeviceToGateway",
+			call: func(registry *DeviceRegistry) error {
+				return registry.BindDeviceToGateway(ctx, "gateway-1", "device-1")
+			},
+		},
+		{
+			name:   "unbind",
+			method: "unbindDeviceFromGateway",
+			call: func(registry *DeviceRegistry) error {
+				return registry.UnbindDeviceFromGateway(ctx, "gateway-1", "device-1")
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := NewDeviceRegistry(NewClients(), "perch-test", "us-central1", "perch-test", "perch-test")
+			var got map[string]string
+			registry.Client = newTestIoTService(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/v1/"+registry.RegistryName()+":"+tc.method {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				}
+
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("error decoding request %s", err)
+				}
+
+				_, _ = w.Write([]byte("{}"))
+			})
+
+			if err := tc.call(registry); err != nil {
+				t.Fatalf("%s error %s", tc.method, err)
+			}
+
+			if want := map[string]string{"gatewayId": "gateway-1", "deviceId": "device-1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s request %v, want %v", tc.method, got, want)
+			}
+		})
+	}
+}
+
+func TestCreateGatewayDevices(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name     string
+		child    bool
+		wantType string
+		wantAuth string
+		wantKey  bool
+	}{
+		{name: "gateway", wantType: gatewayTypeGateway, wantAuth: gatewayAuthAssociated, wantKey: true},
+		{name: "child", child: true, wantType: gatewayTypeNonGateway},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+			device.Gateway = true
+			if tc.child {
+				device = NewChildDevice(device, 0)
+			}
+
+			var created *cloudiot.Device
+			device.client = newTestIoTService(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case http.MethodGet:
+					w.WriteHeader(http.StatusNotFound)
+					return
+				case http.MethodPost:
+					created = &cloudiot.Device{}
+					if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+						t.Errorf("error decoding request %s", err)
+					}
+					_ = json.NewEncoder(w).Encode(created)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+
+			if err := device.CreateDevice(ctx); err != nil {
+				t.Fatalf("CreateDevice() error %s", err)
+			}
+
+			if created == nil || created.GatewayConfig == nil {
+				t.Fatalf("created %+v, want a gateway config", created)
+			}
+
+			if created.GatewayConfig.GatewayType != tc.wantType || created.GatewayConfig.GatewayAuthMethod != tc.wantAuth {
+				t.Errorf("gateway config %+v, want type %s and auth %q", created.GatewayConfig, tc.wantType, tc.wantAuth)
+			}
+
+			if (len(created.Credentials) > 0) != tc.wantKey {
+				t.Errorf("created with %d credentials, want credentials %t", len(created.Credentials), tc.wantKey)
+			}
+		})
+	}
+}
+
+func TestBindDeviceToGateway(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t)
+	gateway := newTestDevice(t, registry, "gateway-1", true)
+	child := NewChildDevice(gateway, 0)
+	if _, err := child.Init(ctx); err != nil {
+		t.Fatalf("error creating child %s", err)
+	}
+	newTestDevice(t, registry, "device-1", false)
+
+	boundTo := func(gatewayID string) []string {
+		t.Helper()
+
+		resp, err := registry.Client.Projects.Locations.Registries.Devices.
+			List(registry.RegistryName()).
+			GatewayListOptionsAssociationsGatewayId(gatewayID).
+			Do()
+		if err != nil {
+			t.Fatalf("error listing devices bound to %s: %s", gatewayID, err)
+		}
+
+		bound := make([]string, 0, len(resp.Devices))
+		for _, device := range resp.Devices {
+			bound = append(bound, device.Id)
+		}
+
+		return bound
+	}
+
+	for _, deviceID := range []string{child.DeviceID, "device-1", "device-1"} {
+		if err := registry.BindDeviceToGateway(ctx, "gateway-1", deviceID); err != nil {
+			t.Fatalf("BindDeviceToGateway(%s) error %s", deviceID, err)
+		}
+	}
+
+	// devices are listed in id order
+	if want := []string{"device-1", child.DeviceID}; !reflect.DeepEqual(boundTo("gateway-1"), want) {
+		t.Errorf("bound devices %v, want %v bound once each", boundTo("gateway-1"), want)
+	}
+
+	if err := registry.BindDeviceToGateway(ctx, "device-1", child.DeviceID); err == nil {
+		t.Errorf("binding to a device that is not a gateway succeeded, want error")
+	}
+
+	if err := registry.BindDeviceToGateway(ctx, "gateway-1", "gateway-1"); err == nil {
+		t.Errorf("binding a gateway to a gateway succeeded, want error")
+	}
+
+	if err := registry.BindDeviceToGateway(ctx, "gateway-1", "device-missing"); err == nil {
+		t.Errorf("binding a missing device succeeded, want error")
+	}
+
+	if err := registry.UnbindDeviceFromGateway(ctx, "gateway-1", "device-1"); err != nil {
+		t.Fatalf("UnbindDeviceFromGateway() error %s", err)
+	}
+
+	if want := []string{child.DeviceID}; !reflect.DeepEqual(boundTo("gateway-1"), want) {
+		t.Errorf("bound devices after unbinding %v, want %v", boundTo("gateway-1"), want)
+	}
+
+	if err := registry.UnbindDeviceFromGateway(ctx, "gateway-1", "device-1"); err == nil {
+		t.Errorf("unbinding a device that is not bound succeeded, want error")
+	}
+}
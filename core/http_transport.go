@@ -0,0 +1,252 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHTTPBridgeURL = "https://cloudiotdevice.googleapis.com/v1"
+	DefaultConfigPolling = time.Minute
+	httpAttempts         = 5
+)
+
+// HTTPTransport publishes through the IoT Core HTTP bridge, it is meant for networks that block the MQTT port.
+// The bridge has no push channel so config is polled and commands are not supported
+type HTTPTransport struct {
+	BaseURL       string
+	ConfigPolling time.Duration
+	device        *Device
+	client        *http.Client
+	cancel        context.CancelFunc
+	polling       context.Context
+	sync.Mutex
+}
+
+type publishEventRequest struct {
+	BinaryData string `json:"binary_data"`
+	SubFolder  string `json:"sub_folder,omitempty"`
+}
+
+type setStateRequest struct {
+	State struct {
+		BinaryData string `json:"binary_data"`
+	} `json:"state"`
+}
+
+type deviceConfigResponse struct {
+	Version    string `json:"version"`
+	BinaryData string `json:"binaryData"`
+}
+
+// Connect checks a JWT can be minted for the device, the bridge itself is connectionless
+func (t *HTTPTransport) Connect(_ context.Context) error {
+	if t.device.Token() == "" {
+		return fmt.Errorf("device %s has no jwt, create its key first", t.device.DeviceID)
+	}
+
+	t.Lock()
+	t.polling, t.cancel = context.WithCancel(context.Background())
+	t.Unlock()
+
+	return nil
+}
+
+// Publish maps the MQTT topic to the matching bridge call, the state topic is sent to setState
+// and event topics to publishEvent with everything after /events/ as the subfolder
+func (t *HTTPTransport) Publish(ctx context.Context, topic string, payload []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	if topic == fmt.Sprintf(stateTopicFMT, t.device.DeviceID) {
+		req := &setStateRequest{}
+		req.State.BinaryData = encoded
+		return t.post(ctx, "setState", req)
+	}
+
+	prefix := fmt.Sprintf("/devices/%s/%s", t.device.DeviceID, topicType)
+	if !strings.HasPrefix(topic, prefix) {
+		return fmt.Errorf("http bridge can not publish to %s", topic)
+	}
+
+	return t.post(ctx, "publishEvent", &publishEventRequest{
+		BinaryData: encoded,
+		SubFolder:  strings.TrimPrefix(strings.TrimPrefix(topic, prefix), "/"),
+	})
+}
+
+// Subscribe polls the config of the device every ConfigPolling until the transport is closed, other topics
+// are not supported by the bridge and return ErrTopicNotSupported
+func (t *HTTPTransport) Subscribe(_ context.Context, topic string, handler MessageHandler) error {
+	if topic != fmt.Sprintf(configTopicFMT, t.device.DeviceID) {
+		return ErrTopicNotSupported
+	}
+
+	t.Lock()
+	polling := t.polling
+	t.Unlock()
+	if polling == nil {
+		return fmt.Errorf("http transport is not connected")
+	}
+
+	go t.pollConfig(polling, topic, handler)
+	return nil
+}
+
+// Close stops config polling
+func (t *HTTPTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+		t.polling = nil
+	}
+
+	return nil
+}
+
+func (t *HTTPTransport) pollConfig(ctx context.Context, topic string, handler MessageHandler) {
+	interval := t.ConfigPolling
+	if interval <= 0 {
+		interval = DefaultConfigPolling
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	version := "0"
+	for {
+		config, err := t.getConfig(ctx, version)
+		if err != nil {
+			logger.WithError(err).WithField("device-id", t.device.DeviceID).Warnln("error polling device config")
+		} else if config.Version != version {
+			version = config.Version
+			payload, err := base64.StdEncoding.DecodeString(config.BinaryData)
+			if err != nil {
+				logger.WithError(err).WithField("device-id", t.device.DeviceID).Warnln("error decoding device config")
+			} else {
+				handler(topic, payload)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *HTTPTransport) getConfig(ctx context.Context, localVersion string) (*deviceConfigResponse, error) {
+	url := fmt.Sprintf("%s/%s/config?local_version=%s", t.BaseURL, t.device.DevicePath, localVersion)
+	body, err := t.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &deviceConfigResponse{}
+	return config, json.Unmarshal(body, config)
+}
+
+func (t *HTTPTransport) post(ctx context.Context, method string, req interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/%s:%s", t.BaseURL, t.device.DevicePath, method)
+	_, err = t.do(ctx, http.MethodPost, url, b)
+	if err != nil {
+		atomic.AddInt64(&connectionMetrics.PublishErrors, 1)
+	}
+
+	return err
+}
+
+// do sends the request with the device JWT, 429 and 5xx responses are retried with exponential backoff
+// honoring Retry-After when the bridge sends one, retries stop once ctx is done
+func (t *HTTPTransport) do(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	backoff := initialBackoff
+	var err error
+	for attempt := 1; attempt <= httpAttempts; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+t.device.Token())
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Cache-Control", "no-cache")
+
+		var resp *http.Response
+		resp, err = t.client.Do(req)
+		if err == nil {
+			b, readErr := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return b, readErr
+			}
+
+			err = fmt.Errorf("http bridge returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return nil, err
+			}
+
+			if wait := retryAfter(resp); wait > 0 {
+				backoff = wait
+			}
+		}
+
+		if attempt == httpAttempts {
+			break
+		}
+
+		logger.WithError(err).
+			WithField("device-id", t.device.DeviceID).
+			WithField("attempt", attempt).
+			Warnf("http bridge request failed, retrying in %s", backoff)
+
+		if ctxErr := sleep(ctx, backoff); ctxErr != nil {
+			return nil, err
+		}
+
+		backoff = nextBackoff(backoff, defaultMaxReconnectInterval)
+	}
+
+	return nil, err
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// NewHTTPTransport returns a Transport that authenticates as device against the IoT Core HTTP bridge,
+// a nil config uses the system roots
+func NewHTTPTransport(device *Device, config *tls.Config) *HTTPTransport {
+	return &HTTPTransport{
+		BaseURL: DefaultHTTPBridgeURL,
+		device:  device,
+		client: &http.Client{
+			Timeout:   publishTimeout,
+			Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+		},
+	}
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestHTTPTransport returns a connected http transport of a new device, every bridge request goes to handler
+func newTestHTTPTransport(t *testing.T, handler http.HandlerFunc) (*HTTPTransport, *Device) {
+	ctx := context.Background()
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+	if err := device.NewKey(); err != nil {
+		t.Fatalf("NewKey() error %s", err)
+	}
+
+	if err := device.JWT(); err != nil {
+		t.Fatalf("JWT() error %s", err)
+	}
+
+	transport := NewHTTPTransport(device, nil)
+	transport.BaseURL = server.URL + "/v1"
+	transport.ConfigPolling = 10 * time.Millisecond
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error %s", err)
+	}
+	t.Cleanup(func() { _ = transport.Close() })
+
+	return transport, device
+}
+
+func TestHTTPTransportPublish(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name          string
+		topic         string
+		wantPath      string
+		wantSubFolder string
+		wantErr       bool
+	}{
+		{name: "event", topic: "/devices/%s/events", wantPath: ":publishEvent"},
+		{name: "event subfolder", topic: "/devices/%s/events/interactions", wantPath: ":publishEvent", wantSubFolder: "interactions"},
+		{name: "state", topic: "/devices/%s/state", wantPath: ":setState"},
+		{name: "other topic", topic: "/devices/%s/commands", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var device *Device
+			var body map[string]json.RawMessage
+			var transport *HTTPTransport
+			transport, device = newTestHTTPTransport(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/v1/"+device.DevicePath+tc.wantPath {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				}
+
+				if auth := r.Header.Get("Authorization"); auth != "Bearer "+device.Token() {
+					t.Errorf("request authorization %s, want the device jwt", auth)
+				}
+
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("error decoding request %s", err)
+				}
+			})
+
+			err := transport.Publish(ctx, fmt.Sprintf(tc.topic, device.DeviceID), []byte("payload"))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Publish() succeeded, want error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Publish() error %s", err)
+			}
+
+			var binaryData, subFolder string
+			if tc.wantPath == ":setState" {
+				state := &struct {
+					BinaryData string `json:"binary_data"`
+				}{}
+				_ = json.Unmarshal(body["state"], state)
+				binaryData = state.BinaryData
+			} else {
+				_ = json.Unmarshal(body["binary_data"], &binaryData)
+				_ = json.Unmarshal(body["sub_folder"], &subFolder)
+			}
+
+			if binaryData != base64.StdEncoding.EncodeToString([]byte("payload")) {
+				t.Errorf("binary data %s, want the base64 payload", binaryData)
+			}
+
+			if subFolder != tc.wantSubFolder {
+				t.Errorf("sub folder %q, want %q", subFolder, tc.wantSubFolder)
+			}
+		})
+	}
+}
+
+func TestHTTPTransportRetry(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name         string
+		statuses     []int
+		retryAfter   string
+		wantAttempts int
+		wantErr      bool
+		minWait      time.Duration
+	}{
+		{name: "too many requests honors retry after", statuses: []int{http.StatusTooManyRequests}, retryAfter: "2", wantAttempts: 2, minWait: 2 * time.Second},
+		{name: "server error is retried", statuses: []int{http.StatusServiceUnavailable}, wantAttempts: 2, minWait: initialBackoff},
+		{name: "client error is not retried", statuses: []int{http.StatusBadRequest}, wantAttempts: 1, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			transport, device := newTestHTTPTransport(t, func(w http.ResponseWriter, r *http.Request) {
+				_, _ = ioutil.ReadAll(r.Body)
+				attempts++
+				if attempts <= len(tc.statuses) {
+					if tc.retryAfter != "" {
+						w.Header().Set("Retry-After", tc.retryAfter)
+					}
+					w.WriteHeader(tc.statuses[attempts-1])
+				}
+			})
+
+			start := time.Now()
+			err := transport.Publish(ctx, fmt.Sprintf("/devices/%s/events", device.DeviceID), []byte("payload"))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("Publish() error %v, want error %t", err, tc.wantErr)
+			}
+
+			if attempts != tc.wantAttempts {
+				t.Errorf("bridge received %d attempts, want %d", attempts, tc.wantAttempts)
+			}
+
+			if waited := time.Since(start); waited < tc.minWait {
+				t.Errorf("retried after %s, want at least %s", waited, tc.minWait)
+			}
+		})
+	}
+}
+
+func TestHTTPTransportSubscribe(t *testing.T) {
+	ctx := context.Background()
+	var lock sync.Mutex
+	polls := 0
+	var device *Device
+	transport, device := newTestHTTPTransport(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/"+device.DevicePath+"/config" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+
+		lock.Lock()
+		polls++
+		lock.Unlock()
+
+		_ = json.NewEncoder(w).Encode(&deviceConfigResponse{
+			Version:    "1",
+			BinaryData: base64.StdEncoding.EncodeToString([]byte(`{"tickInterval": "1s"}`)),
+		})
+	})
+
+	if err := transport.Subscribe(ctx, fmt.Sprintf(commandsTopicFMT, device.DeviceID)+"/#", nil); err != ErrTopicNotSupported {
+		t.Errorf("Subscribe() to commands error %v, want %s", err, ErrTopicNotSupported)
+	}
+
+	configs := make(chan string, 10)
+	err := transport.Subscribe(ctx, fmt.Sprintf(configTopicFMT, device.DeviceID), func(topic string, payload []byte) {
+		configs <- string(payload)
+	})
+	if err != nil {
+		t.Fatalf("Subscribe() to config error %s", err)
+	}
+
+	select {
+	case config := <-configs:
+		if !strings.Contains(config, "tickInterval") {
+			t.Errorf("received config %s, want the polled document", config)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no config received")
+	}
+
+	// the same version is polled again but not delivered again
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	if polls < 2 {
+		t.Errorf("config polled %d times, want it polled every 10ms", polls)
+	}
+	lock.Unlock()
+
+	if len(configs) != 0 {
+		t.Errorf("config version 1 delivered %d more times, want once", len(configs))
+	}
+
+	// devices on the bridge subscribe to what it supports without error
+	device.Transport = transport
+	if err := device.SubscribeControl(ctx); err != nil {
+		t.Errorf("SubscribeControl() error %s, want commands skipped", err)
+	}
+}
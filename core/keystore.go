@@ -0,0 +1,382 @@
+package core
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrIdentityNotFound = errors.New("identity not found")
+
+// Identity is everything a device needs to reconnect as the same device across runs
+type Identity struct {
+	DeviceID     string `json:"deviceId"`
+	KeyAlgorithm string `json:"keyAlgorithm"`
+	PrivateKey   string `json:"privateKey"`
+	Certificate  string `json:"certificate"`
+}
+
+// KeyStore persists device identities
+type KeyStore interface {
+	List() ([]*Identity, error)
+	Get(deviceID string) (*Identity, error)
+	Put(identity *Identity) error
+	Delete(deviceID string) error
+}
+
+// OpenKeyStore returns an encrypted single file store at path when a passphrase is given,
+// otherwise a directory store holding one json file per identity
+func OpenKeyStore(path, passphrase string) (KeyStore, error) {
+	if passphrase != "" {
+		return &FileKeyStore{Path: path, passphrase: passphrase}, nil
+	}
+
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating keystore directory %s: %s", path, err)
+	}
+
+	return &DirKeyStore{Dir: path}, nil
+}
+
+// DirKeyStore keeps each identity in <Dir>/<device id>.json
+type DirKeyStore struct {
+	Dir string
+}
+
+// List reads every identity file of the directory, sorted by device ID
+func (s *DirKeyStore) List() ([]*Identity, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	identities := make([]*Identity, 0, len(files))
+	for _, file := range files {
+		identity, err := readIdentity(file)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// Get reads the identity of deviceID, ErrIdentityNotFound when it has no file
+func (s *DirKeyStore) Get(deviceID string) (*Identity, error) {
+	identity, err := readIdentity(s.path(deviceID))
+	if os.IsNotExist(err) {
+		return nil, ErrIdentityNotFound
+	}
+
+	return identity, err
+}
+
+// Put writes the identity to its own file, replacing the file atomically
+func (s *DirKeyStore) Put(identity *Identity) error {
+	b, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path(identity.DeviceID), b)
+}
+
+// Delete removes the identity file of deviceID
+func (s *DirKeyStore) Delete(deviceID string) error {
+	err := os.Remove(s.path(deviceID))
+	if os.IsNotExist(err) {
+		return ErrIdentityNotFound
+	}
+
+	return err
+}
+
+func (s *DirKeyStore) path(deviceID string) string {
+	return filepath.Join(s.Dir, deviceID+".json")
+}
+
+// FileKeyStore keeps every identity in a single file encrypted with AES-GCM,
+// the key is derived from a passphrase with scrypt
+type FileKeyStore struct {
+	Path       string
+	passphrase string
+	sync.Mutex
+}
+
+type encryptedKeyStore struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// List decrypts the store and returns its identities sorted by device ID
+func (s *FileKeyStore) List() ([]*Identity, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	identities, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Identity, 0, len(identities))
+	for _, identity := range identities {
+		list = append(list, identity)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeviceID < list[j].DeviceID
+	})
+
+	return list, nil
+}
+
+// Get decrypts the store and returns the identity of deviceID
+func (s *FileKeyStore) Get(deviceID string) (*Identity, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	identities, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	identity, ok := identities[deviceID]
+	if !ok {
+		return nil, ErrIdentityNotFound
+	}
+
+	return identity, nil
+}
+
+// Put adds or replaces the identity and encrypts the store again
+func (s *FileKeyStore) Put(identity *Identity) error {
+	s.Lock()
+	defer s.Unlock()
+
+	identities, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	identities[identity.DeviceID] = identity
+	return s.save(identities)
+}
+
+// Delete removes the identity of deviceID and encrypts the store again
+func (s *FileKeyStore) Delete(deviceID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	identities, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := identities[deviceID]; !ok {
+		return ErrIdentityNotFound
+	}
+
+	delete(identities, deviceID)
+	return s.save(identities)
+}
+
+func (s *FileKeyStore) load() (map[string]*Identity, error) {
+	identities := make(map[string]*Identity)
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return identities, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	envelope := &encryptedKeyStore{}
+	err = json.Unmarshal(b, envelope)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keystore %s: %s", s.Path, err)
+	}
+
+	aead, err := s.cipher(envelope.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(nil, envelope.Nonce, envelope.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting keystore %s, wrong passphrase?", s.Path)
+	}
+
+	err = json.Unmarshal(plain, &identities)
+	return identities, err
+}
+
+func (s *FileKeyStore) save(identities map[string]*Identity) error {
+	plain, err := json.Marshal(identities)
+	if err != nil {
+		return err
+	}
+
+	envelope := &encryptedKeyStore{Salt: make([]byte, 16)}
+	if _, err = rand.Read(envelope.Salt); err != nil {
+		return err
+	}
+
+	aead, err := s.cipher(envelope.Salt)
+	if err != nil {
+		return err
+	}
+
+	envelope.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(envelope.Nonce); err != nil {
+		return err
+	}
+
+	envelope.Data = aead.Seal(nil, envelope.Nonce, plain, nil)
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.Path, b)
+}
+
+func (s *FileKeyStore) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(s.passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// NewIdentity returns the identity for a device id, private key and PEM encoded cert
+func NewIdentity(deviceID string, key crypto.Signer, certPEM string) (*Identity, error) {
+	algorithm, err := KeyAlgorithmOf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private key: %s", err)
+	}
+
+	return &Identity{
+		DeviceID:     deviceID,
+		KeyAlgorithm: algorithm,
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		Certificate:  certPEM,
+	}, nil
+}
+
+// Key parses the identity private key
+func (i *Identity) Key() (crypto.Signer, error) {
+	return ParsePrivateKey([]byte(i.PrivateKey))
+}
+
+// Cert parses the identity certificate
+func (i *Identity) Cert() (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(i.Certificate))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate found for %s", i.DeviceID)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS1, PKCS8 or SEC1 private key
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %s", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
+
+// KeyAlgorithmOf returns RS256 or ES256 depending on the type of key
+func KeyAlgorithmOf(key crypto.Signer) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return KeyAlgorithmRS256, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().Name != "P-256" {
+			return "", fmt.Errorf("unsupported ecdsa curve %s, only P-256 is supported", k.Curve.Params().Name)
+		}
+
+		return KeyAlgorithmES256, nil
+	}
+
+	return "", fmt.Errorf("unsupported private key type %T", key)
+}
+
+func readIdentity(path string) (*Identity, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{}
+	err = json.Unmarshal(b, identity)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity %s: %s", path, err)
+	}
+
+	if identity.DeviceID == "" {
+		identity.DeviceID = strings.TrimSuffix(filepath.Base(path), ".json")
+	}
+
+	return identity, nil
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
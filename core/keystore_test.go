@@ -0,0 +1,116 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyStore(t *testing.T) {
+	cases := []struct {
+		name       string
+		passphrase string
+	}{
+		{name: "directory"},
+		{name: "encrypted file", passphrase: "secret"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "perch-keystore")
+			if err != nil {
+				t.Fatalf("error creating temp dir %s", err)
+			}
+			t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+			path := filepath.Join(dir, "identities")
+			store, err := OpenKeyStore(path, tc.passphrase)
+			if err != nil {
+				t.Fatalf("OpenKeyStore() error %s", err)
+			}
+
+			now := time.Now()
+			identities := []*Identity{
+				newTestIdentity(t, "device-b", now, now.Add(time.Hour)),
+				newTestIdentity(t, "device-a", now, now.Add(time.Hour)),
+			}
+			for _, identity := range identities {
+				if err := store.Put(identity); err != nil {
+					t.Fatalf("Put(%s) error %s", identity.DeviceID, err)
+				}
+			}
+
+			list, err := store.List()
+			if err != nil {
+				t.Fatalf("List() error %s", err)
+			}
+
+			if want := []*Identity{identities[1], identities[0]}; !reflect.DeepEqual(list, want) {
+				t.Errorf("List() = %v, want identities sorted by device ID", list)
+			}
+
+			if err := store.Delete("device-a"); err != nil {
+				t.Fatalf("Delete() error %s", err)
+			}
+
+			if _, err := store.Get("device-a"); err != ErrIdentityNotFound {
+				t.Errorf("Get() of a deleted identity error %v, want %s", err, ErrIdentityNotFound)
+			}
+
+			if err := store.Delete("device-a"); err != ErrIdentityNotFound {
+				t.Errorf("Delete() of a deleted identity error %v, want %s", err, ErrIdentityNotFound)
+			}
+
+			reopened, err := OpenKeyStore(path, tc.passphrase)
+			if err != nil {
+				t.Fatalf("OpenKeyStore() error %s", err)
+			}
+
+			got, err := reopened.Get("device-b")
+			if err != nil || !reflect.DeepEqual(got, identities[0]) {
+				t.Errorf("Get() after reopening = %v %v, want the saved identity", got, err)
+			}
+
+			if tc.passphrase == "" {
+				return
+			}
+
+			if _, err := (&FileKeyStore{Path: path, passphrase: "wrong"}).List(); err == nil {
+				t.Errorf("List() with a wrong passphrase succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestIdentityKeyRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{KeyAlgorithmRS256, KeyAlgorithmES256} {
+		t.Run(algorithm, func(t *testing.T) {
+			device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+			device.KeyAlgorithm = algorithm
+			if err := device.NewKey(); err != nil {
+				t.Fatalf("NewKey() error %s", err)
+			}
+
+			identity, err := device.Identity()
+			if err != nil {
+				t.Fatalf("Identity() error %s", err)
+			}
+
+			if identity.KeyAlgorithm != algorithm {
+				t.Errorf("identity algorithm %s, want %s", identity.KeyAlgorithm, algorithm)
+			}
+
+			key, err := identity.Key()
+			if err != nil {
+				t.Fatalf("Key() error %s", err)
+			}
+
+			if !reflect.DeepEqual(key.Public(), device.Certs.Key.Public()) {
+				t.Errorf("saved key differs from the device key")
+			}
+		})
+	}
+}
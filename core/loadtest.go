@@ -0,0 +1,312 @@
+package core
+
+import (
+	"context"
+	"github.com/kc1116/perch-interactive-challenge/core/protos"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// loadTickInterval is how often a load test hands out publishes
+	loadTickInterval = 10 * time.Millisecond
+	// loadRampInterval is how often devices waiting to be ramped up check whether they are needed
+	loadRampInterval = 100 * time.Millisecond
+)
+
+// LoadStage ramps the target rate of events per second and the number of publishing devices linearly from
+// the end of the previous stage, or 0, to Rate and Devices over Duration
+type LoadStage struct {
+	Name     string
+	Duration time.Duration
+	Rate     float64
+	Devices  int
+}
+
+// LoadTest publishes events from connected devices at the target rate of its stages
+type LoadTest struct {
+	Devices []*Device
+	Stages  []LoadStage
+}
+
+// LoadReport holds the results of every stage of a load test and of the whole run
+type LoadReport struct {
+	Stages []*LoadStageReport `json:"stages"`
+	Total  *LoadStageReport   `json:"total"`
+}
+
+// LoadStageReport sums up the publishes of a stage. Dropped counts the events the target rate asked for
+// that no active device was free to publish within the tick they were due in, latencies are in milliseconds
+type LoadStageReport struct {
+	Name       string         `json:"name"`
+	Seconds    float64        `json:"seconds"`
+	TargetRate float64        `json:"targetRate"`
+	Throughput float64        `json:"throughput"`
+	Published  int            `json:"published"`
+	Errors     int            `json:"errors"`
+	Dropped    int64          `json:"dropped"`
+	P50        float64        `json:"p50Ms"`
+	P90        float64        `json:"p90Ms"`
+	P95        float64        `json:"p95Ms"`
+	P99        float64        `json:"p99Ms"`
+	Max        float64        `json:"maxMs"`
+	ErrorTypes map[string]int `json:"errorTypes,omitempty"`
+}
+
+// loadStats are the publishes of one device during one stage, only the goroutine of the device writes them
+type loadStats struct {
+	latencies []time.Duration
+	errors    map[string]int
+}
+
+func (s *loadStats) add(latency time.Duration, err error, deviceID string) {
+	s.latencies = append(s.latencies, latency)
+	if err == nil {
+		return
+	}
+
+	if s.errors == nil {
+		s.errors = make(map[string]int)
+	}
+
+	// errors mention the device, group them by what went wrong
+	s.errors[strings.Replace(err.Error(), deviceID, "{device-id}", -1)]++
+}
+
+// NewLoadTest returns a load test running stages on devices, the devices must be connected
+func NewLoadTest(devices []*Device, stages []LoadStage) *LoadTest {
+	return &LoadTest{Devices: devices, Stages: stages}
+}
+
+// Duration returns how long the stages run
+func (l *LoadTest) Duration() time.Duration {
+	var d time.Duration
+	for _, stage := range l.Stages {
+		d += stage.Duration
+	}
+
+	return d
+}
+
+// target returns the stage running elapsed into the test with the rate and number of active devices at that
+// time, the stage is len(l.Stages) once every stage ran
+func (l *LoadTest) target(elapsed time.Duration) (int, float64, int) {
+	rate, devices := 0.0, 0
+	for i, stage := range l.Stages {
+		if elapsed < stage.Duration {
+			progress := float64(elapsed) / float64(stage.Duration)
+			return i, rate + (stage.Rate-rate)*progress, devices + int(math.Round(float64(stage.Devices-devices)*progress))
+		}
+
+		elapsed -= stage.Duration
+		rate, devices = stage.Rate, stage.Devices
+	}
+
+	return len(l.Stages), rate, devices
+}
+
+// Run publishes events until every stage ran or ctx is done and reports the publishes of each stage. Once
+// every stage ran the publishes in flight are waited for, once ctx is done they are cancelled
+func (l *LoadTest) Run(ctx context.Context) *LoadReport {
+	// slots are unbuffered, a slot is only handed out to a device ready to publish it
+	slots := make(chan int)
+	done := make(chan struct{})
+	dropped := make([]int64, len(l.Stages))
+	var active int64
+
+	start := time.Now()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(loadTickInterval)
+		defer ticker.Stop()
+
+		due := 0.0
+		last := start
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				stage, rate, devices := l.target(now.Sub(start))
+				if stage == len(l.Stages) {
+					return
+				}
+
+				atomic.StoreInt64(&active, int64(devices))
+				due += rate * now.Sub(last).Seconds()
+				last = now
+				n := int(due)
+				due -= float64(n)
+
+				// slots no device takes before the next tick are dropped, busy devices do not pile up a backlog
+				expired := time.NewTimer(loadTickInterval)
+			handout:
+				for i := 0; i < n; i++ {
+					select {
+					case <-ctx.Done():
+						expired.Stop()
+						return
+					case slots <- stage:
+					case <-expired.C:
+						dropped[stage] += int64(n - i)
+						break handout
+					}
+				}
+				expired.Stop()
+			}
+		}
+	}()
+
+	stats := make([][]*loadStats, len(l.Devices))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(l.Devices))
+	for i, device := range l.Devices {
+		stats[i] = make([]*loadStats, len(l.Stages))
+		for j := range stats[i] {
+			stats[i][j] = &loadStats{}
+		}
+
+		go func(i int, device *Device) {
+			defer wg.Done()
+			wait := time.NewTicker(loadRampInterval)
+			defer wait.Stop()
+
+			for {
+				// devices past the number the stage asks for wait to be ramped up
+				if int64(i) >= atomic.LoadInt64(&active) {
+					select {
+					case <-done:
+						return
+					case <-wait.C:
+						continue
+					}
+				}
+
+				select {
+				case <-done:
+					return
+				case stage := <-slots:
+					evt := loadEvent(device)
+					sent := time.Now()
+					err := device.Publish(ctx, evt)
+					if ctx.Err() != nil {
+						// publishes cut short by an interrupted test are left out of the report
+						return
+					}
+
+					stats[i][stage].add(time.Since(sent), err, device.DeviceID)
+				}
+			}
+		}(i, device)
+	}
+
+	<-done
+	elapsed := time.Since(start)
+	wg.Wait()
+
+	return l.report(stats, dropped, elapsed)
+}
+
+// loadEvent creates an event from the products of the session config of device
+func loadEvent(device *Device) *protos.Event {
+	config := device.SessionConfig()
+	if config.Catalog != nil {
+		return CatalogEvent(device.rng, config.Catalog, config.Interactions)
+	}
+
+	return RandomEvent(device.rng, config.Products, config.Interactions)
+}
+
+func (l *LoadTest) report(stats [][]*loadStats, dropped []int64, elapsed time.Duration) *LoadReport {
+	report := &LoadReport{}
+	var all []*loadStats
+	var targetEvents float64
+	var total time.Duration
+	var totalDropped int64
+	for j, stage := range l.Stages {
+		ran := stage.Duration
+		if elapsed < ran {
+			ran = elapsed
+		}
+		elapsed -= ran
+		total += ran
+		totalDropped += dropped[j]
+
+		var stageStats []*loadStats
+		for i := range stats {
+			stageStats = append(stageStats, stats[i][j])
+		}
+		all = append(all, stageStats...)
+
+		stageReport := newLoadStageReport(stage.Name, ran, stageStats, dropped[j])
+		// the rate ramps linearly, its average is halfway between where the stage starts and ends
+		from := 0.0
+		if j > 0 {
+			from = l.Stages[j-1].Rate
+		}
+		if ran > 0 {
+			progress := float64(ran) / float64(stage.Duration)
+			stageReport.TargetRate = from + (stage.Rate-from)*progress/2
+		}
+		targetEvents += stageReport.TargetRate * ran.Seconds()
+		report.Stages = append(report.Stages, stageReport)
+	}
+
+	report.Total = newLoadStageReport("total", total, all, totalDropped)
+	if total > 0 {
+		report.Total.TargetRate = targetEvents / total.Seconds()
+	}
+
+	return report
+}
+
+func newLoadStageReport(name string, ran time.Duration, stats []*loadStats, dropped int64) *LoadStageReport {
+	report := &LoadStageReport{Name: name, Seconds: ran.Seconds(), Dropped: dropped}
+	var latencies []time.Duration
+	for _, s := range stats {
+		latencies = append(latencies, s.latencies...)
+		for err, n := range s.errors {
+			if report.ErrorTypes == nil {
+				report.ErrorTypes = make(map[string]int)
+			}
+
+			report.ErrorTypes[err] += n
+			report.Errors += n
+		}
+	}
+
+	report.Published = len(latencies) - report.Errors
+	if ran > 0 {
+		report.Throughput = float64(report.Published) / ran.Seconds()
+	}
+
+	if len(latencies) == 0 {
+		return report
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50 = percentile(latencies, 50)
+	report.P90 = percentile(latencies, 90)
+	report.P95 = percentile(latencies, 95)
+	report.P99 = percentile(latencies, 99)
+	report.Max = milliseconds(latencies[len(latencies)-1])
+	return report
+}
+
+// percentile returns the nearest rank percentile p of sorted latencies in milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return milliseconds(sorted[rank-1])
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLoadTestTarget(t *testing.T) {
+	load := NewLoadTest(nil, []LoadStage{
+		{Name: "ramp-up", Duration: 10 * time.Second, Rate: 100, Devices: 10},
+		{Name: "steady", Duration: 10 * time.Second, Rate: 100, Devices: 10},
+		{Name: "ramp-down", Duration: 10 * time.Second},
+	})
+
+	if d := load.Duration(); d != 30*time.Second {
+		t.Fatalf("Duration() = %s, want 30s", d)
+	}
+
+	cases := []struct {
+		elapsed     time.Duration
+		wantStage   int
+		wantRate    float64
+		wantDevices int
+	}{
+		{elapsed: 0, wantStage: 0},
+		{elapsed: 5 * time.Second, wantStage: 0, wantRate: 50, wantDevices: 5},
+		{elapsed: 15 * time.Second, wantStage: 1, wantRate: 100, wantDevices: 10},
+		{elapsed: 24 * time.Second, wantStage: 2, wantRate: 60, wantDevices: 6},
+		{elapsed: 30 * time.Second, wantStage: 3},
+	}
+
+	for _, tc := range cases {
+		stage, rate, devices := load.target(tc.elapsed)
+		if stage != tc.wantStage || math.Abs(rate-tc.wantRate) > 1e-9 || devices != tc.wantDevices {
+			t.Errorf("target(%s) = stage %d rate %v devices %d, want stage %d rate %v devices %d",
+				tc.elapsed, stage, rate, devices, tc.wantStage, tc.wantRate, tc.wantDevices)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	for p, want := range map[float64]float64{0: 1, 50: 50, 90: 90, 99: 99, 100: 100} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile(%v) = %v, want %v", p, got, want)
+		}
+	}
+
+	if got := percentile([]time.Duration{1500 * time.Microsecond}, 99); got != 1.5 {
+		t.Errorf("percentile() of a single latency = %v, want 1.5", got)
+	}
+}
+
+func TestLoadTestReport(t *testing.T) {
+	load := NewLoadTest(nil, []LoadStage{
+		{Name: "ramp-up", Duration: 10 * time.Second, Rate: 100, Devices: 2},
+		{Name: "steady", Duration: 10 * time.Second, Rate: 100, Devices: 2},
+	})
+
+	stats := [][]*loadStats{{{}, {}}, {{}, {}}}
+	for i := 1; i <= 4; i++ {
+		stats[0][0].add(time.Duration(i)*time.Millisecond, nil, "device-0")
+	}
+	stats[1][0].add(10*time.Millisecond, fmt.Errorf("error publishing from device-1: timeout"), "device-1")
+	stats[0][1].add(20*time.Millisecond, fmt.Errorf("error publishing from device-0: timeout"), "device-0")
+	stats[1][1].add(5*time.Millisecond, nil, "device-1")
+
+	// the run was interrupted halfway through the steady stage
+	report := load.report(stats, []int64{3, 1}, 15*time.Second)
+
+	rampUp, steady := report.Stages[0], report.Stages[1]
+	if rampUp.Published != 4 || rampUp.Errors != 1 || rampUp.Dropped != 3 || rampUp.Seconds != 10 {
+		t.Errorf("ramp-up report %+v, want 4 published, 1 error and 3 dropped in 10s", rampUp)
+	}
+
+	if rampUp.TargetRate != 50 || rampUp.Throughput != 0.4 || rampUp.P50 != 3 || rampUp.Max != 10 {
+		t.Errorf("ramp-up report %+v, want a target of 50/s, 0.4/s achieved, p50 3ms and max 10ms", rampUp)
+	}
+
+	if steady.Seconds != 5 || steady.TargetRate != 100 || steady.Published != 1 || steady.Dropped != 1 {
+		t.Errorf("steady report %+v, want 5s at 100/s with 1 published and 1 dropped", steady)
+	}
+
+	total := report.Total
+	if total.Seconds != 15 || total.Published != 5 || total.Errors != 2 || total.Dropped != 4 {
+		t.Errorf("total report %+v, want 15s with 5 published, 2 errors and 4 dropped", total)
+	}
+
+	// (50/s for 10s + 100/s for 5s) / 15s
+	if math.Abs(total.TargetRate-1000.0/15) > 1e-9 {
+		t.Errorf("total target rate %v, want %v", total.TargetRate, 1000.0/15)
+	}
+
+	if n := total.ErrorTypes["error publishing from {device-id}: timeout"]; n != 2 || len(total.ErrorTypes) != 1 {
+		t.Errorf("error types %v, want the timeouts of both devices grouped", total.ErrorTypes)
+	}
+}
+
+// slowTransport takes delay for every publish
+type slowTransport struct {
+	*MemoryTransport
+	delay time.Duration
+}
+
+func (t *slowTransport) Publish(ctx context.Context, topic string, payload []byte) error {
+	time.Sleep(t.delay)
+	return t.MemoryTransport.Publish(ctx, topic, payload)
+}
+
+func TestLoadTestRunDropsBusySlots(t *testing.T) {
+	ctx := context.Background()
+	device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+	device.Transport = &slowTransport{MemoryTransport: NewMemoryTransport(NewMemoryBroker()), delay: 100 * time.Millisecond}
+	if err := device.Transport.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error %s", err)
+	}
+
+	// a single device publishing every 100ms can not keep up with 200 events per second, the slots it
+	// is too busy to take are dropped instead of queueing up
+	report := NewLoadTest([]*Device{device}, []LoadStage{
+		{Name: "ramp-up", Duration: time.Millisecond, Rate: 200, Devices: 1},
+		{Name: "steady", Duration: 500 * time.Millisecond, Rate: 200, Devices: 1},
+	}).Run(ctx)
+
+	steady := report.Stages[1]
+	if steady.Published < 1 || steady.Published > 6 || steady.Errors != 0 {
+		t.Errorf("published %d with %d errors, want at most one every 100ms", steady.Published, steady.Errors)
+	}
+
+	if steady.Dropped < 50 {
+		t.Errorf("dropped %d, want the slots the device was too busy for dropped", steady.Dropped)
+	}
+}
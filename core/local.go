@@ -0,0 +1,149 @@
+package core
+
+import (
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"context"
+	"fmt"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultLocalPubSubAddr = "localhost:8085"
+	DefaultLocalIoTAddr    = "localhost:8086"
+	DefaultLocalBrokerURL  = "tcp://" + DefaultLocalBrokerAddr
+	// PubSubEmulatorHostEnv points the pubsub client at an emulator instead of GCP
+	PubSubEmulatorHostEnv = "PUBSUB_EMULATOR_HOST"
+)
+
+// LocalPubSub is an in-process Pub/Sub stand-in backed by the pstest fake, it speaks the real gRPC API so
+// other processes reach it by setting PUBSUB_EMULATOR_HOST to its address
+type LocalPubSub struct {
+	Addr   string
+	fake   *pstest.Server
+	server *grpc.Server
+}
+
+// Close stops the server, every topic and message is lost
+func (l *LocalPubSub) Close() error {
+	l.server.Stop()
+	return l.fake.Close()
+}
+
+// StartLocalPubSub serves a fake Pub/Sub on addr e.g. localhost:8085
+func StartLocalPubSub(addr string) (*LocalPubSub, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting local pubsub %s", err)
+	}
+
+	// pstest only listens on a random port, its service is registered again on the requested one
+	fake := pstest.NewServer()
+	server := grpc.NewServer()
+	pb.RegisterPublisherServer(server, &fake.GServer)
+	pb.RegisterSubscriberServer(server, &fake.GServer)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.WithError(err).Errorln("local pubsub stopped")
+		}
+	}()
+
+	logger.WithField("addr", listener.Addr().String()).Infoln("local pubsub listening")
+	return &LocalPubSub{Addr: listener.Addr().String(), fake: fake, server: server}, nil
+}
+
+// LocalBridge does what the IoT Core MQTT bridge does for events, messages devices publish on
+// /devices/{id}/events[/subfolder] are published to the topic the registry routes the subfolder to
+// with the IoT Core attributes. States published on /devices/{id}/state are passed to OnState
+type LocalBridge struct {
+	Registry *DeviceRegistry
+	OnState  func(deviceID string, payload []byte)
+	topics   map[string]*pubsub.Topic
+	mu       sync.Mutex
+}
+
+// Forward is an MQTTBroker.OnPublish hook, it returns once Pub/Sub accepted the event so the broker
+// only acknowledges events that reached the topic
+func (b *LocalBridge) Forward(clientID, topic string, payload []byte) error {
+	parts := strings.SplitN(strings.TrimPrefix(topic, "/"), "/", 4)
+	if len(parts) < 3 || parts[0] != "devices" {
+		return nil
+	}
+
+	if len(parts) == 3 && parts[2] == "state" {
+		if b.OnState != nil {
+			b.OnState(parts[1], payload)
+		}
+		return nil
+	}
+
+	if parts[2] != topicType {
+		return nil
+	}
+
+	subFolder := ""
+	if len(parts) == 4 {
+		subFolder = parts[3]
+	}
+
+	msg := &pubsub.Message{
+		Data: payload,
+		Attributes: map[string]string{
+			"deviceId":               parts[1],
+			"deviceRegistryId":       b.Registry.RegistryID,
+			"deviceRegistryLocation": b.Registry.Region,
+			"projectId":              b.Registry.projectID,
+			"subFolder":              subFolder,
+		},
+	}
+
+	pubsubTopic, err := b.topic(subFolder)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	if _, err = pubsubTopic.Publish(ctx, msg).Get(ctx); err != nil {
+		logger.WithError(err).
+			WithField("client-id", clientID).
+			WithField("device-id", parts[1]).
+			Warnln("error forwarding device event to pubsub")
+		return err
+	}
+
+	return nil
+}
+
+// topic returns the topic subFolder is routed to, topics are kept so their publish batching is shared
+func (b *LocalBridge) topic(subFolder string) (*pubsub.Topic, error) {
+	topicName := b.Registry.TopicFor(subFolder)
+	if topicName == "" {
+		return b.Registry.Topic, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	topic, ok := b.topics[topicName]
+	if !ok {
+		topicID, err := TopicID(b.Registry.projectID, topicName)
+		if err != nil {
+			return nil, err
+		}
+
+		topic = b.Registry.PubSubClient.Topic(topicID)
+		b.topics[topicName] = topic
+	}
+
+	return topic, nil
+}
+
+// NewLocalBridge returns a bridge publishing to the topics of registry, the registry must be initialized
+func NewLocalBridge(registry *DeviceRegistry) *LocalBridge {
+	return &LocalBridge{Registry: registry, topics: make(map[string]*pubsub.Topic)}
+}
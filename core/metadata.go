@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/cloudiot/v1"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"sync"
+	"time"
+	// the alpine image has no zoneinfo, store timezones are resolved from the embedded copy
+	_ "time/tzdata"
+)
+
+// Keys of the IoT Core device metadata DeviceMetadata is stored under
+const (
+	MetadataStoreID  = "store_id"
+	MetadataFixture  = "fixture"
+	MetadataAisle    = "aisle"
+	MetadataTimezone = "timezone"
+
+	DefaultMetadataTTL = 10 * time.Minute
+)
+
+// DeviceMetadata describes where a device is installed, it is saved as IoT Core device metadata
+type DeviceMetadata struct {
+	StoreID  string `json:"storeId,omitempty" yaml:"storeId,omitempty"`
+	Fixture  string `json:"fixture,omitempty" yaml:"fixture,omitempty"`
+	Aisle    string `json:"aisle,omitempty" yaml:"aisle,omitempty"`
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+}
+
+// Validate checks that Timezone is an IANA time zone e.g. America/New_York
+func (m DeviceMetadata) Validate() error {
+	if m.Timezone == "" {
+		return nil
+	}
+
+	if _, err := time.LoadLocation(m.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %s", m.Timezone)
+	}
+
+	return nil
+}
+
+// Empty reports whether no field is set
+func (m DeviceMetadata) Empty() bool {
+	return m == DeviceMetadata{}
+}
+
+// Map returns the IoT Core metadata of m, unset fields are left out
+func (m DeviceMetadata) Map() map[string]string {
+	metadata := make(map[string]string)
+	for key, value := range map[string]string{
+		MetadataStoreID:  m.StoreID,
+		MetadataFixture:  m.Fixture,
+		MetadataAisle:    m.Aisle,
+		MetadataTimezone: m.Timezone,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+
+	return metadata
+}
+
+// MetadataOf reads the DeviceMetadata of device, other metadata keys are ignored
+func MetadataOf(device *cloudiot.Device) DeviceMetadata {
+	return DeviceMetadata{
+		StoreID:  device.Metadata[MetadataStoreID],
+		Fixture:  device.Metadata[MetadataFixture],
+		Aisle:    device.Metadata[MetadataAisle],
+		Timezone: device.Metadata[MetadataTimezone],
+	}
+}
+
+// metadataDiffers reports whether device is missing any of the fields set in m
+func metadataDiffers(device *cloudiot.Device, m DeviceMetadata) bool {
+	for key, value := range m.Map() {
+		if device.Metadata[key] != value {
+			return true
+		}
+	}
+
+	return false
+}
+
+type metadataEntry struct {
+	metadata DeviceMetadata
+	expires  time.Time
+}
+
+// MetadataCache looks up the metadata of devices in the Registry and keeps it for TTL, events of a device
+// arrive in bursts so only the first one of a session costs an API call
+type MetadataCache struct {
+	Registry *DeviceRegistry
+	TTL      time.Duration
+	entries  map[string]metadataEntry
+	mu       sync.Mutex
+}
+
+// Get returns the metadata of deviceID, devices that no longer exist have empty metadata
+func (c *MetadataCache) Get(ctx context.Context, deviceID string) (DeviceMetadata, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[deviceID]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.metadata, nil
+	}
+
+	metadata, err := c.lookup(ctx, deviceID)
+	if err != nil {
+		return DeviceMetadata{}, err
+	}
+
+	c.mu.Lock()
+	c.entries[deviceID] = metadataEntry{metadata: metadata, expires: time.Now().Add(c.TTL)}
+	c.mu.Unlock()
+	return metadata, nil
+}
+
+func (c *MetadataCache) lookup(ctx context.Context, deviceID string) (DeviceMetadata, error) {
+	device, err := c.Registry.Client.Projects.Locations.Registries.Devices.
+		Get(c.Registry.DevicePath(deviceID)).
+		FieldMask("metadata").
+		Context(ctx).
+		Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+		return DeviceMetadata{}, nil
+	} else if err != nil {
+		return DeviceMetadata{}, fmt.Errorf("error looking up metadata of %s: %s", deviceID, err)
+	}
+
+	return MetadataOf(device), nil
+}
+
+// NewMetadataCache returns an empty cache of the metadata of devices in registry
+func NewMetadataCache(registry *DeviceRegistry, ttl time.Duration) *MetadataCache {
+	return &MetadataCache{
+		Registry: registry,
+		TTL:      ttl,
+		entries:  make(map[string]metadataEntry),
+	}
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/api/cloudiot/v1"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeviceMetadata(t *testing.T) {
+	metadata := DeviceMetadata{StoreID: "store-12", Aisle: "4", Timezone: "America/New_York"}
+	if err := metadata.Validate(); err != nil {
+		t.Errorf("Validate() error %s", err)
+	}
+
+	if err := (DeviceMetadata{Timezone: "Mars/Olympus_Mons"}).Validate(); err == nil {
+		t.Errorf("Validate() of an unknown timezone succeeded, want error")
+	}
+
+	want := map[string]string{MetadataStoreID: "store-12", MetadataAisle: "4", MetadataTimezone: "America/New_York"}
+	if got := metadata.Map(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Map() = %v, want %v without the unset fixture", got, want)
+	}
+
+	device := &cloudiot.Device{Metadata: map[string]string{MetadataStoreID: "store-12", "owner": "ops"}}
+	if !metadataDiffers(device, metadata) {
+		t.Errorf("metadataDiffers() = false for a device without aisle and timezone, want true")
+	}
+
+	device.Metadata[MetadataAisle] = "4"
+	device.Metadata[MetadataTimezone] = "America/New_York"
+	if metadataDiffers(device, metadata) {
+		t.Errorf("metadataDiffers() = true for a device with every field, want false")
+	}
+
+	if got := MetadataOf(device); got != metadata {
+		t.Errorf("MetadataOf() = %+v, want %+v", got, metadata)
+	}
+
+	if !(DeviceMetadata{}).Empty() || metadata.Empty() {
+		t.Errorf("Empty() only holds for metadata without fields")
+	}
+}
+
+func TestInteractionWithDevice(t *testing.T) {
+	interaction := &Interaction{Timestamp: "2020-01-01T15:00:00Z"}
+	interaction.WithDevice("device-1", DeviceMetadata{StoreID: "store-12", Fixture: "endcap", Timezone: "America/New_York"})
+
+	want := &Interaction{
+		Timestamp: "2020-01-01T15:00:00Z",
+		DeviceID:  "device-1",
+		StoreID:   "store-12",
+		Fixture:   "endcap",
+		Timezone:  "America/New_York",
+		LocalTime: "2020-01-01T10:00:00-05:00",
+	}
+	if !reflect.DeepEqual(interaction, want) {
+		t.Errorf("WithDevice() = %+v, want %+v", interaction, want)
+	}
+
+	// without a timezone there is no local time
+	interaction = (&Interaction{Timestamp: "2020-01-01T15:00:00Z"}).WithDevice("device-1", DeviceMetadata{})
+	if interaction.LocalTime != "" || interaction.DeviceID != "device-1" {
+		t.Errorf("WithDevice() without metadata = %+v, want only the device id", interaction)
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	ctx := context.Background()
+	registry := NewDeviceRegistry(NewClients(), "perch-test", "us-central1", "perch-test", "perch-test")
+	lookups := 0
+	registry.Client = newTestIoTService(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Path != "/v1/"+registry.DevicePath("device-1") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(&cloudiot.Device{Metadata: map[string]string{MetadataStoreID: "store-12"}})
+	})
+
+	cache := NewMetadataCache(registry, 20*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		metadata, err := cache.Get(ctx, "device-1")
+		if err != nil || metadata.StoreID != "store-12" {
+			t.Fatalf("Get() = %+v %v, want store-12", metadata, err)
+		}
+	}
+
+	if lookups != 1 {
+		t.Errorf("%d lookups for 3 events, want the metadata cached", lookups)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := cache.Get(ctx, "device-1"); err != nil || lookups != 2 {
+		t.Errorf("Get() after the ttl made %d lookups %v, want the metadata looked up again", lookups, err)
+	}
+
+	// devices deleted since they published have no metadata
+	if metadata, err := cache.Get(ctx, "device-2"); err != nil || !metadata.Empty() {
+		t.Errorf("Get() of a missing device = %+v %v, want empty metadata", metadata, err)
+	}
+}
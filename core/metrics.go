@@ -0,0 +1,47 @@
+package core
+
+import (
+	"sync/atomic"
+)
+
+var connectionMetrics = &ConnectionMetrics{}
+
+// ConnectionMetrics counts connection lifecycle events across every transport in the process
+type ConnectionMetrics struct {
+	Connects       int64
+	ConnectFails   int64
+	ConnectionLost int64
+	Reconnects     int64
+	TokenRefreshes int64
+	PublishErrors  int64
+}
+
+// Metrics returns the process wide connection metrics
+func Metrics() *ConnectionMetrics {
+	return connectionMetrics
+}
+
+// Snapshot returns a copy of the counters that is safe to read
+func (m *ConnectionMetrics) Snapshot() ConnectionMetrics {
+	return ConnectionMetrics{
+		Connects:       atomic.LoadInt64(&m.Connects),
+		ConnectFails:   atomic.LoadInt64(&m.ConnectFails),
+		ConnectionLost: atomic.LoadInt64(&m.ConnectionLost),
+		Reconnects:     atomic.LoadInt64(&m.Reconnects),
+		TokenRefreshes: atomic.LoadInt64(&m.TokenRefreshes),
+		PublishErrors:  atomic.LoadInt64(&m.PublishErrors),
+	}
+}
+
+// Log writes the current counters to the logger
+func (m *ConnectionMetrics) Log() {
+	s := m.Snapshot()
+	logger.
+		WithField("connects", s.Connects).
+		WithField("connect-fails", s.ConnectFails).
+		WithField("connection-lost", s.ConnectionLost).
+		WithField("reconnects", s.Reconnects).
+		WithField("token-refreshes", s.TokenRefreshes).
+		WithField("publish-errors", s.PublishErrors).
+		Infoln("connection metrics")
+}
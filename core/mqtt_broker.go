@@ -0,0 +1,564 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultLocalBrokerAddr = "localhost:1883"
+
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+
+	connackAccepted           = 0
+	connackBadProtocolVersion = 1
+	connackIdentifierRejected = 2
+	connackSessionPresent     = 0x01
+	connectReserved           = 0x01
+	connectCleanSession       = 0x02
+	connectWill               = 0x04
+	connectWillQoS            = 0x18
+	connectWillRetain         = 0x20
+	connectPassword           = 0x40
+	connectUsername           = 0x80
+)
+
+var errMalformedPacket = errors.New("malformed mqtt packet")
+
+// MQTTBroker is a small MQTT 3.1.1 broker for local development, any client is accepted without
+// authentication. Messages are delivered to subscribers with QoS 0 and retained messages are not kept,
+// clients connecting without clean session find their subscriptions again when they reconnect. Will
+// messages are published when a client goes away without disconnecting
+type MQTTBroker struct {
+	// OnPublish is called for every message published by a client before it is routed to subscribers,
+	// the message is only acknowledged once it returns without error
+	OnPublish func(clientID, topic string, payload []byte) error
+	listener  net.Listener
+	clients   map[string]*brokerClient
+	sessions  map[string]*brokerSession
+	sync.Mutex
+}
+
+type brokerClient struct {
+	conn      net.Conn
+	id        string
+	keepAlive time.Duration
+	clean     bool
+	will      *brokerMessage
+	session   *brokerSession
+	writeLock sync.Mutex
+}
+
+// brokerSession is the state kept for a client id, across connections unless the client asks for a clean session
+type brokerSession struct {
+	subs map[string]bool
+	// received holds the ids of QoS 2 messages that were delivered and wait for their PUBREL
+	received map[uint16]bool
+	sync.Mutex
+}
+
+type brokerMessage struct {
+	topic   string
+	payload []byte
+}
+
+// ListenAndServe accepts clients on addr until the broker is closed
+func (b *MQTTBroker) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return b.Serve(listener)
+}
+
+// Serve accepts clients on listener until the broker is closed
+func (b *MQTTBroker) Serve(listener net.Listener) error {
+	b.Lock()
+	b.listener = listener
+	b.Unlock()
+
+	logger.WithField("addr", listener.Addr().String()).Infoln("mqtt broker listening")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			b.Lock()
+			closed := b.listener == nil
+			b.Unlock()
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		go b.serveConn(conn)
+	}
+}
+
+// Publish routes a message to every client subscribed to a matching filter
+func (b *MQTTBroker) Publish(topic string, payload []byte) error {
+	b.Lock()
+	clients := make([]*brokerClient, 0, len(b.clients))
+	for _, c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.Unlock()
+
+	for _, c := range clients {
+		if !c.subscribed(topic) {
+			continue
+		}
+
+		if err := c.write(encodePublish(topic, payload)); err != nil {
+			logger.WithError(err).WithField("client-id", c.id).WithField("topic", topic).Debugln("error delivering message")
+		}
+	}
+
+	return nil
+}
+
+// Close stops accepting clients and disconnects the connected ones
+func (b *MQTTBroker) Close() error {
+	b.Lock()
+	listener := b.listener
+	b.listener = nil
+	clients := b.clients
+	b.clients = make(map[string]*brokerClient)
+	b.Unlock()
+
+	for _, c := range clients {
+		_ = c.conn.Close()
+	}
+
+	if listener == nil {
+		return nil
+	}
+
+	return listener.Close()
+}
+
+func (b *MQTTBroker) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, body, err := readPacket(r)
+	if err != nil || header>>4 != packetConnect {
+		return
+	}
+
+	c, err := b.connect(conn, body)
+	if err != nil {
+		logger.WithError(err).WithField("remote-addr", conn.RemoteAddr().String()).Debugln("rejected mqtt client")
+		return
+	}
+	defer b.disconnect(c)
+
+	for {
+		deadline := time.Time{}
+		if c.keepAlive > 0 {
+			deadline = time.Now().Add(c.keepAlive * 3 / 2)
+		}
+		_ = conn.SetReadDeadline(deadline)
+
+		header, body, err := readPacket(r)
+		if err != nil {
+			if err != io.EOF {
+				logger.WithError(err).WithField("client-id", c.id).Debugln("mqtt client connection closed")
+			}
+			return
+		}
+
+		if header>>4 == packetDisconnect {
+			c.will = nil
+			return
+		}
+
+		if err = b.handle(c, header, body); err != nil {
+			logger.WithError(err).WithField("client-id", c.id).Debugln("closing mqtt client")
+			return
+		}
+	}
+}
+
+func (b *MQTTBroker) connect(conn net.Conn, body []byte) (*brokerClient, error) {
+	p := &packetReader{b: body}
+	_ = p.string()
+	level := p.byte()
+	flags := p.byte()
+	keepAlive := p.uint16()
+	clientID := p.string()
+	var will *brokerMessage
+	if flags&connectWill != 0 {
+		will = &brokerMessage{topic: p.string(), payload: []byte(p.string())}
+	}
+
+	username := ""
+	if flags&connectUsername != 0 {
+		username = p.string()
+	}
+
+	if flags&connectPassword != 0 {
+		// any password is accepted
+		_ = p.string()
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	if level != 3 && level != 4 {
+		_, _ = conn.Write([]byte{packetConnack << 4, 2, 0, connackBadProtocolVersion})
+		return nil, fmt.Errorf("unsupported protocol level %d", level)
+	}
+
+	// the reserved flag is zero, will QoS and retain come with a will and a password with a username
+	if flags&connectReserved != 0 || flags&connectWillQoS == connectWillQoS ||
+		(will == nil && flags&(connectWillQoS|connectWillRetain) != 0) ||
+		(flags&connectPassword != 0 && flags&connectUsername == 0) {
+		return nil, fmt.Errorf("invalid connect flags %08b", flags)
+	}
+
+	clean := flags&connectCleanSession != 0
+	if clientID == "" {
+		if !clean {
+			_, _ = conn.Write([]byte{packetConnack << 4, 2, 0, connackIdentifierRejected})
+			return nil, fmt.Errorf("a session can not be kept without a client id")
+		}
+
+		clientID = fmt.Sprintf("anonymous-%s", conn.RemoteAddr().String())
+	}
+
+	c := &brokerClient{
+		conn:      conn,
+		id:        clientID,
+		keepAlive: time.Duration(keepAlive) * time.Second,
+		clean:     clean,
+		will:      will,
+	}
+
+	b.Lock()
+	if b.clients == nil {
+		b.clients = make(map[string]*brokerClient)
+	}
+	if b.sessions == nil {
+		b.sessions = make(map[string]*brokerSession)
+	}
+	previous := b.clients[clientID]
+	b.clients[clientID] = c
+	c.session = b.sessions[clientID]
+	sessionPresent := c.session != nil && !clean
+	if !sessionPresent {
+		c.session = &brokerSession{subs: make(map[string]bool), received: make(map[uint16]bool)}
+		b.sessions[clientID] = c.session
+	}
+	b.Unlock()
+
+	// a second connection with the same client id takes over the session of the first
+	if previous != nil {
+		_ = previous.conn.Close()
+	}
+
+	var ackFlags byte
+	if sessionPresent {
+		ackFlags = connackSessionPresent
+	}
+
+	logger.WithField("client-id", clientID).
+		WithField("username", username).
+		WithField("clean-session", clean).
+		WithField("session-present", sessionPresent).
+		Debugln("mqtt client connected")
+	return c, c.write([]byte{packetConnack << 4, 2, ackFlags, connackAccepted})
+}
+
+// disconnect forgets a clean session and publishes the will of a client that went away without DISCONNECT,
+// nothing is published while the broker shuts down
+func (b *MQTTBroker) disconnect(c *brokerClient) {
+	b.Lock()
+	closed := b.listener == nil
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+		if c.clean {
+			delete(b.sessions, c.id)
+		}
+	}
+	b.Unlock()
+
+	logger.WithField("client-id", c.id).Debugln("mqtt client disconnected")
+	if c.will == nil || closed {
+		return
+	}
+
+	if err := b.deliver(c.id, c.will.topic, c.will.payload); err != nil {
+		logger.WithError(err).WithField("client-id", c.id).Warnln("error publishing will")
+	}
+}
+
+// deliver hands a message published by clientID to OnPublish and then routes it to subscribers
+func (b *MQTTBroker) deliver(clientID, topic string, payload []byte) error {
+	if b.OnPublish != nil {
+		if err := b.OnPublish(clientID, topic, payload); err != nil {
+			return fmt.Errorf("error forwarding message on %s: %s", topic, err)
+		}
+	}
+
+	return b.Publish(topic, payload)
+}
+
+func (b *MQTTBroker) handle(c *brokerClient, header byte, body []byte) error {
+	p := &packetReader{b: body}
+	switch header >> 4 {
+	case packetPublish:
+		qos := (header >> 1) & 0x03
+		topic := p.string()
+		var id uint16
+		if qos > 0 {
+			id = p.uint16()
+		}
+		if p.err != nil {
+			return p.err
+		}
+
+		if qos > 2 {
+			return errMalformedPacket
+		}
+
+		// a QoS 2 message is delivered once, copies sent again before its PUBREL are only acknowledged
+		if qos == 2 && c.session.hasReceived(id) {
+			return c.write(ackPacket(packetPubrec, id))
+		}
+
+		// the message is acknowledged once it was forwarded, the connection of a client whose message
+		// could not be forwarded is closed so it sends the message again
+		if err := b.deliver(c.id, topic, p.rest()); err != nil {
+			return err
+		}
+
+		switch qos {
+		case 1:
+			return c.write(ackPacket(packetPuback, id))
+		case 2:
+			c.session.setReceived(id, true)
+			return c.write(ackPacket(packetPubrec, id))
+		}
+
+		return nil
+	case packetPubrel:
+		id := p.uint16()
+		if p.err != nil {
+			return p.err
+		}
+
+		c.session.setReceived(id, false)
+		return c.write(ackPacket(packetPubcomp, id))
+	case packetPuback, packetPubrec, packetPubcomp:
+		// messages are only sent with QoS 0 so there is nothing to acknowledge
+		return nil
+	case packetSubscribe:
+		id := p.uint16()
+		granted := make([]byte, 0, 1)
+		for p.err == nil && len(p.b) > 0 {
+			filter := p.string()
+			qos := p.byte()
+			if qos > 1 {
+				qos = 1
+			}
+
+			c.session.Lock()
+			c.session.subs[filter] = true
+			c.session.Unlock()
+			granted = append(granted, qos)
+		}
+		if p.err != nil {
+			return p.err
+		}
+
+		return c.write(append(encodeHeader(packetSuback<<4, 2+len(granted)), append([]byte{byte(id >> 8), byte(id)}, granted...)...))
+	case packetUnsubscribe:
+		id := p.uint16()
+		for p.err == nil && len(p.b) > 0 {
+			filter := p.string()
+			c.session.Lock()
+			delete(c.session.subs, filter)
+			c.session.Unlock()
+		}
+		if p.err != nil {
+			return p.err
+		}
+
+		return c.write(ackPacket(packetUnsuback, id))
+	case packetPingreq:
+		return c.write([]byte{packetPingresp << 4, 0})
+	}
+
+	return fmt.Errorf("unexpected packet type %d", header>>4)
+}
+
+func (c *brokerClient) subscribed(topic string) bool {
+	c.session.Lock()
+	defer c.session.Unlock()
+
+	for filter := range c.session.subs {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *brokerSession) hasReceived(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.received[id]
+}
+
+func (s *brokerSession) setReceived(id uint16, received bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if received {
+		s.received[id] = true
+	} else {
+		delete(s.received, id)
+	}
+}
+
+func (c *brokerClient) write(packet []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(publishTimeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+type packetReader struct {
+	b   []byte
+	err error
+}
+
+func (p *packetReader) byte() byte {
+	if p.err != nil || len(p.b) < 1 {
+		p.err = errMalformedPacket
+		return 0
+	}
+
+	v := p.b[0]
+	p.b = p.b[1:]
+	return v
+}
+
+func (p *packetReader) uint16() uint16 {
+	if p.err != nil || len(p.b) < 2 {
+		p.err = errMalformedPacket
+		return 0
+	}
+
+	v := binary.BigEndian.Uint16(p.b)
+	p.b = p.b[2:]
+	return v
+}
+
+func (p *packetReader) string() string {
+	n := int(p.uint16())
+	if p.err != nil || len(p.b) < n {
+		p.err = errMalformedPacket
+		return ""
+	}
+
+	v := string(p.b[:n])
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *packetReader) rest() []byte {
+	v := p.b
+	p.b = nil
+	return v
+}
+
+// readPacket reads the fixed header and body of the next control packet
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		length += int(digit&0x7F) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+
+		multiplier *= 128
+		if multiplier > 128*128*128 {
+			return 0, nil, errMalformedPacket
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func encodeHeader(header byte, length int) []byte {
+	b := []byte{header}
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+func encodePublish(topic string, payload []byte) []byte {
+	length := 2 + len(topic) + len(payload)
+	b := encodeHeader(packetPublish<<4, length)
+	b = append(b, byte(len(topic)>>8), byte(len(topic)))
+	b = append(b, topic...)
+	return append(b, payload...)
+}
+
+func ackPacket(packetType byte, id uint16) []byte {
+	return []byte{packetType << 4, 2, byte(id >> 8), byte(id)}
+}
+
+// NewMQTTBroker returns a broker that is not listening yet
+func NewMQTTBroker() *MQTTBroker {
+	return &MQTTBroker{clients: make(map[string]*brokerClient), sessions: make(map[string]*brokerSession)}
+}
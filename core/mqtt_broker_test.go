@@ -0,0 +1,380 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestBroker serves a new broker on a random local port until the test ends
+func startTestBroker(t *testing.T) (*MQTTBroker, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening %s", err)
+	}
+
+	broker := NewMQTTBroker()
+	go func() { _ = broker.Serve(listener) }()
+	t.Cleanup(func() { _ = broker.Close() })
+
+	return broker, listener.Addr().String()
+}
+
+func newTestMQTTClient(t *testing.T, addr, clientID string) mqtt.Client {
+	t.Helper()
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID(clientID).
+		SetAutoReconnect(false))
+	if token := client.Connect(); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("error connecting %s %v", clientID, token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	return client
+}
+
+// dialTestBroker sends a CONNECT with the given flags, the payload fields follow the client id
+func dialTestBroker(t *testing.T, addr, clientID string, flags byte, fields ...string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error dialing broker %s", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	body := append(encodeString("MQTT"), 4, flags, 0, 0)
+	for _, field := range append([]string{clientID}, fields...) {
+		body = append(body, encodeString(field)...)
+	}
+
+	if _, err = conn.Write(append(encodeHeader(packetConnect<<4, len(body)), body...)); err != nil {
+		t.Fatalf("error writing connect %s", err)
+	}
+
+	return conn, bufio.NewReader(conn)
+}
+
+func encodeString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// readTestPacket returns the next packet sent by the broker, an error once it closed the connection
+func readTestPacket(t *testing.T, conn net.Conn, r *bufio.Reader) ([]byte, error) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	header, body, err := readPacket(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(encodeHeader(header, len(body)), body...), nil
+}
+
+func TestMQTTBrokerRouting(t *testing.T) {
+	broker, addr := startTestBroker(t)
+
+	var lock sync.Mutex
+	var forwarded []string
+	broker.OnPublish = func(clientID, topic string, payload []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		forwarded = append(forwarded, clientID+" "+topic)
+		return nil
+	}
+
+	received := make(chan string, 10)
+	subscriber := newTestMQTTClient(t, addr, "subscriber")
+	token := subscriber.Subscribe("/devices/+/events/#", 1, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- msg.Topic() + " " + string(msg.Payload())
+	})
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("Subscribe() error %v", token.Error())
+	}
+
+	publisher := newTestMQTTClient(t, addr, "d1")
+	for qos := byte(0); qos <= 2; qos++ {
+		token := publisher.Publish("/devices/d1/events/interactions", qos, false, fmt.Sprintf("qos%d", qos))
+		if !token.WaitTimeout(time.Second) || token.Error() != nil {
+			t.Fatalf("Publish() with QoS %d error %v", qos, token.Error())
+		}
+	}
+
+	if token := publisher.Publish("/devices/d1/state", 1, false, "state"); !token.WaitTimeout(time.Second) {
+		t.Fatalf("Publish() of state timed out")
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-received:
+			got = append(got, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v, want 3 events", got)
+		}
+	}
+
+	want := []string{
+		"/devices/d1/events/interactions qos0",
+		"/devices/d1/events/interactions qos1",
+		"/devices/d1/events/interactions qos2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriber received %v, want %v", got, want)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(forwarded) != 4 || forwarded[3] != "d1 /devices/d1/state" {
+		t.Errorf("forwarded %v, want every message published by d1", forwarded)
+	}
+}
+
+func TestMQTTBrokerForwardsBeforeAck(t *testing.T) {
+	broker, addr := startTestBroker(t)
+
+	release := make(chan struct{})
+	broker.OnPublish = func(clientID, topic string, payload []byte) error {
+		<-release
+		return nil
+	}
+
+	publisher := newTestMQTTClient(t, addr, "d1")
+	token := publisher.Publish("/devices/d1/events", 1, false, "event")
+	if token.WaitTimeout(100 * time.Millisecond) {
+		t.Fatalf("Publish() acknowledged while the message is being forwarded")
+	}
+
+	close(release)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Errorf("Publish() not acknowledged after forwarding, error %v", token.Error())
+	}
+}
+
+func TestMQTTBrokerForwardError(t *testing.T) {
+	broker, addr := startTestBroker(t)
+	broker.OnPublish = func(clientID, topic string, payload []byte) error {
+		return fmt.Errorf("pubsub unavailable")
+	}
+
+	conn, r := dialTestBroker(t, addr, "d1", connectCleanSession)
+	if ack, err := readTestPacket(t, conn, r); err != nil || ack[0]>>4 != packetConnack {
+		t.Fatalf("connect answered %v %v, want CONNACK", ack, err)
+	}
+
+	body := append(encodeString("/devices/d1/events"), 0, 1)
+	_, _ = conn.Write(append(encodeHeader(packetPublish<<4|1<<1, len(body)+5), append(body, "event"...)...))
+
+	// without PUBACK the client keeps the message and sends it again once connected
+	if packet, err := readTestPacket(t, conn, r); err == nil {
+		t.Errorf("broker answered %v to a message it could not forward, want the connection closed", packet)
+	}
+}
+
+func TestMQTTBrokerQoS2(t *testing.T) {
+	broker, addr := startTestBroker(t)
+
+	var lock sync.Mutex
+	forwarded := 0
+	broker.OnPublish = func(clientID, topic string, payload []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		forwarded++
+		return nil
+	}
+
+	conn, r := dialTestBroker(t, addr, "d1", connectCleanSession)
+	if _, err := readTestPacket(t, conn, r); err != nil {
+		t.Fatalf("error reading CONNACK %s", err)
+	}
+
+	body := append(append(encodeString("/devices/d1/events"), 0, 7), "event"...)
+	exchange := []struct {
+		name          string
+		packet        []byte
+		wantAck       []byte
+		wantForwarded int
+	}{
+		{name: "publish", packet: append(encodeHeader(packetPublish<<4|2<<1, len(body)), body...), wantAck: ackPacket(packetPubrec, 7), wantForwarded: 1},
+		{name: "duplicate", packet: append(encodeHeader(packetPublish<<4|0x08|2<<1, len(body)), body...), wantAck: ackPacket(packetPubrec, 7), wantForwarded: 1},
+		{name: "release", packet: ackPacket(packetPubrel, 7), wantAck: ackPacket(packetPubcomp, 7), wantForwarded: 1},
+		{name: "id reused after release", packet: append(encodeHeader(packetPublish<<4|2<<1, len(body)), body...), wantAck: ackPacket(packetPubrec, 7), wantForwarded: 2},
+	}
+
+	for _, step := range exchange {
+		if _, err := conn.Write(step.packet); err != nil {
+			t.Fatalf("%s: error writing %s", step.name, err)
+		}
+
+		ack, err := readTestPacket(t, conn, r)
+		if err != nil {
+			t.Fatalf("%s: error reading ack %s", step.name, err)
+		}
+
+		if !reflect.DeepEqual(ack, step.wantAck) {
+			t.Errorf("%s: broker answered %v, want %v", step.name, ack, step.wantAck)
+		}
+
+		lock.Lock()
+		if forwarded != step.wantForwarded {
+			t.Errorf("%s: forwarded %d times, want %d", step.name, forwarded, step.wantForwarded)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestMQTTBrokerConnectFlags(t *testing.T) {
+	cases := []struct {
+		name     string
+		clientID string
+		flags    byte
+		fields   []string
+		// wantAck is nil when the broker closes the connection without CONNACK
+		wantAck []byte
+	}{
+		{name: "username and password", clientID: "d1", flags: connectCleanSession | connectUsername | connectPassword, fields: []string{"user", "secret"}, wantAck: []byte{packetConnack << 4, 2, 0, connackAccepted}},
+		{name: "will", clientID: "d1", flags: connectCleanSession | connectWill | 1<<3, fields: []string{"/devices/d1/state", "offline"}, wantAck: []byte{packetConnack << 4, 2, 0, connackAccepted}},
+		{name: "generated client id", flags: connectCleanSession, wantAck: []byte{packetConnack << 4, 2, 0, connackAccepted}},
+		{name: "session without client id", wantAck: []byte{packetConnack << 4, 2, 0, connackIdentifierRejected}},
+		{name: "reserved flag", clientID: "d1", flags: connectReserved | connectCleanSession},
+		{name: "password without username", clientID: "d1", flags: connectCleanSession | connectPassword, fields: []string{"secret"}},
+		{name: "will QoS without will", clientID: "d1", flags: connectCleanSession | 1<<3},
+		{name: "will QoS 3", clientID: "d1", flags: connectCleanSession | connectWill | connectWillQoS, fields: []string{"/devices/d1/state", "offline"}},
+	}
+
+	_, addr := startTestBroker(t)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, r := dialTestBroker(t, addr, tc.clientID, tc.flags, tc.fields...)
+			ack, err := readTestPacket(t, conn, r)
+			if tc.wantAck == nil {
+				if err == nil {
+					t.Errorf("broker answered %v, want the connection closed", ack)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("error reading CONNACK %s", err)
+			}
+
+			if !reflect.DeepEqual(ack, tc.wantAck) {
+				t.Errorf("broker answered %v, want %v", ack, tc.wantAck)
+			}
+		})
+	}
+}
+
+func TestMQTTBrokerWill(t *testing.T) {
+	cases := []struct {
+		name     string
+		graceful bool
+		wantWill bool
+	}{
+		{name: "connection lost", wantWill: true},
+		{name: "disconnect", graceful: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker, addr := startTestBroker(t)
+			wills := make(chan string, 1)
+			broker.OnPublish = func(clientID, topic string, payload []byte) error {
+				wills <- topic + " " + string(payload)
+				return nil
+			}
+
+			conn, r := dialTestBroker(t, addr, "d1", connectCleanSession|connectWill, "/devices/d1/state", "offline")
+			if _, err := readTestPacket(t, conn, r); err != nil {
+				t.Fatalf("error reading CONNACK %s", err)
+			}
+
+			if tc.graceful {
+				_, _ = conn.Write([]byte{packetDisconnect << 4, 0})
+			}
+			_ = conn.Close()
+
+			select {
+			case will := <-wills:
+				if !tc.wantWill {
+					t.Errorf("published will %s after DISCONNECT", will)
+				} else if will != "/devices/d1/state offline" {
+					t.Errorf("published %s, want the will", will)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.wantWill {
+					t.Errorf("will not published")
+				}
+			}
+		})
+	}
+}
+
+func TestMQTTBrokerSession(t *testing.T) {
+	broker, addr := startTestBroker(t)
+
+	// connect returns the session present flag of the CONNACK
+	connect := func(flags byte) (net.Conn, *bufio.Reader, byte) {
+		conn, r := dialTestBroker(t, addr, "d1", flags)
+		ack, err := readTestPacket(t, conn, r)
+		if err != nil || len(ack) != 4 || ack[3] != connackAccepted {
+			t.Fatalf("connect answered %v %v, want CONNACK accepted", ack, err)
+		}
+
+		return conn, r, ack[2]
+	}
+
+	// disconnect waits for the broker to close the connection so the session is stored
+	disconnect := func(conn net.Conn, r *bufio.Reader) {
+		_, _ = conn.Write([]byte{packetDisconnect << 4, 0})
+		for {
+			if _, err := readTestPacket(t, conn, r); err != nil {
+				return
+			}
+		}
+	}
+
+	conn, r, present := connect(0)
+	if present != 0 {
+		t.Errorf("first connect session present %d, want 0", present)
+	}
+
+	body := append(append([]byte{0, 1}, encodeString("/devices/d1/config")...), 0)
+	_, _ = conn.Write(append(encodeHeader(packetSubscribe<<4|0x02, len(body)), body...))
+	if ack, err := readTestPacket(t, conn, r); err != nil || ack[0]>>4 != packetSuback {
+		t.Fatalf("subscribe answered %v %v, want SUBACK", ack, err)
+	}
+	disconnect(conn, r)
+
+	conn, r, present = connect(0)
+	if present != connackSessionPresent {
+		t.Errorf("reconnect session present %d, want %d", present, connackSessionPresent)
+	}
+
+	_ = broker.Publish("/devices/d1/config", []byte("config"))
+	if packet, err := readTestPacket(t, conn, r); err != nil || !reflect.DeepEqual(packet, encodePublish("/devices/d1/config", []byte("config"))) {
+		t.Errorf("resumed session received %v %v, want the config", packet, err)
+	}
+	disconnect(conn, r)
+
+	// a clean session drops the stored one and is not kept after it ends
+	conn, r, present = connect(connectCleanSession)
+	if present != 0 {
+		t.Errorf("clean connect session present %d, want 0", present)
+	}
+	disconnect(conn, r)
+
+	if _, _, present = connect(0); present != 0 {
+		t.Errorf("connect after a clean session present %d, want 0", present)
+	}
+}
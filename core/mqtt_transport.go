@@ -0,0 +1,324 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	connectAttempts             = 5
+	initialBackoff              = time.Second
+	defaultMaxReconnectInterval = 2 * time.Minute
+	publishTimeout              = 30 * time.Second
+	tokenPollInterval           = 100 * time.Millisecond
+)
+
+// MQTTTransport publishes through a generic MQTT broker such as mosquitto
+type MQTTTransport struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	TLS      *tls.Config
+	// Credentials is consulted on every (re)connect and takes precedence over Username and Password
+	Credentials          mqtt.CredentialsProvider
+	MaxReconnectInterval time.Duration
+	conn                 mqtt.Client
+	store                *mqtt.MemoryStore
+	subs                 map[string]MessageHandler
+	reconnectFns         []func()
+	lost                 bool
+	// inFlight is held for reading by publishes waiting for their ack, Reconnect takes it so they finish
+	// before the connection is dropped, disconnecting fails every unacknowledged publish
+	inFlight sync.RWMutex
+	sync.Mutex
+}
+
+// Connect connects to the broker retrying with exponential backoff until ctx is done, once connected the
+// client reconnects on its own and resumes in flight QoS 1 publishes from its store
+func (t *MQTTTransport) Connect(ctx context.Context) error {
+	t.Lock()
+	if t.conn == nil {
+		t.conn = mqtt.NewClient(t.clientOptions())
+	}
+	conn := t.conn
+	t.Unlock()
+
+	backoff := initialBackoff
+	var err error
+	for attempt := 1; attempt <= connectAttempts; attempt++ {
+		err = waitToken(ctx, conn.Connect())
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("error connecting to mqtt broker %s: %s", t.Broker, ctx.Err())
+		}
+
+		atomic.AddInt64(&connectionMetrics.ConnectFails, 1)
+		logger.WithError(err).
+			WithField("client-id", t.ClientID).
+			WithField("attempt", attempt).
+			Warnf("mqtt connect failed, retrying in %s", backoff)
+
+		if err := sleep(ctx, backoff); err != nil {
+			return fmt.Errorf("error connecting to mqtt broker %s: %s", t.Broker, err)
+		}
+
+		backoff = nextBackoff(backoff, t.maxReconnectInterval())
+	}
+
+	return fmt.Errorf("error connecting to mqtt broker %s: %s", t.Broker, err)
+}
+
+// Reconnect presents fresh credentials before the current ones expire. An open connection is dropped once the
+// publishes in flight are acknowledged and connected again, new publishes wait until it is back. While the
+// client is reconnecting on its own there is nothing to do, it asks Credentials for the fresh token
+func (t *MQTTTransport) Reconnect(ctx context.Context) error {
+	conn := t.client()
+	if conn == nil || !conn.IsConnectionOpen() {
+		return nil
+	}
+
+	t.inFlight.Lock()
+	defer t.inFlight.Unlock()
+
+	t.Lock()
+	t.lost = true
+	t.Unlock()
+
+	conn.Disconnect(250)
+	return t.Connect(ctx)
+}
+
+// Publish waits for the broker to acknowledge the message for at most publishTimeout or until ctx is done,
+// a message still waiting for its ack is kept in the store and a *PendingError returned
+func (t *MQTTTransport) Publish(ctx context.Context, topic string, payload []byte) error {
+	t.inFlight.RLock()
+	defer t.inFlight.RUnlock()
+
+	conn := t.client()
+	if conn == nil {
+		return fmt.Errorf("mqtt transport is not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	err := waitToken(ctx, conn.Publish(topic, qos, retain, payload))
+	if err != nil && err == ctx.Err() {
+		// the token is still open, paho resends unacknowledged QoS 1 publishes from its store when it reconnects
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out")
+		}
+
+		err = &PendingError{Topic: topic, Err: err}
+	}
+
+	if err != nil {
+		atomic.AddInt64(&connectionMetrics.PublishErrors, 1)
+	}
+
+	return err
+}
+
+// Subscribe subscribes to topic, subscriptions are restored every time the connection is re-established
+func (t *MQTTTransport) Subscribe(ctx context.Context, topic string, handler MessageHandler) error {
+	t.Lock()
+	conn := t.conn
+	if conn != nil {
+		t.subs[topic] = handler
+	}
+	t.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("mqtt transport is not connected")
+	}
+
+	return t.subscribe(ctx, conn, topic, handler)
+}
+
+// Close disconnects from the broker, giving in-flight messages 250ms to complete
+func (t *MQTTTransport) Close() error {
+	if conn := t.client(); conn != nil && conn.IsConnected() {
+		conn.Disconnect(250)
+	}
+
+	return nil
+}
+
+func (t *MQTTTransport) client() mqtt.Client {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.conn
+}
+
+func (t *MQTTTransport) subscribe(ctx context.Context, conn mqtt.Client, topic string, handler MessageHandler) error {
+	return waitToken(ctx, conn.Subscribe(topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		handler(msg.Topic(), msg.Payload())
+	}))
+}
+
+func (t *MQTTTransport) clientOptions() *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions().
+		AddBroker(t.Broker).
+		SetClientID(t.ClientID).
+		SetUsername(t.Username).
+		SetPassword(t.Password).
+		SetProtocolVersion(4).
+		SetCleanSession(false).
+		SetStore(t.store).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(t.maxReconnectInterval()).
+		SetOnConnectHandler(t.onConnect).
+		SetConnectionLostHandler(t.onConnectionLost)
+
+	if t.Credentials != nil {
+		opts.SetCredentialsProvider(t.Credentials)
+	}
+
+	if t.TLS != nil {
+		opts.SetTLSConfig(t.TLS)
+	} else if strings.HasPrefix(t.Broker, "ssl://") || strings.HasPrefix(t.Broker, "tls://") {
+		opts.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+
+	return opts
+}
+
+func (t *MQTTTransport) onConnect(conn mqtt.Client) {
+	atomic.AddInt64(&connectionMetrics.Connects, 1)
+
+	t.Lock()
+	reconnected := t.lost
+	t.lost = false
+	subs := make(map[string]MessageHandler, len(t.subs))
+	for topic, handler := range t.subs {
+		subs[topic] = handler
+	}
+	reconnectFns := t.reconnectFns
+	t.Unlock()
+
+	entry := logger.WithField("client-id", t.ClientID).WithField("broker", t.Broker)
+	if !reconnected {
+		entry.Infoln("mqtt connection established")
+		return
+	}
+
+	atomic.AddInt64(&connectionMetrics.Reconnects, 1)
+	entry.Infoln("mqtt connection re-established")
+
+	// the callback runs on the client's own goroutine so subscribing must not block it
+	go func() {
+		for _, fn := range reconnectFns {
+			fn()
+		}
+
+		for topic, handler := range subs {
+			if err := t.subscribe(context.Background(), conn, topic, handler); err != nil {
+				entry.WithError(err).WithField("topic", topic).Warnln("error restoring subscription")
+			}
+		}
+	}()
+}
+
+// OnReconnect registers fn to be called after the client reconnected, before its subscriptions are restored
+func (t *MQTTTransport) OnReconnect(fn func()) {
+	t.Lock()
+	t.reconnectFns = append(t.reconnectFns, fn)
+	t.Unlock()
+}
+
+func (t *MQTTTransport) onConnectionLost(_ mqtt.Client, err error) {
+	atomic.AddInt64(&connectionMetrics.ConnectionLost, 1)
+
+	t.Lock()
+	t.lost = true
+	t.Unlock()
+
+	logger.WithError(err).
+		WithField("client-id", t.ClientID).
+		WithField("broker", t.Broker).
+		Warnln("mqtt connection lost, reconnecting")
+}
+
+func (t *MQTTTransport) maxReconnectInterval() time.Duration {
+	if t.MaxReconnectInterval > 0 {
+		return t.MaxReconnectInterval
+	}
+
+	return defaultMaxReconnectInterval
+}
+
+// NewMQTTTransport returns a Transport for the broker url e.g. tcp://localhost:1883
+func NewMQTTTransport(broker, clientID string) *MQTTTransport {
+	return &MQTTTransport{
+		Broker:   broker,
+		ClientID: clientID,
+		store:    mqtt.NewMemoryStore(),
+		subs:     make(map[string]MessageHandler),
+	}
+}
+
+// NewGoogleTransport returns a Transport with its own connection to the IoT Core MQTT bridge,
+// authenticated with the client ID and JWT of device. The JWT is re-minted whenever it is close
+// to expiring so reconnects always present a valid token. A nil config trusts the embedded google roots
+func NewGoogleTransport(device *Device, config *tls.Config) *MQTTTransport {
+	if config == nil {
+		config = &tls.Config{
+			RootCAs:    GoogleRoots(),
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	clientID := MQTTClientID(device.projectID, device.Region, device.RegistryID, device.DeviceID)
+	t := NewMQTTTransport(mqttServer, clientID)
+	t.Username = username
+	t.Credentials = func() (string, string) {
+		return username, device.Token()
+	}
+	t.TLS = config
+
+	return t
+}
+
+// waitToken waits for token to complete, paho tokens can not be cancelled so ctx is checked between short waits
+func waitToken(ctx context.Context, token mqtt.Token) error {
+	for !token.WaitTimeout(tokenPollInterval) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	return token.Error()
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func nextBackoff(current, max time.Duration) time.Duration {
+	next := current * 2
+	if next > max {
+		return max
+	}
+
+	return next
+}
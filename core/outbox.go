@@ -0,0 +1,288 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutboxMaxBytes = 64 << 20
+	DefaultOutboxMaxAge   = 24 * time.Hour
+	outboxRetryInterval   = 10 * time.Second
+)
+
+// OutboxEntry is a message waiting to be published, the payload is stored as it was encoded
+// so replayed events keep the timestamp they were created with
+type OutboxEntry struct {
+	Topic    string    `json:"topic"`
+	Payload  []byte    `json:"payload"`
+	QueuedAt time.Time `json:"queuedAt"`
+}
+
+type outboxFile struct {
+	seq      uint64
+	size     int64
+	queuedAt time.Time
+}
+
+// Outbox is an on-disk FIFO queue of messages a device could not publish, every entry is a file
+// named after its sequence number in Dir so the queue survives restarts of the simulator.
+// Once the queue grows past MaxBytes the oldest entries are dropped, entries older than MaxAge
+// are dropped instead of replayed
+type Outbox struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+	files    []outboxFile
+	size     int64
+	nextSeq  uint64
+	replay   sync.Mutex
+	sync.Mutex
+}
+
+// Put appends a message to the queue
+func (o *Outbox) Put(topic string, payload []byte) error {
+	entry := &OutboxEntry{Topic: topic, Payload: payload, QueuedAt: time.Now().UTC()}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	seq := o.nextSeq
+	if err = writeFileAtomic(o.path(seq), b); err != nil {
+		return fmt.Errorf("error writing outbox entry %s", err)
+	}
+
+	o.nextSeq++
+	o.files = append(o.files, outboxFile{seq: seq, size: int64(len(b)), queuedAt: entry.QueuedAt})
+	o.size += int64(len(b))
+
+	dropped := 0
+	for o.MaxBytes > 0 && o.size > o.MaxBytes && len(o.files) > 1 {
+		o.removeOldest()
+		dropped++
+	}
+
+	if dropped > 0 {
+		logger.WithField("outbox", o.Dir).WithField("dropped", dropped).Warnln("outbox is full, dropped oldest entries")
+	}
+
+	return nil
+}
+
+// Len returns the number of queued messages
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return len(o.files)
+}
+
+// Replay publishes queued messages oldest first and removes them once publish succeeds, it stops
+// at the first error so the order is kept for the next attempt. It returns how many were published
+func (o *Outbox) Replay(publish func(topic string, payload []byte) error) (int, error) {
+	o.replay.Lock()
+	defer o.replay.Unlock()
+
+	published, expired := 0, 0
+	defer func() {
+		if expired > 0 {
+			logger.WithField("outbox", o.Dir).WithField("expired", expired).Warnln("dropped outbox entries older than max age")
+		}
+	}()
+
+	for {
+		o.Lock()
+		if len(o.files) == 0 {
+			o.Unlock()
+			return published, nil
+		}
+
+		oldest := o.files[0]
+		if o.MaxAge > 0 && time.Since(oldest.queuedAt) > o.MaxAge {
+			o.removeOldest()
+			o.Unlock()
+			expired++
+			continue
+		}
+		o.Unlock()
+
+		entry, err := readOutboxEntry(o.path(oldest.seq))
+		if err != nil {
+			return published, err
+		}
+
+		if err = publish(entry.Topic, entry.Payload); err != nil {
+			return published, err
+		}
+
+		o.Lock()
+		// the entry may have been dropped by Put while it was being published
+		if len(o.files) > 0 && o.files[0].seq == oldest.seq {
+			o.removeOldest()
+		}
+		o.Unlock()
+		published++
+	}
+}
+
+// removeOldest must be called with the lock held
+func (o *Outbox) removeOldest() {
+	oldest := o.files[0]
+	if err := os.Remove(o.path(oldest.seq)); err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).WithField("outbox", o.Dir).Warnln("error removing outbox entry")
+	}
+
+	o.files = o.files[1:]
+	o.size -= oldest.size
+}
+
+func (o *Outbox) path(seq uint64) string {
+	return filepath.Join(o.Dir, fmt.Sprintf("%020d.json", seq))
+}
+
+func (o *Outbox) load() error {
+	paths, err := filepath.Glob(filepath.Join(o.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		entry, err := readOutboxEntry(path)
+		if err != nil {
+			logger.WithError(err).WithField("path", path).Warnln("skipping unreadable outbox entry")
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		o.files = append(o.files, outboxFile{seq: seq, size: info.Size(), queuedAt: entry.QueuedAt})
+		o.size += info.Size()
+		o.nextSeq = seq + 1
+	}
+
+	return nil
+}
+
+func readOutboxEntry(path string) (*OutboxEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &OutboxEntry{}
+	if err = json.Unmarshal(b, entry); err != nil {
+		return nil, fmt.Errorf("error decoding outbox entry %s: %s", path, err)
+	}
+
+	return entry, nil
+}
+
+// OpenOutbox opens the queue stored in dir creating it if needed, entries left by a previous run are kept
+func OpenOutbox(dir string, maxBytes int64, maxAge time.Duration) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating outbox %s", err)
+	}
+
+	outbox := &Outbox{Dir: dir, MaxBytes: maxBytes, MaxAge: maxAge}
+	if err := outbox.load(); err != nil {
+		return nil, fmt.Errorf("error loading outbox %s: %s", dir, err)
+	}
+
+	return outbox, nil
+}
+
+// publishOrQueue publishes straight to the transport only while the outbox is empty so newer events
+// never overtake queued ones, failed publishes are queued instead of being returned to the session
+func (d *Device) publishOrQueue(ctx context.Context, topic string, payload []byte) error {
+	if d.Outbox.Len() == 0 {
+		err := d.Transport.Publish(ctx, topic, payload)
+		d.recordPublish(err)
+		if err == nil {
+			return nil
+		}
+
+		// the transport still holds the event, queueing it as well would deliver it twice
+		if _, ok := err.(*PendingError); ok {
+			logger.WithError(err).WithField("device-id", d.DeviceID).Warnln("publish pending, event is not queued in outbox")
+			return nil
+		}
+
+		logger.WithError(err).WithField("device-id", d.DeviceID).Warnln("publish failed, queueing event in outbox")
+	}
+
+	if err := d.Outbox.Put(topic, payload); err != nil {
+		return err
+	}
+
+	d.kickOutbox()
+	return nil
+}
+
+func (d *Device) kickOutbox() {
+	select {
+	case d.outboxKick <- struct{}{}:
+	default:
+	}
+}
+
+// drainOutbox replays the outbox when kicked, after reconnects and every outboxRetryInterval until ctx is done
+func (d *Device) drainOutbox(ctx context.Context, kick <-chan struct{}) {
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+
+	publish := func(topic string, payload []byte) error {
+		err := d.Transport.Publish(ctx, topic, payload)
+		if _, ok := err.(*PendingError); ok {
+			// the transport sends the entry once reconnected, it leaves the outbox so it is not replayed twice
+			logger.WithError(err).WithField("device-id", d.DeviceID).Debugln("replayed entry pending")
+			return nil
+		}
+
+		return err
+	}
+
+	for {
+		if d.Outbox.Len() > 0 {
+			n, err := d.Outbox.Replay(publish)
+			for i := 0; i < n; i++ {
+				d.recordPublish(nil)
+			}
+
+			entry := logger.WithField("device-id", d.DeviceID).WithField("replayed", n).WithField("queued", d.Outbox.Len())
+			if err != nil {
+				entry.WithError(err).Debugln("outbox replay interrupted")
+			} else if n > 0 {
+				entry.Infoln("replayed outbox")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-kick:
+		case <-ticker.C:
+		}
+	}
+}
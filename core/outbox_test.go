@@ -0,0 +1,175 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestOutbox opens an outbox in a temp dir that is removed with the test
+func newTestOutbox(t *testing.T, maxBytes int64, maxAge time.Duration) *Outbox {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "perch-outbox")
+	if err != nil {
+		t.Fatalf("error creating temp dir %s", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	outbox, err := OpenOutbox(dir, maxBytes, maxAge)
+	if err != nil {
+		t.Fatalf("OpenOutbox() error %s", err)
+	}
+
+	return outbox
+}
+
+func putEntries(t *testing.T, outbox *Outbox, payloads ...string) {
+	t.Helper()
+
+	for _, payload := range payloads {
+		if err := outbox.Put("/devices/d1/events", []byte(payload)); err != nil {
+			t.Fatalf("Put(%s) error %s", payload, err)
+		}
+	}
+}
+
+func TestOutboxReplay(t *testing.T) {
+	outbox := newTestOutbox(t, 0, 0)
+	putEntries(t, outbox, "1", "2", "3", "4", "5")
+
+	var published []string
+	failAt := "3"
+	publish := func(topic string, payload []byte) error {
+		if string(payload) == failAt {
+			return fmt.Errorf("broker unavailable")
+		}
+
+		published = append(published, string(payload))
+		return nil
+	}
+
+	n, err := outbox.Replay(publish)
+	if err == nil || n != 2 || outbox.Len() != 3 {
+		t.Fatalf("Replay() = %d %v with %d queued, want 2 published, an error and 3 queued", n, err, outbox.Len())
+	}
+
+	// entries survive a restart and keep their order
+	reopened, err := OpenOutbox(outbox.Dir, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenOutbox() error %s", err)
+	}
+
+	putEntries(t, reopened, "6")
+	failAt = ""
+	n, err = reopened.Replay(publish)
+	if err != nil || n != 4 {
+		t.Fatalf("Replay() = %d %v, want 4 published", n, err)
+	}
+
+	if want := []string{"1", "2", "3", "4", "5", "6"}; !reflect.DeepEqual(published, want) {
+		t.Errorf("published %v, want %v", published, want)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(outbox.Dir, "*.json")); len(files) != 0 || reopened.Len() != 0 {
+		t.Errorf("%d entry files and %d entries left after replay, want none", len(files), reopened.Len())
+	}
+}
+
+func TestOutboxEviction(t *testing.T) {
+	// an entry holding a single digit payload takes this many bytes on disk
+	probe := newTestOutbox(t, 0, 0)
+	putEntries(t, probe, "1")
+	entrySize := probe.size
+
+	cases := []struct {
+		name     string
+		maxBytes int64
+		maxAge   time.Duration
+		wait     time.Duration
+		want     []string
+	}{
+		{name: "unbounded", want: []string{"1", "2", "3", "4"}},
+		{name: "oldest entries dropped past max bytes", maxBytes: 2*entrySize + entrySize/2, want: []string{"3", "4"}},
+		{name: "newest entry kept even when larger than max bytes", maxBytes: 1, want: []string{"4"}},
+		{name: "expired entries dropped on replay", maxAge: 20 * time.Millisecond, wait: 40 * time.Millisecond, want: []string{"4"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			outbox := newTestOutbox(t, tc.maxBytes, tc.maxAge)
+			putEntries(t, outbox, "1", "2", "3")
+			time.Sleep(tc.wait)
+			putEntries(t, outbox, "4")
+
+			var published []string
+			_, err := outbox.Replay(func(topic string, payload []byte) error {
+				published = append(published, string(payload))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Replay() error %s", err)
+			}
+
+			if !reflect.DeepEqual(published, tc.want) {
+				t.Errorf("published %v, want %v", published, tc.want)
+			}
+
+			if files, _ := filepath.Glob(filepath.Join(outbox.Dir, "*.json")); len(files) != 0 {
+				t.Errorf("%d entry files left, want evicted entries removed from disk", len(files))
+			}
+		})
+	}
+}
+
+func TestDevicePublishOrQueue(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+	device.Outbox = newTestOutbox(t, 0, 0)
+	device.Transport = NewMemoryTransport(broker)
+
+	var received []string
+	broker.Subscribe("/devices/d1/events", func(_ string, payload []byte) {
+		received = append(received, string(payload))
+	})
+
+	// the transport is not connected, events are queued instead of failing the session
+	for _, payload := range []string{"1", "2"} {
+		if err := device.publishOrQueue(ctx, "/devices/d1/events", []byte(payload)); err != nil {
+			t.Fatalf("publishOrQueue() error %s", err)
+		}
+	}
+
+	if err := device.Transport.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error %s", err)
+	}
+
+	// newer events queue behind older ones until the outbox is drained
+	if err := device.publishOrQueue(ctx, "/devices/d1/events", []byte("3")); err != nil {
+		t.Fatalf("publishOrQueue() error %s", err)
+	}
+
+	if len(received) != 0 || device.Outbox.Len() != 3 {
+		t.Fatalf("received %v with %d queued, want everything queued", received, device.Outbox.Len())
+	}
+
+	if _, err := device.Outbox.Replay(func(topic string, payload []byte) error {
+		return device.Transport.Publish(ctx, topic, payload)
+	}); err != nil {
+		t.Fatalf("Replay() error %s", err)
+	}
+
+	if err := device.publishOrQueue(ctx, "/devices/d1/events", []byte("4")); err != nil {
+		t.Fatalf("publishOrQueue() error %s", err)
+	}
+
+	if want := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(received, want) || device.Outbox.Len() != 0 {
+		t.Errorf("received %v with %d queued, want %v", received, device.Outbox.Len(), want)
+	}
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"github.com/satori/go.uuid"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// seeds hands every new device the seed of its own random stream, concurrent sessions never share a source
+var seeds = struct {
+	rng *rand.Rand
+	sync.Mutex
+}{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Seed restarts the stream device seeds are drawn from. Devices created in the same order after the same
+// seed draw the same IDs, sessions and events
+func Seed(seed int64) {
+	seeds.Lock()
+	seeds.rng = rand.New(rand.NewSource(seed))
+	seeds.Unlock()
+}
+
+// NewRand returns a random stream seeded from the stream Seed sets, it is not safe for concurrent use
+func NewRand() *rand.Rand {
+	seeds.Lock()
+	defer seeds.Unlock()
+
+	return rand.New(rand.NewSource(seeds.rng.Int63()))
+}
+
+// randomUUID returns a version 4 uuid drawn from rng
+func randomUUID(rng *rand.Rand) uuid.UUID {
+	var u uuid.UUID
+	_, _ = rng.Read(u[:])
+	u.SetVersion(uuid.V4)
+	u.SetVariant(uuid.VariantRFC4122)
+	return u
+}
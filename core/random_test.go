@@ -0,0 +1,42 @@
+package core
+
+import (
+	"github.com/kc1116/perch-interactive-challenge/core/protos"
+	"testing"
+)
+
+// simulate returns the device ID, session ID and events a device created after Seed(seed) draws
+func simulate(seed int64) (string, string, []*protos.Event) {
+	Seed(seed)
+	device := NewDevice(NewClients(), "perch-test", "us-central1", "perch-test", testRegistryPath)
+	session := NewSession(device.DeviceID, nil, DefaultSessionConfig(), device.Rand(), WallClock())
+	session.stopTicks()
+
+	mix := InteractionMix{protos.INTERACTION_TYPE_PICK_UP: 1, protos.INTERACTION_TYPE_SCREEN_TOUCH: 2}
+	events := make([]*protos.Event, 20)
+	for i := range events {
+		events[i] = RandomEvent(device.Rand(), shoes, mix)
+		// timestamps are the only field not drawn from the stream
+		events[i].Timestamp = nil
+	}
+
+	return device.DeviceID, session.ID, events
+}
+
+func TestSeed(t *testing.T) {
+	deviceID, sessionID, events := simulate(42)
+	againDeviceID, againSessionID, againEvents := simulate(42)
+	if deviceID != againDeviceID || sessionID != againSessionID {
+		t.Fatalf("device %s session %s after the same seed, want device %s session %s", againDeviceID, againSessionID, deviceID, sessionID)
+	}
+
+	for i := range events {
+		if events[i].String() != againEvents[i].String() {
+			t.Fatalf("event %d after the same seed = %s, want %s", i, againEvents[i], events[i])
+		}
+	}
+
+	if otherDeviceID, _, _ := simulate(43); otherDeviceID == deviceID {
+		t.Errorf("device %s after another seed, want another device ID", otherDeviceID)
+	}
+}
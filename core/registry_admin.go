@@ -0,0 +1,230 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/cloudiot/v1"
+	"strings"
+)
+
+const (
+	LogLevelNone  = "NONE"
+	LogLevelError = "ERROR"
+	LogLevelInfo  = "INFO"
+	LogLevelDebug = "DEBUG"
+
+	mqttEnabled  = "MQTT_ENABLED"
+	mqttDisabled = "MQTT_DISABLED"
+	httpEnabled  = "HTTP_ENABLED"
+	httpDisabled = "HTTP_DISABLED"
+)
+
+// Update mask paths of the registry fields RegistrySettings describes
+const (
+	RegistryFieldEventTopics = "event_notification_configs"
+	RegistryFieldStateTopic  = "state_notification_config"
+	RegistryFieldMQTT        = "mqtt_config"
+	RegistryFieldHTTP        = "http_config"
+	RegistryFieldLogLevel    = "log_level"
+)
+
+// RegistrySettings are the registry options that can be provisioned, topics are full topic names.
+// EventTopic receives the events none of the EventRoutes match
+type RegistrySettings struct {
+	EventTopic  string
+	EventRoutes []EventRoute
+	StateTopic  string
+	MQTTEnabled bool
+	HTTPEnabled bool
+	LogLevel    string
+}
+
+// DefaultRegistrySettings returns the settings registries are created with when nothing else is asked for
+func DefaultRegistrySettings(eventTopic string) *RegistrySettings {
+	return &RegistrySettings{
+		EventTopic:  eventTopic,
+		MQTTEnabled: true,
+		HTTPEnabled: true,
+	}
+}
+
+func (s *RegistrySettings) registry(registryID string) *cloudiot.DeviceRegistry {
+	registry := &cloudiot.DeviceRegistry{
+		Id:                       registryID,
+		MqttConfig:               &cloudiot.MqttConfig{MqttEnabledState: mqttDisabled},
+		HttpConfig:               &cloudiot.HttpConfig{HttpEnabledState: httpDisabled},
+		LogLevel:                 s.LogLevel,
+		EventNotificationConfigs: eventNotificationConfigs(s.EventTopic, s.EventRoutes),
+	}
+
+	if s.StateTopic != "" {
+		registry.StateNotificationConfig = &cloudiot.StateNotificationConfig{PubsubTopicName: s.StateTopic}
+	}
+
+	if s.MQTTEnabled {
+		registry.MqttConfig.MqttEnabledState = mqttEnabled
+	}
+
+	if s.HTTPEnabled {
+		registry.HttpConfig.HttpEnabledState = httpEnabled
+	}
+
+	return registry
+}
+
+// ValidLogLevel reports whether level is a registry log level
+func ValidLogLevel(level string) bool {
+	switch level {
+	case LogLevelNone, LogLevelError, LogLevelInfo, LogLevelDebug:
+		return true
+	}
+
+	return false
+}
+
+// CreateRegistryWithSettings creates the device Registry configured by settings
+func (d *DeviceRegistry) CreateRegistryWithSettings(ctx context.Context, settings *RegistrySettings) (*cloudiot.DeviceRegistry, error) {
+	registry, err := d.Client.Projects.Locations.Registries.Create(d.parent, settings.registry(d.RegistryID)).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	d.Registry = registry
+	return registry, nil
+}
+
+// UpdateRegistry changes the fields of the Registry named by the RegistryField paths to their value in settings
+func (d *DeviceRegistry) UpdateRegistry(ctx context.Context, settings *RegistrySettings, fields ...string) (*cloudiot.DeviceRegistry, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no registry field to update")
+	}
+
+	registry, err := d.Client.Projects.Locations.Registries.
+		Patch(d.RegistryName(), settings.registry(d.RegistryID)).
+		UpdateMask(strings.Join(fields, ",")).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	d.Registry = registry
+	return registry, nil
+}
+
+// DeleteRegistry deletes the Registry, registries that still have devices can only be deleted with force
+// which unbinds and deletes every device first
+func (d *DeviceRegistry) DeleteRegistry(ctx context.Context, force bool) error {
+	if force {
+		if err := d.deleteDevices(ctx); err != nil {
+			return err
+		}
+	}
+
+	_, err := d.Client.Projects.Locations.Registries.Delete(d.RegistryName()).Context(ctx).Do()
+	return err
+}
+
+func (d *DeviceRegistry) deleteDevices(ctx context.Context) error {
+	devices, err := d.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if !IsGateway(device) {
+			continue
+		}
+
+		err = d.Client.Projects.Locations.Registries.Devices.List(d.RegistryName()).
+			GatewayListOptionsAssociationsGatewayId(device.Id).
+			Pages(ctx, func(resp *cloudiot.ListDevicesResponse) error {
+				for _, bound := range resp.Devices {
+					if err := d.UnbindDeviceFromGateway(ctx, device.Id, bound.Id); err != nil {
+						return fmt.Errorf("error unbinding %s from %s: %s", bound.Id, device.Id, err)
+					}
+				}
+
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, device := range devices {
+		if err = d.DeleteDevice(ctx, device.Id); err != nil {
+			return fmt.Errorf("error deleting %s: %s", device.Id, err)
+		}
+
+		logger.WithField("device-id", device.Id).Infoln("deleted device")
+	}
+
+	return nil
+}
+
+// RegistryTopics returns the full names of the topics registry publishes events and state to
+func RegistryTopics(registry *cloudiot.DeviceRegistry) []string {
+	names := make([]string, 0, len(registry.EventNotificationConfigs)+1)
+	for _, config := range registry.EventNotificationConfigs {
+		names = append(names, config.PubsubTopicName)
+	}
+
+	if registry.StateNotificationConfig != nil {
+		names = append(names, registry.StateNotificationConfig.PubsubTopicName)
+	}
+
+	// several routes may share a topic
+	var topics []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			topics = append(topics, name)
+		}
+	}
+
+	return topics
+}
+
+// DeleteTopic deletes the topic with the full name topicName, it has to be in the project of the registry
+func (d *DeviceRegistry) DeleteTopic(ctx context.Context, topicName string) error {
+	topicID, err := TopicID(d.projectID, topicName)
+	if err != nil {
+		return err
+	}
+
+	return d.PubSubClient.Topic(topicID).Delete(ctx)
+}
+
+// TopicName returns the full name of topicID, names that are already full are returned as is
+func TopicName(projectID, topicID string) string {
+	if strings.HasPrefix(topicID, "projects/") {
+		return topicID
+	}
+
+	return fmt.Sprintf("projects/%s/topics/%s", projectID, topicID)
+}
+
+// TopicID returns the ID of a topic given by ID or full name, the Pub/Sub client only reaches topics of
+// projectID so full names of topics in other projects are refused
+func TopicID(projectID, topicName string) (string, error) {
+	if !strings.HasPrefix(topicName, "projects/") {
+		if strings.Contains(topicName, "/") {
+			return "", fmt.Errorf("invalid topic %s", topicName)
+		}
+
+		return topicName, nil
+	}
+
+	parts := strings.Split(topicName, "/")
+	if len(parts) != 4 || parts[2] != "topics" || parts[3] == "" {
+		return "", fmt.Errorf("invalid topic name %s", topicName)
+	}
+
+	if parts[1] != projectID {
+		return "", fmt.Errorf("topic %s is not in project %s", topicName, projectID)
+	}
+
+	return parts[3], nil
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestTopicID(t *testing.T) {
+	cases := []struct {
+		topic   string
+		want    string
+		wantErr bool
+	}{
+		{topic: "perch-events", want: "perch-events"},
+		{topic: "projects/perch-test/topics/perch-events", want: "perch-events"},
+		{topic: "projects/other-project/topics/perch-events", wantErr: true},
+		{topic: "projects/perch-test/subscriptions/perch-events", wantErr: true},
+		{topic: "projects/perch-test/topics/", wantErr: true},
+		{topic: "topics/perch-events", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		got, err := TopicID("perch-test", tc.topic)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("TopicID(%q) = %s, want error", tc.topic, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tc.want {
+			t.Errorf("TopicID(%q) = %s %v, want %s", tc.topic, got, err, tc.want)
+		}
+
+		if name := TopicName("perch-test", got); name != "projects/perch-test/topics/"+tc.want {
+			t.Errorf("TopicName(%q) = %s, want the full name in perch-test", got, name)
+		}
+	}
+}
+
+func TestRegistrySettings(t *testing.T) {
+	settings := &RegistrySettings{
+		EventTopic:  "projects/perch-test/topics/events",
+		StateTopic:  "projects/perch-test/topics/state",
+		MQTTEnabled: true,
+		LogLevel:    LogLevelInfo,
+	}
+
+	registry := settings.registry("perch-test")
+	if registry.Id != "perch-test" || registry.LogLevel != LogLevelInfo {
+		t.Errorf("registry %s with log level %s, want perch-test at %s", registry.Id, registry.LogLevel, LogLevelInfo)
+	}
+
+	if registry.MqttConfig.MqttEnabledState != mqttEnabled || registry.HttpConfig.HttpEnabledState != httpDisabled {
+		t.Errorf("registry mqtt %s and http %s, want mqtt enabled and http disabled", registry.MqttConfig.MqttEnabledState, registry.HttpConfig.HttpEnabledState)
+	}
+
+	topics := RegistryTopics(registry)
+	if len(topics) != 2 || topics[0] != settings.EventTopic || topics[1] != settings.StateTopic {
+		t.Errorf("RegistryTopics() = %v, want the event and state topics", topics)
+	}
+
+	if topics := RegistryTopics((&RegistrySettings{}).registry("perch-test")); len(topics) != 0 {
+		t.Errorf("RegistryTopics() without topics = %v, want none", topics)
+	}
+}
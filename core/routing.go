@@ -0,0 +1,101 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/cloudiot/v1"
+	"strings"
+)
+
+const (
+	SubFolderInteractions = "interactions"
+	SubFolderTelemetry    = "telemetry"
+	SubFolderDiagnostics  = "diagnostics"
+)
+
+// EventRoute sends the events devices publish to /devices/{id}/events/{SubFolder} to Topic,
+// the route with an empty SubFolder receives every event no other route matches
+type EventRoute struct {
+	SubFolder string `json:"subFolder"`
+	Topic     string `json:"topic"`
+}
+
+// ParseEventRoute parses a subfolder=topic route
+func ParseEventRoute(route string) (EventRoute, error) {
+	parts := strings.SplitN(route, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return EventRoute{}, fmt.Errorf("invalid route %s, expected subfolder=topic", route)
+	}
+
+	return EventRoute{SubFolder: parts[0], Topic: parts[1]}, nil
+}
+
+// EventRoutes returns the routes of registry, the default route comes last
+func EventRoutes(registry *cloudiot.DeviceRegistry) []EventRoute {
+	routes := make([]EventRoute, 0, len(registry.EventNotificationConfigs))
+	for _, config := range registry.EventNotificationConfigs {
+		routes = append(routes, EventRoute{SubFolder: config.SubfolderMatches, Topic: config.PubsubTopicName})
+	}
+
+	return routes
+}
+
+// eventNotificationConfigs converts routes to notification configs, IoT Core requires the config
+// without a subfolder to be the last one
+func eventNotificationConfigs(defaultTopic string, routes []EventRoute) []*cloudiot.EventNotificationConfig {
+	configs := make([]*cloudiot.EventNotificationConfig, 0, len(routes)+1)
+	for _, route := range routes {
+		if route.SubFolder == "" {
+			continue
+		}
+
+		configs = append(configs, &cloudiot.EventNotificationConfig{
+			SubfolderMatches: route.SubFolder,
+			PubsubTopicName:  route.Topic,
+		})
+	}
+
+	if defaultTopic != "" {
+		configs = append(configs, &cloudiot.EventNotificationConfig{PubsubTopicName: defaultTopic})
+	}
+
+	return configs
+}
+
+// TopicFor returns the full name of the topic events published to subFolder are routed to
+func (d *DeviceRegistry) TopicFor(subFolder string) string {
+	if d.Registry == nil {
+		return ""
+	}
+
+	defaultTopic := ""
+	for _, route := range EventRoutes(d.Registry) {
+		if route.SubFolder == "" {
+			defaultTopic = route.Topic
+		} else if route.SubFolder == subFolder {
+			return route.Topic
+		}
+	}
+
+	return defaultTopic
+}
+
+// EnsureRouteTopics creates the topics of routes that do not exist yet and returns the routes with full topic names,
+// the topics have to be in the project of the registry
+func (d *DeviceRegistry) EnsureRouteTopics(ctx context.Context, routes []EventRoute) ([]EventRoute, error) {
+	ensured := make([]EventRoute, 0, len(routes))
+	for _, route := range routes {
+		topicID, err := TopicID(d.projectID, route.Topic)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = d.EnsureTopic(ctx, topicID); err != nil {
+			return nil, fmt.Errorf("error creating topic %s for %s: %s", route.Topic, route.SubFolder, err)
+		}
+
+		ensured = append(ensured, EventRoute{SubFolder: route.SubFolder, Topic: TopicName(d.projectID, topicID)})
+	}
+
+	return ensured, nil
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"google.golang.org/api/cloudiot/v1"
+	"reflect"
+	"testing"
+)
+
+func TestParseEventRoute(t *testing.T) {
+	cases := []struct {
+		route   string
+		want    EventRoute
+		wantErr bool
+	}{
+		{route: "telemetry=perch-telemetry", want: EventRoute{SubFolder: "telemetry", Topic: "perch-telemetry"}},
+		{route: "diagnostics=projects/perch-test/topics/diag", want: EventRoute{SubFolder: "diagnostics", Topic: "projects/perch-test/topics/diag"}},
+		{route: "telemetry", wantErr: true},
+		{route: "=perch-telemetry", wantErr: true},
+		{route: "telemetry=", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		got, err := ParseEventRoute(tc.route)
+		if tc.wantErr != (err != nil) {
+			t.Errorf("ParseEventRoute(%q) error %v, want error %t", tc.route, err, tc.wantErr)
+			continue
+		}
+
+		if got != tc.want {
+			t.Errorf("ParseEventRoute(%q) = %+v, want %+v", tc.route, got, tc.want)
+		}
+	}
+}
+
+func TestEventRouting(t *testing.T) {
+	routes := []EventRoute{
+		{SubFolder: SubFolderTelemetry, Topic: "projects/perch-test/topics/telemetry"},
+		{Topic: "projects/perch-test/topics/ignored"},
+		{SubFolder: SubFolderDiagnostics, Topic: "projects/perch-test/topics/diagnostics"},
+	}
+
+	// the route without a subfolder is replaced by the default topic which IoT Core wants last
+	configs := eventNotificationConfigs("projects/perch-test/topics/events", routes)
+	want := []*cloudiot.EventNotificationConfig{
+		{SubfolderMatches: SubFolderTelemetry, PubsubTopicName: "projects/perch-test/topics/telemetry"},
+		{SubfolderMatches: SubFolderDiagnostics, PubsubTopicName: "projects/perch-test/topics/diagnostics"},
+		{PubsubTopicName: "projects/perch-test/topics/events"},
+	}
+	if !reflect.DeepEqual(configs, want) {
+		t.Fatalf("eventNotificationConfigs() = %+v, want %+v", configs, want)
+	}
+
+	registry := NewDeviceRegistry(NewClients(), "perch-test", "us-central1", "perch-test", "events")
+	if got := registry.TopicFor(SubFolderTelemetry); got != "" {
+		t.Errorf("TopicFor() before the registry is loaded = %s, want none", got)
+	}
+
+	registry.Registry = &cloudiot.DeviceRegistry{EventNotificationConfigs: configs}
+	for subFolder, want := range map[string]string{
+		SubFolderTelemetry:    "projects/perch-test/topics/telemetry",
+		SubFolderDiagnostics:  "projects/perch-test/topics/diagnostics",
+		SubFolderInteractions: "projects/perch-test/topics/events",
+		"":                    "projects/perch-test/topics/events",
+	} {
+		if got := registry.TopicFor(subFolder); got != want {
+			t.Errorf("TopicFor(%q) = %s, want %s", subFolder, got, want)
+		}
+	}
+
+	if got := EventRoutes(registry.Registry); len(got) != 3 || got[2] != (EventRoute{Topic: "projects/perch-test/topics/events"}) {
+		t.Errorf("EventRoutes() = %+v, want the default route last", got)
+	}
+}
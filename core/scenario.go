@@ -0,0 +1,468 @@
+package core
+
+import (
+	"fmt"
+	"github.com/kc1116/perch-interactive-challenge/core/protos"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Distributions a duration can be drawn from
+const (
+	DistributionFixed       = "fixed"
+	DistributionUniform     = "uniform"
+	DistributionNormal      = "normal"
+	DistributionExponential = "exponential"
+)
+
+// Distribution describes how a duration is drawn. Fixed uses Value, uniform draws between Min and Max, normal
+// uses Mean and StdDev and exponential uses Mean. Samples of every distribution are clamped to Min and Max when set
+type Distribution struct {
+	Type   string        `yaml:"distribution"`
+	Value  time.Duration `yaml:"value,omitempty"`
+	Min    time.Duration `yaml:"min,omitempty"`
+	Max    time.Duration `yaml:"max,omitempty"`
+	Mean   time.Duration `yaml:"mean,omitempty"`
+	StdDev time.Duration `yaml:"stddev,omitempty"`
+}
+
+// Validate checks the parameters the distribution type needs are set
+func (d *Distribution) Validate() error {
+	if d.Min < 0 || d.Max < 0 || d.Value < 0 || d.Mean < 0 || d.StdDev < 0 {
+		return fmt.Errorf("durations can not be negative")
+	}
+
+	if d.Max > 0 && d.Max < d.Min {
+		return fmt.Errorf("max %s is shorter than min %s", d.Max, d.Min)
+	}
+
+	switch d.Type {
+	case DistributionFixed:
+		if d.Value <= 0 {
+			return fmt.Errorf("%s distribution needs a value", d.Type)
+		}
+	case DistributionUniform:
+		if d.Max <= 0 {
+			return fmt.Errorf("%s distribution needs a max", d.Type)
+		}
+	case DistributionNormal, DistributionExponential:
+		if d.Mean <= 0 {
+			return fmt.Errorf("%s distribution needs a mean", d.Type)
+		}
+	default:
+		return fmt.Errorf("invalid distribution %s, expected %s, %s, %s or %s",
+			d.Type, DistributionFixed, DistributionUniform, DistributionNormal, DistributionExponential)
+	}
+
+	return nil
+}
+
+// Sample draws a duration from rng rounded to the millisecond, it is never negative
+func (d *Distribution) Sample(rng *rand.Rand) time.Duration {
+	var sample time.Duration
+	switch d.Type {
+	case DistributionFixed:
+		sample = d.Value
+	case DistributionUniform:
+		sample = d.Min + time.Duration(rng.Int63n(int64(d.Max-d.Min)+1))
+	case DistributionNormal:
+		sample = d.Mean + time.Duration(rng.NormFloat64()*float64(d.StdDev))
+	case DistributionExponential:
+		sample = time.Duration(rng.ExpFloat64() * float64(d.Mean))
+	}
+
+	if sample < d.Min {
+		sample = d.Min
+	}
+
+	if d.Max > 0 && sample > d.Max {
+		sample = d.Max
+	}
+
+	if sample < 0 {
+		return 0
+	}
+
+	return sample.Round(time.Millisecond)
+}
+
+// InteractionMix weights how often each interaction type is picked
+type InteractionMix map[protos.INTERACTION_TYPE]float64
+
+// ParseInteractionMix converts weights keyed by interaction type name e.g. PICK_UP
+func ParseInteractionMix(weights map[string]float64) (InteractionMix, error) {
+	mix := make(InteractionMix, len(weights))
+	total := 0.0
+	for name, weight := range weights {
+		value, ok := protos.INTERACTION_TYPE_value[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid interaction type %s", name)
+		}
+
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("invalid weight %v for %s", weight, name)
+		}
+
+		mix[protos.INTERACTION_TYPE(value)] = weight
+		total += weight
+	}
+
+	if len(weights) > 0 && total <= 0 {
+		return nil, fmt.Errorf("interaction weights add up to 0")
+	}
+
+	return mix, nil
+}
+
+// Pick draws an interaction type from rng in proportion to its weight
+func (m InteractionMix) Pick(rng *rand.Rand) protos.INTERACTION_TYPE {
+	// map order is random, walk the types in a fixed order
+	types := make([]protos.INTERACTION_TYPE, 0, len(m))
+	total := 0.0
+	for interaction, weight := range m {
+		types = append(types, interaction)
+		total += weight
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	n := rng.Float64() * total
+	for _, interaction := range types {
+		if n < m[interaction] {
+			return interaction
+		}
+
+		n -= m[interaction]
+	}
+
+	return types[len(types)-1]
+}
+
+// ActivityWindow sets how busy a store is from From until To, times are HH:MM local to the store.
+// Windows that end before they start run over midnight
+type ActivityWindow struct {
+	From     string  `yaml:"from"`
+	To       string  `yaml:"to"`
+	Activity float64 `yaml:"activity"`
+	from, to int
+}
+
+func (w *ActivityWindow) contains(minute int) bool {
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+
+	return minute >= w.from || minute < w.to
+}
+
+// ActivityProfile describes how busy a store is over the day, 1 is full traffic and 0 closed. The first
+// window containing a time wins, Default applies outside every window
+type ActivityProfile struct {
+	Windows []*ActivityWindow `yaml:"hours"`
+	Default float64           `yaml:"default"`
+}
+
+// Validate parses the window times and checks the store is open at some point
+func (p *ActivityProfile) Validate() error {
+	open := p.Default > 0
+	if p.Default < 0 {
+		return fmt.Errorf("invalid default activity %v", p.Default)
+	}
+
+	for _, window := range p.Windows {
+		var err error
+		if window.from, err = parseClock(window.From); err != nil {
+			return err
+		}
+
+		if window.to, err = parseClock(window.To); err != nil {
+			return err
+		}
+
+		if window.from == window.to {
+			return fmt.Errorf("window %s-%s is empty", window.From, window.To)
+		}
+
+		if window.Activity < 0 {
+			return fmt.Errorf("invalid activity %v for %s-%s", window.Activity, window.From, window.To)
+		}
+
+		open = open || window.Activity > 0
+	}
+
+	if !open {
+		return fmt.Errorf("activity is 0 all day")
+	}
+
+	return nil
+}
+
+// Activity returns how busy the store is at t, t must be in the timezone of the store
+func (p *ActivityProfile) Activity(t time.Time) float64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range p.Windows {
+		if window.contains(minute) {
+			return window.Activity
+		}
+	}
+
+	return p.Default
+}
+
+// NextActive returns the first minute from t on that has activity, t itself when the store is open
+func (p *ActivityProfile) NextActive(t time.Time) time.Time {
+	next := t
+	for i := 0; i <= 24*60; i++ {
+		if p.Activity(next) > 0 {
+			return next
+		}
+
+		next = next.Truncate(time.Minute).Add(time.Minute)
+	}
+
+	return t
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", clock)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// SessionSpec describes the sessions of a device group. Duration and TickInterval default to the simulator
+// ranges, Idle is the time a device waits before each session and every interaction type is equally likely
+// when Interactions is empty. Shopper sessions publish as their shopper moves instead of every tick
+type SessionSpec struct {
+	Duration     *Distribution      `yaml:"duration"`
+	TickInterval *Distribution      `yaml:"tickInterval"`
+	Idle         *Distribution      `yaml:"idle"`
+	Interactions map[string]float64 `yaml:"interactions"`
+	Shopper      *ShopperModel      `yaml:"shopper"`
+}
+
+// DeviceGroup is a set of identical devices, each runs Sessions sessions one after another
+type DeviceGroup struct {
+	Name     string         `yaml:"name"`
+	Devices  int            `yaml:"devices"`
+	Sessions int            `yaml:"sessions"`
+	Metadata DeviceMetadata `yaml:",inline"`
+	// Catalog names a catalog of the scenario, Products lists the products inline. Groups setting neither
+	// draw from the product catalog of the scenario, limited to Categories when set
+	Catalog    string      `yaml:"catalog"`
+	Products   []string    `yaml:"products"`
+	Categories []string    `yaml:"categories"`
+	Profile    string      `yaml:"profile"`
+	Session    SessionSpec `yaml:"session"`
+	profile    *ActivityProfile
+	location   *time.Location
+	config     SessionConfig
+}
+
+// SessionConfig returns the config the devices of the group start sessions with
+func (g *DeviceGroup) SessionConfig() SessionConfig {
+	return g.config
+}
+
+// IdleTime draws from rng how long a device of the group waits at now before its next session. Idle time is
+// stretched by how quiet the store is and devices of closed stores wait for them to open first
+func (g *DeviceGroup) IdleTime(rng *rand.Rand, now time.Time) time.Duration {
+	local := now.In(g.location)
+	var wait time.Duration
+	if g.profile != nil {
+		next := g.profile.NextActive(local)
+		wait = next.Sub(local)
+		local = next
+	}
+
+	if g.Session.Idle == nil {
+		return wait
+	}
+
+	idle := g.Session.Idle.Sample(rng)
+	if g.profile != nil {
+		idle = time.Duration(float64(idle) / g.profile.Activity(local))
+	}
+
+	return wait + idle
+}
+
+// Scenario describes the devices a simulation runs and the traffic they generate. ProductCatalog is the path
+// of a csv or json product catalog relative to the scenario file, LoadScenario loads it into Catalog
+type Scenario struct {
+	Name           string                      `yaml:"name"`
+	ProductCatalog string                      `yaml:"productCatalog"`
+	Catalog        *Catalog                    `yaml:"-"`
+	Catalogs       map[string][]string         `yaml:"catalogs"`
+	Profiles       map[string]*ActivityProfile `yaml:"profiles"`
+	Groups         []*DeviceGroup              `yaml:"groups"`
+}
+
+// Validate checks every group and resolves the catalogs and profiles they refer to
+func (s *Scenario) Validate() error {
+	for name, catalog := range s.Catalogs {
+		if len(catalog) == 0 {
+			return fmt.Errorf("catalog %s is empty", name)
+		}
+	}
+
+	for name, profile := range s.Profiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("profile %s: %s", name, err)
+		}
+	}
+
+	if len(s.Groups) == 0 {
+		return fmt.Errorf("scenario has no device groups")
+	}
+
+	names := make(map[string]bool)
+	for i, group := range s.Groups {
+		if group.Name == "" {
+			group.Name = fmt.Sprintf("group-%d", i)
+		}
+
+		if names[group.Name] {
+			return fmt.Errorf("group %s is defined twice", group.Name)
+		}
+		names[group.Name] = true
+
+		if err := s.validateGroup(group); err != nil {
+			return fmt.Errorf("group %s: %s", group.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Scenario) validateGroup(g *DeviceGroup) error {
+	if g.Devices < 1 {
+		return fmt.Errorf("invalid value for devices %d", g.Devices)
+	}
+
+	if g.Sessions < 0 {
+		return fmt.Errorf("invalid value for sessions %d", g.Sessions)
+	} else if g.Sessions == 0 {
+		g.Sessions = 1
+	}
+
+	if err := g.Metadata.Validate(); err != nil {
+		return err
+	}
+
+	g.location = time.UTC
+	if g.Metadata.Timezone != "" {
+		g.location, _ = time.LoadLocation(g.Metadata.Timezone)
+	}
+
+	if g.Profile != "" {
+		if g.profile = s.Profiles[g.Profile]; g.profile == nil {
+			return fmt.Errorf("profile %s is not defined", g.Profile)
+		}
+	}
+
+	g.config = DefaultSessionConfig()
+	switch {
+	case g.Catalog != "" && len(g.Products) > 0:
+		return fmt.Errorf("set either catalog or products")
+	case len(g.Categories) > 0 && (s.Catalog == nil || g.Catalog != "" || len(g.Products) > 0):
+		return fmt.Errorf("categories only apply to the productCatalog of the scenario")
+	case g.Catalog != "":
+		if g.config.Products = s.Catalogs[g.Catalog]; g.config.Products == nil {
+			return fmt.Errorf("catalog %s is not defined", g.Catalog)
+		}
+	case len(g.Products) > 0:
+		g.config.Products = g.Products
+	case s.Catalog != nil:
+		catalog, err := s.Catalog.Filter(g.Categories)
+		if err != nil {
+			return err
+		}
+
+		g.config.Catalog = catalog
+	}
+
+	for name, distribution := range map[string]*Distribution{
+		"duration":     g.Session.Duration,
+		"tickInterval": g.Session.TickInterval,
+		"idle":         g.Session.Idle,
+	} {
+		if distribution == nil {
+			continue
+		}
+
+		if err := distribution.Validate(); err != nil {
+			return fmt.Errorf("session %s: %s", name, err)
+		}
+	}
+
+	if g.Session.TickInterval != nil && g.Session.TickInterval.Min <= 0 && g.Session.TickInterval.Type != DistributionFixed {
+		return fmt.Errorf("session tickInterval needs a min above 0")
+	}
+
+	mix, err := ParseInteractionMix(g.Session.Interactions)
+	if err != nil {
+		return fmt.Errorf("session interactions: %s", err)
+	}
+
+	if g.Session.Shopper != nil {
+		if g.Session.TickInterval != nil || len(mix) > 0 {
+			return fmt.Errorf("set either shopper or tickInterval and interactions")
+		}
+
+		if err = g.Session.Shopper.Validate(); err != nil {
+			return fmt.Errorf("session shopper: %s", err)
+		}
+	}
+
+	g.config.Duration = g.Session.Duration
+	g.config.Tick = g.Session.TickInterval
+	g.config.Interactions = mix
+	g.config.Shopper = g.Session.Shopper
+	return nil
+}
+
+// Devices returns the number of devices of every group
+func (s *Scenario) Devices() int {
+	n := 0
+	for _, group := range s.Groups {
+		n += group.Devices
+	}
+
+	return n
+}
+
+// LoadScenario reads and validates a yaml scenario file, json files work as well
+func LoadScenario(path string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scenario %s", err)
+	}
+
+	scenario := &Scenario{}
+	if err = yaml.UnmarshalStrict(b, scenario); err != nil {
+		return nil, fmt.Errorf("error decoding scenario %s: %s", path, err)
+	}
+
+	if catalog := scenario.ProductCatalog; catalog != "" {
+		if !filepath.IsAbs(catalog) {
+			catalog = filepath.Join(filepath.Dir(path), catalog)
+		}
+
+		if scenario.Catalog, err = LoadCatalog(catalog); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = scenario.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %s", path, err)
+	}
+
+	return scenario, nil
+}
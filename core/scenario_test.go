@@ -0,0 +1,124 @@
+package core
+
+import (
+	"github.com/kc1116/perch-interactive-challenge/core/protos"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScenarioValidate(t *testing.T) {
+	group := func() *DeviceGroup {
+		return &DeviceGroup{Devices: 1, Catalog: "running", Profile: "store-hours"}
+	}
+
+	cases := []struct {
+		name    string
+		change  func(s *Scenario)
+		wantErr string
+	}{
+		{name: "valid", change: func(s *Scenario) {}},
+		{name: "no groups", change: func(s *Scenario) { s.Groups = nil }, wantErr: "no device groups"},
+		{name: "no devices", change: func(s *Scenario) { s.Groups[0].Devices = 0 }, wantErr: "invalid value for devices"},
+		{name: "negative sessions", change: func(s *Scenario) { s.Groups[0].Sessions = -1 }, wantErr: "invalid value for sessions"},
+		{name: "duplicate group", change: func(s *Scenario) {
+			s.Groups = append(s.Groups, group())
+			s.Groups[0].Name, s.Groups[1].Name = "entrance", "entrance"
+		}, wantErr: "defined twice"},
+		{name: "unknown catalog", change: func(s *Scenario) { s.Groups[0].Catalog = "dress" }, wantErr: "catalog dress is not defined"},
+		{name: "catalog and products", change: func(s *Scenario) { s.Groups[0].Products = []string{"Oxfords"} }, wantErr: "either catalog or products"},
+		{name: "empty catalog", change: func(s *Scenario) { s.Catalogs["dress"] = nil }, wantErr: "catalog dress is empty"},
+		{name: "unknown profile", change: func(s *Scenario) { s.Groups[0].Profile = "weekend" }, wantErr: "profile weekend is not defined"},
+		{name: "closed all day", change: func(s *Scenario) { s.Profiles["store-hours"].Windows[0].Activity = 0 }, wantErr: "activity is 0 all day"},
+		{name: "invalid window", change: func(s *Scenario) { s.Profiles["store-hours"].Windows[0].To = "25:00" }, wantErr: "invalid time 25:00"},
+		{name: "unknown timezone", change: func(s *Scenario) { s.Groups[0].Metadata.Timezone = "Mars/Olympus_Mons" }, wantErr: "Mars/Olympus_Mons"},
+		{name: "distribution without mean", change: func(s *Scenario) {
+			s.Groups[0].Session.Duration = &Distribution{Type: DistributionNormal}
+		}, wantErr: "needs a mean"},
+		{name: "tick interval without min", change: func(s *Scenario) {
+			s.Groups[0].Session.TickInterval = &Distribution{Type: DistributionUniform, Max: time.Second}
+		}, wantErr: "needs a min above 0"},
+		{name: "unknown interaction", change: func(s *Scenario) {
+			s.Groups[0].Session.Interactions = map[string]float64{"WAVE": 1}
+		}, wantErr: "invalid interaction type WAVE"},
+		{name: "zero interaction weights", change: func(s *Scenario) {
+			s.Groups[0].Session.Interactions = map[string]float64{"PICK_UP": 0}
+		}, wantErr: "add up to 0"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			scenario := &Scenario{
+				Catalogs: map[string][]string{"running": {"Athletic"}},
+				Profiles: map[string]*ActivityProfile{
+					"store-hours": {Windows: []*ActivityWindow{{From: "09:00", To: "21:00", Activity: 1}}},
+				},
+				Groups: []*DeviceGroup{group()},
+			}
+			tc.change(scenario)
+
+			err := scenario.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() error %s", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Validate() error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadScenario(t *testing.T) {
+	scenario, err := LoadScenario(filepath.Join("..", "build", "scenarios", "weekday.yaml"))
+	if err != nil {
+		t.Fatalf("LoadScenario() error %s", err)
+	}
+
+	if len(scenario.Groups) != 3 || scenario.Devices() != 4 {
+		t.Fatalf("LoadScenario() groups %d with %d devices, want 3 groups with 4 devices", len(scenario.Groups), scenario.Devices())
+	}
+
+	entrance := scenario.Groups[0]
+	if entrance.Metadata.StoreID != "nyc-01" || entrance.Session.Duration.Mean != time.Minute {
+		t.Errorf("group %s store %s duration %+v, want nyc-01 with a mean of 1m", entrance.Name, entrance.Metadata.StoreID, entrance.Session.Duration)
+	}
+
+	config := entrance.SessionConfig()
+	if len(config.Products) != 3 || config.Interactions[protos.INTERACTION_TYPE_PICK_UP] != 3 {
+		t.Errorf("SessionConfig() = %+v, want the running catalog and the interaction mix", config)
+	}
+
+	// la-wall is closed at 07:00 local time and waits for the store to open before its idle time
+	now := time.Date(2020, 1, 6, 15, 0, 0, 0, time.UTC)
+	if idle := scenario.Groups[1].IdleTime(rand.New(rand.NewSource(1)), now); idle != 2*time.Hour+2*time.Minute {
+		t.Errorf("IdleTime() at 07:00 = %s, want 2h to opening plus 1m idle at half activity", idle)
+	}
+
+	dir, err := ioutil.TempDir("", "perch-scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	// fields are decoded strictly, a typo fails instead of being ignored
+	path := filepath.Join(dir, "typo.yaml")
+	if err := ioutil.WriteFile(path, []byte("groups:\n  - devices: 1\n    sesions: 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadScenario(path); err == nil || !strings.Contains(err.Error(), "sesions") {
+		t.Errorf("LoadScenario() of an unknown field error %v, want it rejected", err)
+	}
+
+	if _, err := LoadScenario(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("LoadScenario() of a missing file succeeded, want error")
+	}
+}
@@ -1,16 +1,18 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	data "github.com/Pallinder/go-randomdata"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/kc1116/perch-interactive-challenge/core/protos"
-	"github.com/satori/go.uuid"
 	"math/rand"
 	"sync"
 	"time"
 )
 
+// screenButtons are the buttons of the product screen interactions can touch
+var screenButtons = []string{"size-chart", "colors", "reviews", "similar-styles", "in-store-availability", "add-to-cart"}
+
 var shoes = []string{"Ankle", "Athletic", "Boat Shoes", "Boot", "Clogs and Mules", "Crib Shoes", "Firstwalker", "Flat", "Flats", "Heel", "Heels", "Knee High", "Loafers", "Mid-Calf", "Over the Knee", "Oxfords", "Prewalker", "Prewalker Boots", "Slipper Flats", "Slipper Heels", "Sneakers and Athletic Shoes", "SubCategory"}
 
 const (
@@ -20,7 +22,35 @@ const (
 	maxSession = 180
 )
 
-type publish func(evt *protos.Event) error
+type publish func(ctx context.Context, evt *protos.Event) error
+
+// SessionConfig holds the parameters a session is simulated with, a zero TickInterval
+// means a random interval between 5s and 30s is picked for every session
+type SessionConfig struct {
+	TickInterval time.Duration
+	MinDuration  time.Duration
+	MaxDuration  time.Duration
+	Products     []string
+	// Catalog replaces Products when set, products are drawn from it by popularity
+	Catalog *Catalog
+	// Duration and Tick replace the MinDuration to MaxDuration and 5s to 30s ranges when set
+	Duration *Distribution
+	Tick     *Distribution
+	// Interactions weights the interaction types of events, every type is equally likely when empty
+	Interactions InteractionMix
+	// Shopper replaces the events published every tick with a shopper moving through its states, the
+	// session ends once the shopper leaves and the duration only caps it
+	Shopper *ShopperModel
+}
+
+// DefaultSessionConfig returns the parameters sessions use until a device receives a config
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		MinDuration: minSession * time.Second,
+		MaxDuration: maxSession * time.Second,
+		Products:    shoes,
+	}
+}
 
 type Session struct {
 	DeviceID         string
@@ -31,79 +61,292 @@ type Session struct {
 	PubFn            publish
 	Duration         string
 	InteractionSleep string
+	products         []string
+	catalog          *Catalog
+	interactions     InteractionMix
+	rng              *rand.Rand
+	clock            Clock
+	tick             Timer
+	timeout          Timer
+	shopper          *ShopperModel
+	state            string
+	product          *Product
+	reconfigure      chan SessionConfig
+	end              chan struct{}
+	endOnce          sync.Once
 }
 
-func NewSession(deviceID string, pubFn publish) *Session {
-	rand.Seed(time.Now().UnixNano())
-	tick := time.Second * time.Duration(rand.Intn(maxEvtIter-minEvtIter)+minEvtIter)
-	timeout := time.Second * time.Duration(rand.Intn(maxSession-minSession)+minSession)
+// NewSession returns a session of deviceID drawing its length, events and ID from rng, it waits on
+// clock and stamps its events with it
+func NewSession(deviceID string, pubFn publish, config SessionConfig, rng *rand.Rand, clock Clock) *Session {
+	timeout := sessionDuration(rng, config)
+	s := &Session{
+		DeviceID:     deviceID,
+		ID:           randomUUID(rng).String(),
+		Duration:     timeout.String(),
+		PubFn:        pubFn,
+		products:     config.Products,
+		catalog:      config.Catalog,
+		interactions: config.Interactions,
+		rng:          rng,
+		clock:        clock,
+		timeout:      clock.NewTimer(timeout),
+		reconfigure:  make(chan SessionConfig, 1),
+		end:          make(chan struct{}),
+	}
+	s.SessionTimeout = s.timeout.C()
 
-	return &Session{
-		DeviceID:         deviceID,
-		ID:               fmt.Sprintf("%-%", data.FirstName(rand.Intn(1-0)+0), uuid.NewV1()),
-		EventTick:        time.Tick(tick),
-		SessionTimeout:   time.After(timeout),
-		Duration:         timeout.String(),
-		InteractionSleep: tick.String(),
-		PubFn:            pubFn,
+	if config.Shopper != nil {
+		s.shopper = config.Shopper
+		s.state = ShopperApproach
+		s.pickProduct()
+		s.tick = clock.NewTimer(s.shopper.DwellTime(rng, s.state))
+		s.EventTick = s.tick.C()
+		s.InteractionSleep = "shopper"
+		return s
 	}
+
+	tick := sessionTick(rng, config)
+	s.tick = clock.NewTicker(tick)
+	s.EventTick = s.tick.C()
+	s.InteractionSleep = tick.String()
+	return s
 }
 
-func (s *Session) Start(wg *sync.WaitGroup) {
+// Start publishes events until the session times out, is ended or ctx is done
+func (s *Session) Start(ctx context.Context) {
+	defer s.stopTicks()
+
 	logger.
 		WithField("device-id", s.DeviceID).
 		WithField("duration", s.Duration).
 		WithField("interaction-frequency", fmt.Sprintf("%s", s.InteractionSleep)).
 		Infoln("starting session")
 	for {
+		s.clock.Advance()
 		select {
+		case <-ctx.Done():
+			return
 		case <-s.SessionTimeout:
 			return
+		case <-s.end:
+			logger.WithField("device-id", s.DeviceID).Infoln("session ended early")
+			return
+		case config := <-s.reconfigure:
+			s.apply(config)
 		case <-s.EventTick:
-			err := s.SendEvent()
+			var err error
+			if s.shopper != nil {
+				err = s.step(ctx)
+			} else {
+				err = s.SendEvent(ctx)
+			}
+
 			if err != nil {
 				logger.WithError(err).
 					WithField("device-id", s.DeviceID).
 					Warnln("error sending event during session")
 			}
+
+			if s.state == ShopperLeave {
+				logger.WithField("device-id", s.DeviceID).Infoln("shopper left")
+				return
+			}
 		}
 	}
 }
 
-func (s *Session) SendEvent() error {
-	evt := RandomEvent()
+// Reconfigure changes the tick interval and product set of a running session,
+// the duration range only applies to sessions started afterwards
+func (s *Session) Reconfigure(config SessionConfig) {
+	select {
+	case <-s.reconfigure:
+	default:
+	}
+
+	s.reconfigure <- config
+}
+
+// End stops the session before its timeout
+func (s *Session) End() {
+	s.endOnce.Do(func() {
+		close(s.end)
+	})
+}
+
+func (s *Session) apply(config SessionConfig) {
+	// shoppers publish as they move, their dwell times replace the tick interval
+	if config.TickInterval > 0 && s.shopper == nil {
+		s.tick.Reset(config.TickInterval)
+		s.InteractionSleep = config.TickInterval.String()
+	}
+
+	// products sent as config replace the catalog
+	if len(config.Products) > 0 {
+		s.products = config.Products
+		s.catalog = config.Catalog
+	}
+
+	if len(config.Interactions) > 0 {
+		s.interactions = config.Interactions
+	}
+
+	logger.
+		WithField("device-id", s.DeviceID).
+		WithField("interaction-frequency", s.InteractionSleep).
+		WithField("products", len(s.products)).
+		Infoln("session reconfigured")
+}
+
+func (s *Session) SendEvent(ctx context.Context) error {
+	if s.catalog != nil {
+		return s.publishEvent(ctx, CatalogEvent(s.rng, s.catalog, s.interactions))
+	}
+
+	return s.publishEvent(ctx, RandomEvent(s.rng, s.products, s.interactions))
+}
+
+// step moves the shopper to its next state and publishes the interaction the state starts with
+func (s *Session) step(ctx context.Context) error {
+	s.state = s.shopper.Next(s.rng, s.state)
+	if s.state == ShopperLeave {
+		return nil
+	}
+
+	s.tick.Reset(s.shopper.DwellTime(s.rng, s.state))
+	switch s.state {
+	case ShopperPickUp:
+		return s.publishEvent(ctx, newEvent(s.rng, s.product, protos.INTERACTION_TYPE_PICK_UP))
+	case ShopperBrowse:
+		return s.publishEvent(ctx, newEvent(s.rng, s.product, protos.INTERACTION_TYPE_SCREEN_TOUCH))
+	case ShopperPutDown:
+		// the event schema has no put down interaction, putting a product down only ends the browsing of it
+	case ShopperMove:
+		s.pickProduct()
+	}
+
+	return nil
+}
+
+// pickProduct moves the shopper to a product other than the one it is at, when there is one
+func (s *Session) pickProduct() {
+	if s.catalog != nil {
+		sku := ""
+		if s.product != nil {
+			sku = s.product.SKU
+		}
+
+		s.product = s.catalog.sampleExcept(s.rng, sku)
+		return
+	}
+
+	i := s.rng.Intn(len(s.products))
+	if s.product != nil && s.products[i] == s.product.Name && len(s.products) > 1 {
+		i = (i + 1 + s.rng.Intn(len(s.products)-1)) % len(s.products)
+	}
+
+	s.product = namedProduct(s.products[i])
+}
+
+func (s *Session) stopTicks() {
+	s.tick.Stop()
+	s.timeout.Stop()
+}
+
+func (s *Session) publishEvent(ctx context.Context, evt *protos.Event) error {
+	// events happen at the time of the session clock, which runs ahead of the wall clock in virtual time
+	evt.Timestamp, _ = ptypes.TimestampProto(s.clock.Now())
 	logger.
 		WithField("product-id", evt.ProductId).
 		WithField("product-name", evt.ProductName).
 		WithField("button-name", evt.ButtonName).
 		WithField("interaction-type", evt.InteractionType.String()).
+		WithField("timestamp", ptypes.TimestampString(evt.Timestamp)).
 		Infof("publishing event (device-id: %s)\n", s.DeviceID)
 
-	return s.PubFn(RandomEvent())
+	return s.PubFn(ctx, evt)
+}
+
+func sessionTick(rng *rand.Rand, config SessionConfig) time.Duration {
+	if config.TickInterval > 0 {
+		return config.TickInterval
+	}
+
+	if config.Tick != nil {
+		// tickers need a positive interval
+		if tick := config.Tick.Sample(rng); tick > 0 {
+			return tick
+		}
+
+		return time.Millisecond
+	}
+
+	return time.Second * time.Duration(rng.Intn(maxEvtIter-minEvtIter)+minEvtIter)
 }
 
-func RandomInteraction() protos.INTERACTION_TYPE {
-	rand.Seed(time.Now().Unix())
-	n := rand.Intn(2)
+func sessionDuration(rng *rand.Rand, config SessionConfig) time.Duration {
+	if config.Duration != nil {
+		return config.Duration.Sample(rng)
+	}
+
+	// shoppers end their sessions by leaving, the duration range only caps them
+	if config.Shopper != nil {
+		return config.MaxDuration
+	}
+
+	timeout := config.MinDuration
+	if span := (config.MaxDuration - config.MinDuration) / time.Second; span > 0 {
+		timeout += time.Second * time.Duration(rng.Int63n(int64(span)))
+	}
+
+	return timeout
+}
+
+func RandomInteraction(rng *rand.Rand) protos.INTERACTION_TYPE {
+	n := rng.Intn(len(protos.INTERACTION_TYPE_name))
 	return protos.INTERACTION_TYPE(n)
 }
 
-func RandomShoe() string {
-	rand.Seed(time.Now().Unix())
-	n := rand.Intn(len(shoes) - 1)
-	return shoes[n]
+func RandomShoe(rng *rand.Rand, products []string) string {
+	n := rng.Intn(len(products))
+	return products[n]
 }
 
-// RandomEvent creates a random event filled with random data
-func RandomEvent() *protos.Event {
-	evt := &protos.Event{}
-	evt.ProductName = RandomShoe()
-	evt.InteractionType = RandomInteraction()
-	evt.ProductId = uuid.NewV4().String()
-	evt.Timestamp = ptypes.TimestampNow()
-	if evt.InteractionType == protos.INTERACTION_TYPE_SCREEN_TOUCH {
-		evt.ButtonName = fmt.Sprintf("button-%s", data.SillyName())
+// RandomEvent creates a random event for one of products filled with data drawn from rng, the interaction type
+// is drawn from interactions unless it is empty
+func RandomEvent(rng *rand.Rand, products []string, interactions InteractionMix) *protos.Event {
+	return newEvent(rng, namedProduct(RandomShoe(rng, products)), randomInteraction(rng, interactions))
+}
+
+// CatalogEvent creates a random event for a product drawn from catalog by popularity, screen touches press
+// one of the buttons of the product
+func CatalogEvent(rng *rand.Rand, catalog *Catalog, interactions InteractionMix) *protos.Event {
+	return newEvent(rng, catalog.Sample(rng), randomInteraction(rng, interactions))
+}
+
+func randomInteraction(rng *rand.Rand, interactions InteractionMix) protos.INTERACTION_TYPE {
+	if len(interactions) > 0 {
+		return interactions.Pick(rng)
+	}
+
+	return RandomInteraction(rng)
+}
+
+func newEvent(rng *rand.Rand, product *Product, interaction protos.INTERACTION_TYPE) *protos.Event {
+	evt := &protos.Event{
+		ProductName:     product.Name,
+		ProductId:       product.SKU,
+		InteractionType: interaction,
+		Timestamp:       ptypes.TimestampNow(),
+	}
+
+	if interaction == protos.INTERACTION_TYPE_SCREEN_TOUCH {
+		evt.ButtonName = product.button(rng)
 	}
 
 	return evt
 }
+
+func randomButton(rng *rand.Rand) string {
+	return buttonName(screenButtons[rng.Intn(len(screenButtons))])
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// States a shopper moves through during a session
+const (
+	ShopperApproach = "approach"
+	ShopperPickUp   = "pickUp"
+	ShopperBrowse   = "browse"
+	ShopperPutDown  = "putDown"
+	ShopperMove     = "move"
+	ShopperLeave    = "leave"
+)
+
+// shopperStates lists the states in the order transitions are drawn in, map order is random
+var shopperStates = []string{ShopperApproach, ShopperPickUp, ShopperBrowse, ShopperPutDown, ShopperMove, ShopperLeave}
+
+// ShopperModel is a Markov chain of the states a shopper moves through. Transitions weights the states a
+// state leads to and Dwell is the time spent in a state before moving on. Picking up a product publishes a
+// PICK_UP event and every screen button browsed a SCREEN_TOUCH event for the product held, the session ends
+// once the shopper leaves. States left out of Transitions or Dwell keep the defaults of DefaultShopperModel
+type ShopperModel struct {
+	Transitions map[string]map[string]float64 `yaml:"transitions"`
+	Dwell       map[string]*Distribution      `yaml:"dwell"`
+}
+
+// DefaultShopperModel returns a shopper that picks up a few products, browses some of them and leaves
+func DefaultShopperModel() *ShopperModel {
+	return &ShopperModel{
+		Transitions: map[string]map[string]float64{
+			ShopperApproach: {ShopperPickUp: 0.8, ShopperLeave: 0.2},
+			ShopperPickUp:   {ShopperBrowse: 0.6, ShopperPutDown: 0.4},
+			ShopperBrowse:   {ShopperBrowse: 0.55, ShopperPutDown: 0.45},
+			ShopperPutDown:  {ShopperMove: 0.6, ShopperLeave: 0.4},
+			ShopperMove:     {ShopperPickUp: 0.85, ShopperLeave: 0.15},
+		},
+		Dwell: map[string]*Distribution{
+			ShopperApproach: {Type: DistributionUniform, Min: 2 * time.Second, Max: 8 * time.Second},
+			ShopperPickUp:   {Type: DistributionUniform, Min: 3 * time.Second, Max: 15 * time.Second},
+			ShopperBrowse:   {Type: DistributionUniform, Min: 2 * time.Second, Max: 10 * time.Second},
+			ShopperPutDown:  {Type: DistributionUniform, Min: time.Second, Max: 3 * time.Second},
+			ShopperMove:     {Type: DistributionUniform, Min: 3 * time.Second, Max: 10 * time.Second},
+		},
+	}
+}
+
+// Validate fills the states left out with the defaults and checks a shopper can leave from every state it can get to
+func (m *ShopperModel) Validate() error {
+	defaults := DefaultShopperModel()
+	if m.Transitions == nil {
+		m.Transitions = make(map[string]map[string]float64)
+	}
+
+	if m.Dwell == nil {
+		m.Dwell = make(map[string]*Distribution)
+	}
+
+	for state, next := range m.Transitions {
+		if !validShopperState(state) {
+			return fmt.Errorf("invalid state %s, expected one of %v", state, shopperStates)
+		}
+
+		if state == ShopperLeave {
+			return fmt.Errorf("%s ends the session and has no transitions", ShopperLeave)
+		}
+
+		total := 0.0
+		for to, weight := range next {
+			if !validShopperState(to) {
+				return fmt.Errorf("invalid state %s in transitions of %s", to, state)
+			}
+
+			if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+				return fmt.Errorf("invalid weight %v from %s to %s", weight, state, to)
+			}
+
+			total += weight
+		}
+
+		if total <= 0 {
+			return fmt.Errorf("transitions of %s add up to 0", state)
+		}
+	}
+
+	for state, dwell := range m.Dwell {
+		if !validShopperState(state) || state == ShopperLeave {
+			return fmt.Errorf("invalid state %s in dwell", state)
+		}
+
+		if err := dwell.Validate(); err != nil {
+			return fmt.Errorf("dwell of %s: %s", state, err)
+		}
+	}
+
+	for _, state := range shopperStates[:len(shopperStates)-1] {
+		if m.Transitions[state] == nil {
+			m.Transitions[state] = defaults.Transitions[state]
+		}
+
+		if m.Dwell[state] == nil {
+			m.Dwell[state] = defaults.Dwell[state]
+		}
+	}
+
+	if !m.leaves() {
+		return fmt.Errorf("shoppers can get to states they never %s from", ShopperLeave)
+	}
+
+	return nil
+}
+
+// leaves reports whether leave can be reached from every state reachable from approach, a shopper
+// caught in states that only lead to each other would never end its session
+func (m *ShopperModel) leaves() bool {
+	// walk the transitions backwards from leave to find the states a shopper can leave from
+	canLeave := map[string]bool{ShopperLeave: true}
+	for changed := true; changed; {
+		changed = false
+		for _, state := range shopperStates {
+			if canLeave[state] {
+				continue
+			}
+
+			for to, weight := range m.Transitions[state] {
+				if weight > 0 && canLeave[to] {
+					canLeave[state] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	seen := map[string]bool{ShopperApproach: true}
+	queue := []string{ShopperApproach}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		if !canLeave[state] {
+			return false
+		}
+
+		for to, weight := range m.Transitions[state] {
+			if weight > 0 && !seen[to] {
+				seen[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+
+	return true
+}
+
+// Next draws from rng the state the shopper moves to from state
+func (m *ShopperModel) Next(rng *rand.Rand, state string) string {
+	next := m.Transitions[state]
+	// float addition depends on order, sum in the order the states are drawn in so a seed gives the same walk
+	total := 0.0
+	for _, to := range shopperStates {
+		total += next[to]
+	}
+
+	n := rng.Float64() * total
+	last := ShopperLeave
+	for _, to := range shopperStates {
+		if next[to] <= 0 {
+			continue
+		}
+
+		if n < next[to] {
+			return to
+		}
+
+		n -= next[to]
+		last = to
+	}
+
+	return last
+}
+
+// DwellTime draws from rng how long the shopper stays in state, timers need a positive duration
+func (m *ShopperModel) DwellTime(rng *rand.Rand, state string) time.Duration {
+	if dwell := m.Dwell[state]; dwell != nil {
+		if sample := dwell.Sample(rng); sample > 0 {
+			return sample
+		}
+	}
+
+	return time.Millisecond
+}
+
+func validShopperState(state string) bool {
+	for _, s := range shopperStates {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
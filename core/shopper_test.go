@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"github.com/kc1116/perch-interactive-challenge/core/protos"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestShopperModelValidate(t *testing.T) {
+	cases := []struct {
+		name        string
+		transitions map[string]map[string]float64
+		wantErr     string
+	}{
+		{name: "defaults", transitions: nil},
+		{name: "partial", transitions: map[string]map[string]float64{ShopperBrowse: {ShopperBrowse: 0.7, ShopperPutDown: 0.3}}},
+		{name: "unknown state", transitions: map[string]map[string]float64{"checkout": {ShopperLeave: 1}}, wantErr: "invalid state checkout"},
+		{name: "unknown target", transitions: map[string]map[string]float64{ShopperMove: {"checkout": 1}}, wantErr: "invalid state checkout"},
+		{name: "leave transitions", transitions: map[string]map[string]float64{ShopperLeave: {ShopperApproach: 1}}, wantErr: "has no transitions"},
+		{name: "negative weight", transitions: map[string]map[string]float64{ShopperMove: {ShopperLeave: -1}}, wantErr: "invalid weight"},
+		{name: "zero weights", transitions: map[string]map[string]float64{ShopperMove: {ShopperLeave: 0}}, wantErr: "add up to 0"},
+		{name: "never leaves", transitions: map[string]map[string]float64{ShopperApproach: {ShopperPickUp: 1}, ShopperPickUp: {ShopperBrowse: 1}, ShopperBrowse: {ShopperPickUp: 1}}, wantErr: "never leave"},
+		// approach can leave but shoppers that pick up a product browse it forever
+		{name: "stuck after approach", transitions: map[string]map[string]float64{ShopperBrowse: {ShopperBrowse: 1}}, wantErr: "never leave"},
+		// a cycle that can not be reached from approach does not keep shoppers
+		{name: "unreachable cycle", transitions: map[string]map[string]float64{
+			ShopperApproach: {ShopperLeave: 1},
+			ShopperPickUp:   {ShopperBrowse: 1},
+			ShopperBrowse:   {ShopperPickUp: 1},
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			model := &ShopperModel{Transitions: tc.transitions}
+			err := model.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() error %s", err)
+				}
+
+				if len(model.Transitions) != len(shopperStates)-1 || len(model.Dwell) != len(shopperStates)-1 {
+					t.Errorf("Validate() left states without transitions or dwell: %v %v", model.Transitions, model.Dwell)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Validate() error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestShopperModelNext(t *testing.T) {
+	model := DefaultShopperModel()
+	walk := func(seed int64) []string {
+		rng := rand.New(rand.NewSource(seed))
+		states := []string{ShopperApproach}
+		for state := ShopperApproach; state != ShopperLeave; {
+			state = model.Next(rng, state)
+			if _, ok := model.Transitions[states[len(states)-1]][state]; !ok {
+				t.Fatalf("Next(%s) = %s, want a state it has a transition to", states[len(states)-1], state)
+			}
+			states = append(states, state)
+		}
+
+		return states
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		if first, again := walk(seed), walk(seed); strings.Join(first, ",") != strings.Join(again, ",") {
+			t.Fatalf("walks with seed %d differ: %v and %v", seed, first, again)
+		}
+	}
+}
+
+func TestShopperSession(t *testing.T) {
+	// the shopper picks up a product, browses it, puts it down and leaves
+	model := &ShopperModel{Transitions: map[string]map[string]float64{
+		ShopperApproach: {ShopperPickUp: 1},
+		ShopperPickUp:   {ShopperBrowse: 1},
+		ShopperBrowse:   {ShopperPutDown: 1},
+		ShopperPutDown:  {ShopperLeave: 1},
+	}}
+	if err := model.Validate(); err != nil {
+		t.Fatalf("Validate() error %s", err)
+	}
+
+	var events []*protos.Event
+	record := func(_ context.Context, evt *protos.Event) error {
+		events = append(events, evt)
+		return nil
+	}
+
+	config := DefaultSessionConfig()
+	config.Shopper = model
+	session := NewSession("device-1", record, config, rand.New(rand.NewSource(1)), WallClock())
+	defer session.stopTicks()
+
+	var states []string
+	for session.state != ShopperLeave {
+		if err := session.step(context.Background()); err != nil {
+			t.Fatalf("step() error %s", err)
+		}
+		states = append(states, session.state)
+	}
+
+	if got := strings.Join(states, ","); got != "pickUp,browse,putDown,leave" {
+		t.Fatalf("shopper moved through %s, want pickUp,browse,putDown,leave", got)
+	}
+
+	// putting the product down publishes nothing, the schema has no interaction for it
+	if len(events) != 2 || events[0].InteractionType != protos.INTERACTION_TYPE_PICK_UP || events[1].InteractionType != protos.INTERACTION_TYPE_SCREEN_TOUCH {
+		t.Fatalf("published %v, want a PICK_UP then a SCREEN_TOUCH", events)
+	}
+
+	if events[0].ProductId != events[1].ProductId || events[1].ButtonName == "" {
+		t.Errorf("browsed %s with button %q, want the product picked up %s", events[1].ProductId, events[1].ButtonName, events[0].ProductId)
+	}
+}
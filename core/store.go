@@ -1,43 +1,59 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/kc1116/perch-interactive-challenge/core/protos"
 	"github.com/olahol/melody"
 	r "gopkg.in/rethinkdb/rethinkdb-go.v5"
-	"gopkg.in/vrecan/death.v3"
-	"os"
-	SYS "syscall"
+	"net/http"
 	"time"
 )
 
+// WSProxyAddr is the address StartWSProxy serves websocket clients on
+const WSProxyAddr = ":8000"
+
 type Interaction struct {
 	ID              string `gorethink:"identifier,omitempty"`
 	Timestamp       string `gorethink:"timestamp,omitempty"`
 	ProductName     string `gorethink:"productName,omitempty"`
 	InteractionType string `gorethink:"interactionType,omitempty"`
+	DeviceID        string `gorethink:"deviceId,omitempty"`
+	StoreID         string `gorethink:"storeId,omitempty"`
+	Fixture         string `gorethink:"fixture,omitempty"`
+	Aisle           string `gorethink:"aisle,omitempty"`
+	Timezone        string `gorethink:"timezone,omitempty"`
+	// LocalTime is Timestamp in the timezone of the store
+	LocalTime string `gorethink:"localTime,omitempty"`
+	// Category and Price come from the product catalog
+	Category string  `gorethink:"category,omitempty"`
+	Price    float64 `gorethink:"price,omitempty"`
 }
 
 type Store struct {
 	session *r.Session
-	Shutdown chan bool
 }
 
-func (s *Store) Init() error {
-	_ = r.DBDrop("interactions").Exec(s.session)
-	_ = r.DBCreate("interactions").Exec(s.session)
-	_ = r.DB("interactions").TableCreate("events").Exec(s.session)
-	_ = r.DB("interactions").Table("events").IndexCreate("productName").Exec(s.session)
-
+func (s *Store) Init(ctx context.Context) error {
+	opts := r.ExecOpts{Context: ctx}
+	_ = r.DBDrop("interactions").Exec(s.session, opts)
+	_ = r.DBCreate("interactions").Exec(s.session, opts)
+	_ = r.DB("interactions").TableCreate("events").Exec(s.session, opts)
+	_ = r.DB("interactions").Table("events").IndexCreate("productName").Exec(s.session, opts)
+	_ = r.DB("interactions").Table("events").IndexCreate("storeId").Exec(s.session, opts)
 
 	return nil
 }
 
-func (s *Store) PutEvt(evt *protos.Event) error {
-	interaction := NewInteraction(evt)
-	_, err := r.DB("interactions").Table("events").Insert(interaction).RunWrite(s.session)
+func (s *Store) PutEvt(ctx context.Context, evt *protos.Event) error {
+	return s.PutInteraction(ctx, NewInteraction(evt))
+}
+
+// PutInteraction stores interaction as is
+func (s *Store) PutInteraction(ctx context.Context, interaction *Interaction) error {
+	_, err := r.DB("interactions").Table("events").Insert(interaction).RunWrite(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
 		logger.Errorln(err)
 		return err
@@ -46,82 +62,85 @@ func (s *Store) PutEvt(evt *protos.Event) error {
 	return nil
 }
 
-func (s *Store) GetStream() (*r.Cursor, error)  {
-	return r.Table("events").Changes().Run(s.session)
-}
-
-func (s *Store) Close() error {
-	logger.Infoln("shutting down socket server gracefully")
-
-	close(s.Shutdown)
-	return nil
+// GetStream returns a changefeed of the events table, the cursor is closed once ctx is done
+func (s *Store) GetStream(ctx context.Context) (*r.Cursor, error) {
+	return r.Table("events").Changes().Run(s.session, r.RunOpts{Context: ctx})
 }
 
-func (s *Store) StartWSProxy()  {
-	r := gin.Default()
+// StartWSProxy broadcasts every stored interaction to the websocket clients connected on WSProxyAddr
+// until ctx is done
+func (s *Store) StartWSProxy(ctx context.Context) error {
+	router := gin.Default()
 	m := melody.New()
-	r.GET("/ws", func(c *gin.Context) {
+	router.GET("/ws", func(c *gin.Context) {
 		m.HandleRequest(c.Writer, c.Request)
 	})
 
-	signalWatcher := death.NewDeath(SYS.SIGINT, SYS.SIGTERM, SYS.SIGKILL, os.Interrupt)
+	stream, err := s.GetStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	server := &http.Server{Addr: WSProxyAddr, Handler: router}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
 	logger.Infoln("starting websocket client proxy . . .")
-	go r.Run(":8000")
-	go func(m *melody.Melody) {
-		interactionCh := make(chan interface{})
-		stream, err := s.GetStream()
-		if err != nil {
-			logger.Fatalln(err)
-		}
+	interactionCh := make(chan interface{})
+	stream.Listen(interactionCh)
+
+	for {
+		select {
+		case err := <-serveErr:
+			_ = m.Close()
+			return err
+		case <-ctx.Done():
+			logger.Infoln("shutting down socket server gracefully")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), CleanupTimeout)
+			defer cancel()
+
+			_ = m.Close()
+			return server.Shutdown(shutdownCtx)
+		case interaction, ok := <-interactionCh:
+			if !ok {
+				// the changefeed ends when ctx is done, wait for it to shut the server down
+				if ctx.Err() == nil {
+					logger.Errorln("interaction changefeed ended ", stream.Err())
+				}
 
-		stream.Listen(interactionCh)
+				interactionCh = nil
+				continue
+			}
 
-		for {
-			select {
-			case <- s.Shutdown:
-				s.session.Close()
-				m.Close()
-				return
-			case interaction := <- interactionCh:
-				if interaction == nil {
+			data, _ := interaction.(map[string]interface{})
+			if val, ok := data["new_val"]; ok {
+				b, err := json.Marshal(val)
+				if err != nil {
+					logger.Errorln("error unmarshalling interaction from chan ", err)
 					continue
 				}
-				data := interaction.(map[string]interface{})
-				if val, ok := data["new_val"]; ok {
-					b, err := json.Marshal(val)
-					if err != nil {
-						logger.Errorln("error unmarshalling interaction from chan ", err)
-						continue
-					}
-
-					err = m.Broadcast(b)
-					if err != nil {
-						logger.Errorln("error broadcasting interaction to clients ", err)
-					}
+
+				err = m.Broadcast(b)
+				if err != nil {
+					logger.Errorln("error broadcasting interaction to clients ", err)
 				}
 			}
 		}
-	}(m)
-	err := signalWatcher.WaitForDeath(s)
-	if err != nil {
-		logger.Fatalln(err)
 	}
 }
 
-func NewStore(host, database string) (*Store, error) {
-	session, err := r.Connect(r.ConnectOpts{
-		Address:    host, // "127.0.0.1:28015" default
-		Database:   database,
-		InitialCap: 10,
-		MaxOpen:    10,
-	})
-
+// NewStore returns a store using the session clients has for host e.g. 127.0.0.1:28015 and database
+func NewStore(clients *Clients, host, database string) (*Store, error) {
+	session, err := clients.RethinkDB(host, database)
 	if err != nil {
 		logger.Errorf("error creating rethinkdb connection: %s", err)
 		return nil, err
 	}
 
-	return &Store{session,make(chan bool)}, nil
+	return &Store{session}, nil
 }
 
 func NewInteraction(evt *protos.Event) *Interaction {
@@ -134,3 +153,35 @@ func NewInteraction(evt *protos.Event) *Interaction {
 		InteractionType: evt.GetInteractionType().String(),
 	}
 }
+
+// WithProduct replaces the product name the device sent with the catalog entry and adds its category and price
+func (i *Interaction) WithProduct(product *Product) *Interaction {
+	i.ProductName = product.Name
+	i.Category = product.Category
+	i.Price = product.Price
+	return i
+}
+
+// WithDevice adds the device the interaction happened on and where it is installed
+func (i *Interaction) WithDevice(deviceID string, metadata DeviceMetadata) *Interaction {
+	i.DeviceID = deviceID
+	i.StoreID = metadata.StoreID
+	i.Fixture = metadata.Fixture
+	i.Aisle = metadata.Aisle
+	i.Timezone = metadata.Timezone
+
+	if metadata.Timezone == "" {
+		return i
+	}
+
+	location, err := time.LoadLocation(metadata.Timezone)
+	if err != nil {
+		return i
+	}
+
+	if t, err := time.Parse(time.RFC3339, i.Timestamp); err == nil {
+		i.LocalTime = t.In(location).Format(time.RFC3339)
+	}
+
+	return i
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	TransportGoogle = "google"
+	TransportMQTT   = "mqtt"
+	TransportMemory = "memory"
+	TransportHTTP   = "http"
+)
+
+// ErrTopicNotSupported is returned by Subscribe when a transport has no way of receiving a topic
+var ErrTopicNotSupported = errors.New("topic not supported by transport")
+
+// MessageHandler is called for every message received on a subscribed topic
+type MessageHandler func(topic string, payload []byte)
+
+// Transport is the connection a Device uses to reach a message broker
+type Transport interface {
+	Connect(ctx context.Context) error
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Subscribe(ctx context.Context, topic string, handler MessageHandler) error
+	Close() error
+}
+
+// PendingError is returned when the broker did not acknowledge a publish in time but the transport keeps the
+// message and sends it again once reconnected, it must not be queued or retried or it is delivered twice
+type PendingError struct {
+	Topic string
+	Err   error
+}
+
+func (e *PendingError) Error() string {
+	return fmt.Sprintf("publish to %s not acknowledged, it is resent once reconnected: %s", e.Topic, e.Err)
+}
+
+// Reconnector is implemented by transports that can re-establish their connection with fresh credentials
+type Reconnector interface {
+	Reconnect(ctx context.Context) error
+}
+
+// ConnectNotifier is implemented by transports that reconnect on their own, fn is called every time
+// the connection is re-established
+type ConnectNotifier interface {
+	OnReconnect(fn func())
+}
+
+// MemoryBroker routes messages between in-memory transports living in the same process. Filters with
+// wildcards are indexed by the levels before their first wildcard so publishing does not go through the
+// subscriptions of every device
+type MemoryBroker struct {
+	subs      map[string][]MessageHandler
+	wildcards map[string][]string
+	sync.RWMutex
+}
+
+// Publish delivers payload to every handler subscribed to a matching topic filter
+func (b *MemoryBroker) Publish(topic string, payload []byte) {
+	b.RLock()
+	handlers := append([]MessageHandler(nil), b.subs[topic]...)
+	for _, prefix := range topicPrefixes(topic) {
+		for _, filter := range b.wildcards[prefix] {
+			if TopicMatches(filter, topic) {
+				handlers = append(handlers, b.subs[filter]...)
+			}
+		}
+	}
+	b.RUnlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+}
+
+// Subscribe registers handler for every topic matching filter
+func (b *MemoryBroker) Subscribe(filter string, handler MessageHandler) {
+	b.Lock()
+	if _, ok := b.subs[filter]; !ok {
+		if prefix, ok := wildcardPrefix(filter); ok {
+			b.wildcards[prefix] = append(b.wildcards[prefix], filter)
+		}
+	}
+
+	b.subs[filter] = append(b.subs[filter], handler)
+	b.Unlock()
+}
+
+// NewMemoryBroker returns an empty in-memory broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: make(map[string][]MessageHandler), wildcards: make(map[string][]string)}
+}
+
+// wildcardPrefix returns the levels of filter before its first wildcard including the trailing /, false
+// when filter has no wildcards
+func wildcardPrefix(filter string) (string, bool) {
+	start := 0
+	for i := 0; i <= len(filter); i++ {
+		if i < len(filter) && filter[i] != '/' {
+			continue
+		}
+
+		if level := filter[start:i]; level == "+" || level == "#" {
+			return filter[:start], true
+		}
+
+		start = i + 1
+	}
+
+	return "", false
+}
+
+// topicPrefixes returns every prefix of topic a wildcard filter matching it can be indexed by, a # matches
+// the level before it too so topic itself with a trailing / is one of them
+func topicPrefixes(topic string) []string {
+	prefixes := []string{""}
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '/' {
+			prefixes = append(prefixes, topic[:i+1])
+		}
+	}
+
+	return append(prefixes, topic+"/")
+}
+
+// MemoryTransport is a Transport backed by a MemoryBroker, it never leaves the process
+type MemoryTransport struct {
+	broker    *MemoryBroker
+	connected bool
+	sync.Mutex
+}
+
+// Connect marks the transport connected, there is nothing to dial
+func (t *MemoryTransport) Connect(_ context.Context) error {
+	t.Lock()
+	t.connected = true
+	t.Unlock()
+	return nil
+}
+
+// Publish hands payload to the broker, it returns once every matching handler ran
+func (t *MemoryTransport) Publish(_ context.Context, topic string, payload []byte) error {
+	t.Lock()
+	connected := t.connected
+	t.Unlock()
+	if !connected {
+		return fmt.Errorf("memory transport is not connected")
+	}
+
+	t.broker.Publish(topic, payload)
+	return nil
+}
+
+// Subscribe registers handler with the broker, it works before the transport is connected
+func (t *MemoryTransport) Subscribe(_ context.Context, topic string, handler MessageHandler) error {
+	t.broker.Subscribe(topic, handler)
+	return nil
+}
+
+// Close makes further publishes fail, subscriptions stay registered with the broker
+func (t *MemoryTransport) Close() error {
+	t.Lock()
+	t.connected = false
+	t.Unlock()
+	return nil
+}
+
+// NewMemoryTransport returns a Transport that publishes to broker
+func NewMemoryTransport(broker *MemoryBroker) *MemoryTransport {
+	return &MemoryTransport{broker: broker}
+}
+
+// TopicMatches reports whether topic matches an MQTT topic filter that may contain + and # wildcards
+func TopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
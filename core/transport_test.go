@@ -0,0 +1,108 @@
+package core
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"/devices/d1/events", "/devices/d1/events", true},
+		{"/devices/d1/events", "/devices/d2/events", false},
+		{"/devices/+/events", "/devices/d1/events", true},
+		{"/devices/+/events", "/devices/d1/events/telemetry", false},
+		{"/devices/+/events/+", "/devices/d1/events", false},
+		{"/devices/d1/commands/#", "/devices/d1/commands/end-session", true},
+		{"/devices/d1/commands/#", "/devices/d1/commands", true},
+		{"/devices/d1/commands/#", "/devices/d1/config", false},
+		{"#", "/devices/d1/state", true},
+		{"/devices/d1", "/devices/d1/state", false},
+	}
+
+	for _, tc := range cases {
+		if got := TopicMatches(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("TopicMatches(%q, %q) = %t, want %t", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryBrokerPublish(t *testing.T) {
+	filters := []string{
+		"/devices/d1/events",
+		"/devices/+/events",
+		"/devices/d1/commands/#",
+		"/devices/+/commands/+",
+		"#",
+	}
+
+	cases := []struct {
+		topic string
+		want  []string
+	}{
+		{"/devices/d1/events", []string{"#", "/devices/+/events", "/devices/d1/events"}},
+		{"/devices/d2/events", []string{"#", "/devices/+/events"}},
+		{"/devices/d1/commands", []string{"#", "/devices/d1/commands/#"}},
+		{"/devices/d1/commands/end-session", []string{"#", "/devices/+/commands/+", "/devices/d1/commands/#"}},
+		{"/devices/d2/commands/a/b", []string{"#"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.topic, func(t *testing.T) {
+			broker := NewMemoryBroker()
+			var got []string
+			for _, filter := range filters {
+				filter := filter
+				broker.Subscribe(filter, func(topic string, payload []byte) {
+					if topic != tc.topic || string(payload) != "payload" {
+						t.Errorf("%s received %s on %s", filter, payload, topic)
+					}
+					got = append(got, filter)
+				})
+			}
+
+			broker.Publish(tc.topic, []byte("payload"))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Publish(%s) reached %v, want %v", tc.topic, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	received := 0
+	broker.Subscribe("/devices/d1/events", func(string, []byte) { received++ })
+
+	transport := NewMemoryTransport(broker)
+	if err := transport.Publish(ctx, "/devices/d1/events", []byte("before connect")); err == nil {
+		t.Errorf("Publish() before Connect() succeeded, want error")
+	}
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error %s", err)
+	}
+
+	if err := transport.Publish(ctx, "/devices/d1/events", []byte("connected")); err != nil {
+		t.Errorf("Publish() error %s", err)
+	}
+
+	if err := transport.Close(); err != nil {
+		t.Fatalf("Close() error %s", err)
+	}
+
+	if err := transport.Publish(ctx, "/devices/d1/events", []byte("after close")); err == nil {
+		t.Errorf("Publish() after Close() succeeded, want error")
+	}
+
+	if received != 1 {
+		t.Errorf("subscriber received %d messages, want 1", received)
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// googleRootsPEM is the https://pki.google.com/roots.pem bundle the IoT Core MQTT bridge chains up to
+//
+//go:embed google-cert/roots.pem
+var googleRootsPEM []byte
+
+var (
+	googleRootsOnce sync.Once
+	googleRoots     *x509.CertPool
+)
+
+// TLSOptions describes how transports verify brokers and, optionally, authenticate themselves with a client cert
+type TLSOptions struct {
+	// CAFile is a PEM bundle that replaces the default roots
+	CAFile string
+	// ClientCert and ClientKey are a PEM encoded cert and key presented to brokers that require mutual TLS
+	ClientCert string
+	ClientKey  string
+}
+
+// Config builds the tls config described by the options, brokers are verified against defaultRoots
+// unless a CAFile is set. A nil defaultRoots means the system roots
+func (o TLSOptions) Config(defaultRoots *x509.CertPool) (*tls.Config, error) {
+	roots, err := o.rootCAs(defaultRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if o.ClientCert == "" && o.ClientKey == "" {
+		return config, nil
+	}
+
+	if o.ClientCert == "" || o.ClientKey == "" {
+		return nil, fmt.Errorf("both a client cert and a client key are required for mutual tls")
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client cert %s: %s", o.ClientCert, err)
+	}
+
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// Empty reports whether no option is set
+func (o TLSOptions) Empty() bool {
+	return o.CAFile == "" && o.ClientCert == "" && o.ClientKey == ""
+}
+
+func (o TLSOptions) rootCAs(defaultRoots *x509.CertPool) (*x509.CertPool, error) {
+	if o.CAFile == "" {
+		return defaultRoots, nil
+	}
+
+	pemCerts, err := ioutil.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("can not load ca file %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in ca file %s", o.CAFile)
+	}
+
+	return pool, nil
+}
+
+// GoogleRoots returns the embedded google root CAs, they are parsed the first time they are needed
+func GoogleRoots() *x509.CertPool {
+	googleRootsOnce.Do(func() {
+		googleRoots = x509.NewCertPool()
+		googleRoots.AppendCertsFromPEM(googleRootsPEM)
+	})
+
+	return googleRoots
+}
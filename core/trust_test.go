@@ -0,0 +1,127 @@
+package core
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestCert writes a self signed cert and its key to dir, it returns the cert, cert path and key path
+func writeTestCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, template, err := CreateKey(KeyAlgorithmES256)
+	if err != nil {
+		t.Fatalf("CreateKey() error %s", err)
+	}
+
+	cert, certPEM, err := CreateCert(template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("CreateCert() error %s", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("error encoding key %s", err)
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("error writing cert %s", err)
+	}
+
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("error writing key %s", err)
+	}
+
+	return cert, certPath, keyPath
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perch-tls")
+	if err != nil {
+		t.Fatalf("error creating temp dir %s", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	ca, certPath, keyPath := writeTestCert(t, dir)
+	emptyPath := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(emptyPath, []byte("no certs here"), 0600); err != nil {
+		t.Fatalf("error writing file %s", err)
+	}
+
+	defaultRoots := x509.NewCertPool()
+	cases := []struct {
+		name            string
+		options         TLSOptions
+		wantErr         bool
+		wantDefault     bool
+		wantClientCerts int
+	}{
+		{name: "default roots", wantDefault: true},
+		{name: "ca file replaces the default roots", options: TLSOptions{CAFile: certPath}},
+		{name: "missing ca file", options: TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, wantErr: true},
+		{name: "ca file without certs", options: TLSOptions{CAFile: emptyPath}, wantErr: true},
+		{name: "client cert", options: TLSOptions{ClientCert: certPath, ClientKey: keyPath}, wantDefault: true, wantClientCerts: 1},
+		{name: "client cert without key", options: TLSOptions{ClientCert: certPath}, wantErr: true},
+		{name: "client key that does not match", options: TLSOptions{ClientCert: certPath, ClientKey: emptyPath}, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := tc.options.Config(defaultRoots)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Config() succeeded, want error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Config() error %s", err)
+			}
+
+			if (config.RootCAs == defaultRoots) != tc.wantDefault {
+				t.Errorf("config uses the default roots %t, want %t", config.RootCAs == defaultRoots, tc.wantDefault)
+			}
+
+			if !tc.wantDefault {
+				if _, err := ca.Verify(x509.VerifyOptions{Roots: config.RootCAs}); err != nil {
+					t.Errorf("ca file cert does not verify against the config roots %s", err)
+				}
+			}
+
+			if len(config.Certificates) != tc.wantClientCerts {
+				t.Errorf("config has %d client certs, want %d", len(config.Certificates), tc.wantClientCerts)
+			}
+		})
+	}
+}
+
+func TestGoogleRoots(t *testing.T) {
+	count := 0
+	for rest := googleRootsPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			t.Fatalf("embedded root %d does not parse %s", count, err)
+		}
+		count++
+	}
+
+	if count == 0 {
+		t.Fatalf("no certs embedded in the google roots bundle")
+	}
+
+	if GoogleRoots() != GoogleRoots() {
+		t.Errorf("GoogleRoots() parses the bundle on every call, want it parsed once")
+	}
+}
@@ -1,6 +1,9 @@
 package core
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -9,6 +12,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gogo/protobuf/proto"
 	"github.com/kc1116/perch-interactive-challenge/core/protos"
 	"github.com/sirupsen/logrus"
@@ -21,7 +25,16 @@ var logger = logrus.New()
 const (
 	mqttClientIDFMT      = "projects/%s/locations/%s/registries/%s/devices/%s"
 	interactionsTopicFMT = "/devices/%s/events/interactions"
+	configTopicFMT       = "/devices/%s/config"
+	commandsTopicFMT     = "/devices/%s/commands"
+	stateTopicFMT        = "/devices/%s/state"
 	parentFMT            = "projects/%s/locations/%s"
+	registryNameFMT      = "projects/%s/locations/%s/registries/%s"
+)
+
+const (
+	KeyAlgorithmRS256 = "RS256"
+	KeyAlgorithmES256 = "ES256"
 )
 
 func Logger() *logrus.Logger {
@@ -38,11 +51,16 @@ func DeviceRegistryParent(projectID, region string) string {
 	return fmt.Sprintf(parentFMT, projectID, region)
 }
 
+// RegistryName returns the full resource name of a registry
+func RegistryName(projectID, region, registryID string) string {
+	return fmt.Sprintf(registryNameFMT, projectID, region, registryID)
+}
+
 // https://ericchiang.github.io/post/go-tls/ this blog post was the only post that properly explained TLS Certs etc
 // before that google iot-core docs are super vague about what you need to actually do
 
 // helper function to create a cert template with a serial number and other required fields
-func CertTemplate() (*x509.Certificate, error) {
+func CertTemplate(algorithm string) (*x509.Certificate, error) {
 	// generate a random serial number (a real cert authority would have some logic behind this)
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -53,9 +71,9 @@ func CertTemplate() (*x509.Certificate, error) {
 	tmpl := x509.Certificate{
 		SerialNumber:          serialNumber,
 		Subject:               pkix.Name{CommonName: "unused"},
-		SignatureAlgorithm:    x509.SHA256WithRSA,
+		SignatureAlgorithm:    SignatureAlgorithm(algorithm),
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(24 * time.Hour), // valid for an hour
+		NotAfter:              time.Now().Add(DefaultCertValidity),
 		BasicConstraintsValid: true,
 	}
 	return &tmpl, nil
@@ -80,16 +98,36 @@ func CreateCert(template, parent *x509.Certificate, pub interface{}, parentPriv
 	return
 }
 
-func CreateKey() (*rsa.PrivateKey, *x509.Certificate, error) {
+// CreateKey generates a key-pair for algorithm, RSA-2048 for RS256 and P-256 for ES256
+func CreateKey(algorithm string) (crypto.Signer, *x509.Certificate, error) {
 	// generate a new key-pair
-	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	var rootKey crypto.Signer
+	var err error
+	switch algorithm {
+	case KeyAlgorithmRS256:
+		rootKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgorithmES256:
+		rootKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("unsupported key algorithm %s", algorithm)
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("generating random key: %v", err)
 	}
 
-	rootCertTmpl, err := CertTemplate()
+	rootCertTmpl, err := RootCertTemplate(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rootKey, rootCertTmpl, nil
+}
+
+// RootCertTemplate returns the template for the self signed cert a device key is registered with
+func RootCertTemplate(algorithm string) (*x509.Certificate, error) {
+	rootCertTmpl, err := CertTemplate(algorithm)
 	if err != nil {
-		return nil, nil, fmt.Errorf("creating cert template: %v", err)
+		return nil, fmt.Errorf("creating cert template: %v", err)
 	}
 
 	// describe what the certificate will be used for
@@ -97,7 +135,39 @@ func CreateKey() (*rsa.PrivateKey, *x509.Certificate, error) {
 	rootCertTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
 	rootCertTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
 
-	return rootKey, rootCertTmpl, nil
+	return rootCertTmpl, nil
+}
+
+// ValidKeyAlgorithm reports whether algorithm is one we can create device credentials for
+func ValidKeyAlgorithm(algorithm string) bool {
+	return algorithm == KeyAlgorithmRS256 || algorithm == KeyAlgorithmES256
+}
+
+// SignatureAlgorithm returns the x509 signature algorithm for certs signed with an algorithm key
+func SignatureAlgorithm(algorithm string) x509.SignatureAlgorithm {
+	if algorithm == KeyAlgorithmES256 {
+		return x509.ECDSAWithSHA256
+	}
+
+	return x509.SHA256WithRSA
+}
+
+// SigningMethod returns the JWT signing method for an algorithm key
+func SigningMethod(algorithm string) jwt.SigningMethod {
+	if algorithm == KeyAlgorithmES256 {
+		return jwt.SigningMethodES256
+	}
+
+	return jwt.SigningMethodRS256
+}
+
+// CredentialFormat returns the IoT Core public key format for an algorithm cert
+func CredentialFormat(algorithm string) string {
+	if algorithm == KeyAlgorithmES256 {
+		return "ES256_X509_PEM"
+	}
+
+	return "RSA_X509_PEM"
 }
 
 // EncodeEvent base64 encode event proto bytes
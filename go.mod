@@ -1,12 +1,12 @@
 module github.com/kc1116/perch-interactive-challenge
 
+go 1.16
+
 require (
+	cloud.google.com/go v0.46.3 // indirect
 	cloud.google.com/go/pubsub v1.0.1
-	cloud.google.com/go/storage v1.0.0 // indirect
-	github.com/Pallinder/go-randomdata v1.2.0
 	github.com/bitly/go-hostpool v0.0.0-20171023180738-a3a6125de932 // indirect
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
-	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gin-contrib/sse v0.1.0 // indirect
@@ -24,7 +24,6 @@ require (
 	github.com/pelletier/go-toml v1.4.0 // indirect
 	github.com/satori/go.uuid v1.2.0
 	github.com/sirupsen/logrus v1.4.2
-	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337 // indirect
 	github.com/spf13/afero v1.2.2 // indirect
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
@@ -34,7 +33,7 @@ require (
 	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/ugorji/go v1.1.7 // indirect
 	go.opencensus.io v0.22.1 // indirect
-	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392 // indirect
+	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392
 	golang.org/x/exp v0.0.0-20190919035709-81c71964d733 // indirect
 	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
@@ -42,9 +41,9 @@ require (
 	golang.org/x/tools v0.0.0-20190924021748-035fdb12d3f0 // indirect
 	google.golang.org/api v0.10.0
 	google.golang.org/appengine v1.6.2 // indirect
-	google.golang.org/genproto v0.0.0-20190916214212-f660b8655731 // indirect
-	google.golang.org/grpc v1.23.1 // indirect
+	google.golang.org/genproto v0.0.0-20190916214212-f660b8655731
+	google.golang.org/grpc v1.23.1
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/rethinkdb/rethinkdb-go.v5 v5.0.1
-	gopkg.in/vrecan/death.v3 v3.0.1
+	gopkg.in/yaml.v2 v2.2.2
 )